@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	Merge *ArgMerge `arg:"subcommand:merge"`
+	Diff  *ArgDiff  `arg:"subcommand:diff"`
+}
+
+type ArgMerge struct {
+	Inputs []string `arg:"positional,required" help:"CDL json files to combine"`
+	Output string   `arg:"--output,-o,required"`
+}
+
+type ArgDiff struct {
+	Base   string `arg:"positional,required" help:"CDL json file to compare against"`
+	Other  string `arg:"positional,required" help:"CDL json file with new coverage"`
+	Output string `arg:"--output,-o" help:"write the difference as a CDL json file"`
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+	var err error
+
+	switch {
+	case args.Merge != nil:
+		err = merge(args.Merge)
+	case args.Diff != nil:
+		err = diff(args.Diff)
+	default:
+		fmt.Fprintln(os.Stderr, "Missing command")
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func merge(args *ArgMerge) error {
+	cdl, err := script.CdlFromJsonFile(args.Inputs[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args.Inputs[0], err)
+	}
+
+	for _, filename := range args.Inputs[1:] {
+		other, err := script.CdlFromJsonFile(filename)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		err = cdl.Merge(other)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	return cdl.WriteToFile(args.Output)
+}
+
+func diff(args *ArgDiff) error {
+	base, err := script.CdlFromJsonFile(args.Base)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args.Base, err)
+	}
+
+	other, err := script.CdlFromJsonFile(args.Other)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args.Other, err)
+	}
+
+	d := base.Diff(other)
+	if args.Output != "" {
+		return d.WriteToFile(args.Output)
+	}
+
+	_, err = d.WriteTo(os.Stdout)
+	fmt.Println()
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	Output string `arg:"positional" help:"markdown file to write (default stdout)"`
+	Instructions string `arg:"--instructions" help:"instruction table overrides"`
+}
+
+func run(args *Arguments) error {
+	if args.Instructions != "" {
+		err := script.LoadInstructionsFile(args.Instructions)
+		if err != nil {
+			return fmt.Errorf("Instruction table error: %w", err)
+		}
+	}
+
+	outfile := os.Stdout
+	if args.Output != "" {
+		var err error
+		outfile, err = os.Create(args.Output)
+		if err != nil {
+			return fmt.Errorf("unable to create output file: %w", err)
+		}
+		defer outfile.Close()
+	}
+
+	return script.WriteInstructionDocs(outfile)
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+
+	err := run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
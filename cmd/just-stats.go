@@ -1,26 +1,34 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"io/fs"
 	"slices"
 
 	"github.com/alexflint/go-arg"
 
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/rom"
 	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
 )
 
 type Arguments struct {
 	BaseDir string `arg:"positional,required"`
-	Output  string `arg:"positional,required"`
+	Output  string `arg:"positional,required" help:"stats file (.json, .csv or text)"`
+	Instructions string `arg:"--instructions" help:"instruction table overrides"`
+	Workers int    `arg:"--workers" help:"number of files to parse at once (default: number of CPUs)"`
+	Report  string `arg:"--report" help:"also write the parse failure summary to this file"`
 }
 
 type Walker struct {
 	Found []string
 	CDLs  []string
+	Roms  []string
 }
 
 func (w *Walker) WalkFunc(path string, info fs.DirEntry, err error) error {
@@ -36,10 +44,136 @@ func (w *Walker) WalkFunc(path string, info fs.DirEntry, err error) error {
 		w.CDLs = append(w.CDLs, path)
 	}
 
+	if strings.HasSuffix(strings.ToLower(path), ".studybox") {
+		w.Roms = append(w.Roms, path)
+	}
+
 	return nil
 }
 
+// Job is one file to parse.  A .studybox file has a result for each script.
+type Job struct {
+	File string
+	Rom  bool
+	CDL  string // CDL for a script file, if there is one
+}
+
+type Result struct {
+	File     string
+	Scripts  []*ScriptResult
+	Err      error    // the file couldn't be read
+	Warnings []string // problems that didn't stop the parse
+}
+
+type ScriptResult struct {
+	Name  string
+	Stats script.Stats
+	Err   error
+}
+
+// Parse failures are grouped by these errors.  Anything else is "other".
+var errorGroups = []error{
+	script.ErrEarlyEOF,
+	script.ErrNavigation,
+	script.ErrInvalidInstruction,
+}
+
+type Failure struct {
+	Name string
+	Err  error
+}
+
+func (job Job) Run() *Result {
+	res := &Result{File: job.File, Scripts: []*ScriptResult{}, Warnings: []string{}}
+
+	if !job.Rom {
+		var cdl *script.CodeDataLog
+		if job.CDL != "" {
+			var err error
+			cdl, err = script.CdlFromJsonFile(job.CDL)
+			if err != nil {
+				res.Warnings = append(res.Warnings, fmt.Sprintf("CDL read error: %s", err))
+				cdl = nil
+			}
+		}
+
+		sr := &ScriptResult{Name: job.File}
+		scr, err := script.SmartParseFile(job.File, 0x6000, cdl)
+		sr.Err = err
+		if scr != nil {
+			sr.Stats = scr.SourceStats(filepath.Dir(job.File), job.File)
+		}
+		res.Scripts = append(res.Scripts, sr)
+		return res
+	}
+
+	sb, err := rom.ReadFile(job.File)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	for pidx, page := range sb.Data.Pages {
+		for sidx, seg := range page.Scripts() {
+			sr := &ScriptResult{Name: fmt.Sprintf("%s page %d script %d", job.File, pidx, sidx)}
+			scr, err := script.SmartParseSegment(seg, nil)
+			sr.Err = err
+			if scr != nil {
+				sr.Stats = scr.SourceStats(job.File, sr.Name)
+			}
+			res.Scripts = append(res.Scripts, sr)
+		}
+	}
+	return res
+}
+
+// runJobs runs the jobs with a pool of workers.  Results are passed to
+// handle in the same order as the jobs.
+func runJobs(jobs []Job, workers int, handle func(*Result)) {
+	type indexed struct {
+		idx int
+		res *Result
+	}
+
+	queue := make(chan int)
+	done := make(chan indexed)
+
+	for range workers {
+		go func() {
+			for idx := range queue {
+				done <- indexed{idx, jobs[idx].Run()}
+			}
+		}()
+	}
+
+	go func() {
+		for idx := range jobs {
+			queue <- idx
+		}
+		close(queue)
+	}()
+
+	pending := make(map[int]*Result)
+	next := 0
+	for next < len(jobs) {
+		r := <-done
+		pending[r.idx] = r.res
+		for pending[next] != nil {
+			handle(pending[next])
+			delete(pending, next)
+			next++
+		}
+	}
+}
+
 func run(args *Arguments) error {
+	if args.Instructions != "" {
+		err := script.LoadInstructionsFile(args.Instructions)
+		if err != nil {
+			return fmt.Errorf("Instruction table error: %w", err)
+		}
+	}
+
 	w := &Walker{Found: []string{}}
 	err := filepath.WalkDir(args.BaseDir, w.WalkFunc)
 	if err != nil {
@@ -47,52 +181,134 @@ func run(args *Arguments) error {
 	}
 
 	fmt.Printf("found %d scripts\n", len(w.Found))
+	fmt.Printf("found %d roms\n", len(w.Roms))
 
-	stats := make(script.Stats)
-
+	jobs := []Job{}
 	for _, file := range w.Found {
-		fmt.Println(file)
-		var cdl *script.CodeDataLog
+		job := Job{File: file}
 		cdlname := file[:len(file)-4]+".cdl.json"
 		if slices.Contains(w.CDLs, cdlname) {
-			fmt.Println("", cdlname)
-			cdl, err = script.CdlFromJsonFile(cdlname)
-			if err != nil {
-				fmt.Println(" CDL read error:", err)
-				cdl = nil
-			}
+			job.CDL = cdlname
 		}
+		jobs = append(jobs, job)
+	}
 
-		scr, err := script.SmartParseFile(file, 0x6000, cdl)
-		if err != nil {
-			//if scr != nil {
-			//	for _, token := range scr.Tokens {
-			//		fmt.Println(token.String(scr.Labels))
-			//	}
-			//}
-			fmt.Println(err)
-			//return err
+	for _, file := range w.Roms {
+		jobs = append(jobs, Job{File: file, Rom: true})
+	}
+
+	workers := args.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	stats := make(script.Stats)
+	failures := make(map[error][]Failure)
+	other := []Failure{}
+	scripts := 0
+
+	runJobs(jobs, workers, func(res *Result) {
+		fmt.Println(res.File)
+		for _, warn := range res.Warnings {
+			fmt.Println("", warn)
 		}
 
-		if scr != nil {
-			stats.Add(scr.Stats())
+		if res.Err != nil {
+			fmt.Println("", res.Err)
+			other = append(other, Failure{res.File, res.Err})
+			return
 		}
-	}
 
-	outfile, err := os.Create(args.Output)
+		for _, sr := range res.Scripts {
+			scripts++
+			if sr.Stats != nil {
+				stats.Add(sr.Stats)
+			}
+
+			if sr.Err == nil {
+				continue
+			}
+
+			if sr.Name != res.File {
+				fmt.Printf(" %s: %s\n", strings.TrimPrefix(sr.Name, res.File+" "), sr.Err)
+			} else {
+				fmt.Println("", sr.Err)
+			}
+
+			found := false
+			for _, group := range errorGroups {
+				if errors.Is(sr.Err, group) {
+					failures[group] = append(failures[group], Failure{sr.Name, sr.Err})
+					found = true
+					break
+				}
+			}
+			if !found {
+				other = append(other, Failure{sr.Name, sr.Err})
+			}
+		}
+	})
+
+	err = script.WriteStatsFile(args.Output, stats)
 	if err != nil {
 		return err
 	}
-	defer outfile.Close()
 
-	_, err = stats.WriteTo(outfile)
+	fmt.Println()
+	err = writeReport(os.Stdout, scripts, failures, other)
 	if err != nil {
 		return err
 	}
 
+	if args.Report != "" {
+		file, err := os.Create(args.Report)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return writeReport(file, scripts, failures, other)
+	}
 	return nil
 }
 
+// writeReport writes the number of parse failures for each error group,
+// followed by the files that failed and their errors.
+func writeReport(w io.Writer, scripts int, failures map[error][]Failure, other []Failure) error {
+	total := len(other)
+	for _, list := range failures {
+		total += len(list)
+	}
+
+	_, err := fmt.Fprintf(w, "Parse failures: %d of %d scripts\n", total, scripts)
+	if err != nil {
+		return err
+	}
+
+	section := func(name string, list []Failure) error {
+		_, err := fmt.Fprintf(w, "\n%s: %d\n", name, len(list))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range list {
+			// Joined errors put each error on its own line.
+			msg := strings.ReplaceAll(f.Err.Error(), "\n", ": ")
+			_, err = fmt.Fprintf(w, "  %s: %s\n", f.Name, msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, group := range errorGroups {
+		if err := section(group.Error(), failures[group]); err != nil {
+			return err
+		}
+	}
+	return section("Other errors", other)
+}
+
 func main() {
 	args := &Arguments{}
 	arg.MustParse(args)
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/rom"
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	BaseDir   string `arg:"positional,required" help:"directory to search for scripts"`
+	MinSize   int    `arg:"--min" default:"8" help:"smallest function to match, in instructions"`
+	JsonFile  string `arg:"--json" help:"also write the matches to this file as JSON"`
+	Propagate bool   `arg:"--propagate" help:"copy labels between matching functions and update the label files"`
+	Instructions string `arg:"--instructions" help:"instruction table overrides"`
+}
+
+// Source is a smart parsed script and where it came from.  Only scripts
+// from _scriptData.dat files have a label file.
+type Source struct {
+	Name      string
+	LabelFile string
+	Script    *script.Script
+	Prints    []*script.Fingerprint
+	Changed   bool
+}
+
+type Match struct {
+	Source      *Source
+	Fingerprint *script.Fingerprint
+}
+
+type JsonCloneGroup struct {
+	Hash    string
+	Size    int
+	Matches []JsonCloneMatch
+}
+
+type JsonCloneMatch struct {
+	Script  string
+	Address string
+	Label   string `json:",omitempty"`
+}
+
+func walk(base string) ([]string, []string, error) {
+	scripts := []string{}
+	roms := []string{}
+	err := filepath.WalkDir(base, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if strings.HasSuffix(path, "_scriptData.dat") {
+			scripts = append(scripts, path)
+		}
+
+		if strings.HasSuffix(strings.ToLower(path), ".studybox") {
+			roms = append(roms, path)
+		}
+		return nil
+	})
+	return scripts, roms, err
+}
+
+func loadSources(base string, minSize int) ([]*Source, error) {
+	files, roms, err := walk(base)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []*Source{}
+	for _, file := range files {
+		name := file[:len(file)-4]
+
+		var cdl *script.CodeDataLog
+		if _, err := os.Stat(name+".cdl.json"); err == nil {
+			cdl, err = script.CdlFromJsonFile(name+".cdl.json")
+			if err != nil {
+				fmt.Printf("%s: CDL read error: %s\n", file, err)
+				cdl = nil
+			}
+		}
+
+		scr, err := script.SmartParseFile(file, 0x6000, cdl)
+		if err != nil {
+			fmt.Printf("%s: %s\n", file, err)
+			if scr == nil {
+				continue
+			}
+		}
+
+		src := &Source{Name: file, LabelFile: name+".labels.json", Script: scr}
+		err = scr.LabelsFromJsonFile(src.LabelFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", src.LabelFile, err)
+		}
+
+		src.Prints = scr.Fingerprints(minSize)
+		sources = append(sources, src)
+	}
+
+	for _, file := range roms {
+		sb, err := rom.ReadFile(file)
+		if err != nil {
+			fmt.Printf("%s: %s\n", file, err)
+			continue
+		}
+
+		for pidx, page := range sb.Data.Pages {
+			for sidx, seg := range page.Scripts() {
+				name := fmt.Sprintf("%s page %d script %d", file, pidx, sidx)
+				scr, err := script.SmartParseSegment(seg, nil)
+				if err != nil {
+					fmt.Printf("%s: %s\n", name, err)
+					if scr == nil {
+						continue
+					}
+				}
+
+				sources = append(sources, &Source{Name: name, Script: scr, Prints: scr.Fingerprints(minSize)})
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// findClones groups functions by fingerprint.  Only groups found in more
+// than one script are returned, largest functions first.
+func findClones(sources []*Source) [][]Match {
+	groups := make(map[string][]Match)
+	for _, src := range sources {
+		for _, fp := range src.Prints {
+			groups[fp.Hash] = append(groups[fp.Hash], Match{src, fp})
+		}
+	}
+
+	list := [][]Match{}
+	for _, hash := range slices.Sorted(maps.Keys(groups)) {
+		group := groups[hash]
+		scripts := make(map[*Source]bool)
+		for _, m := range group {
+			scripts[m.Source] = true
+		}
+		if len(scripts) > 1 {
+			list = append(list, group)
+		}
+	}
+
+	slices.SortStableFunc(list, func(a, b []Match) int {
+		return b[0].Fingerprint.Size - a[0].Fingerprint.Size
+	})
+	return list
+}
+
+func labelName(m Match) string {
+	if lbl, ok := m.Source.Script.Labels[m.Fingerprint.Address]; ok && !lbl.IsAuto() {
+		return lbl.Name
+	}
+	return ""
+}
+
+// propagate copies labels between every pair of matches in a group until
+// nothing changes, so labels from any copy reach all of the others.
+func propagate(groups [][]Match) int {
+	total := 0
+	for {
+		count := 0
+		for _, group := range groups {
+			for _, dst := range group {
+				for _, src := range group {
+					if src.Source == dst.Source {
+						continue
+					}
+
+					n := dst.Source.Script.CopyCloneLabels(dst.Fingerprint, src.Source.Script, src.Fingerprint)
+					if n > 0 {
+						dst.Source.Changed = true
+						count += n
+					}
+				}
+			}
+		}
+
+		if count == 0 {
+			return total
+		}
+		total += count
+	}
+}
+
+func run(args *Arguments) error {
+	if args.Instructions != "" {
+		err := script.LoadInstructionsFile(args.Instructions)
+		if err != nil {
+			return fmt.Errorf("Instruction table error: %w", err)
+		}
+	}
+
+	sources, err := loadSources(args.BaseDir, args.MinSize)
+	if err != nil {
+		return err
+	}
+
+	groups := findClones(sources)
+	fmt.Printf("%d scripts, %d functions found in more than one script\n", len(sources), len(groups))
+
+	jsonGroups := []JsonCloneGroup{}
+	for _, group := range groups {
+		fp := group[0].Fingerprint
+		fmt.Printf("\n%s: %d instructions\n", fp.Hash, fp.Size)
+
+		jg := JsonCloneGroup{Hash: fp.Hash, Size: fp.Size, Matches: []JsonCloneMatch{}}
+		for _, m := range group {
+			name := labelName(m)
+			if name != "" {
+				fmt.Printf("  %s $%04X %s\n", m.Source.Name, m.Fingerprint.Address, name)
+			} else {
+				fmt.Printf("  %s $%04X\n", m.Source.Name, m.Fingerprint.Address)
+			}
+
+			jg.Matches = append(jg.Matches, JsonCloneMatch{
+				Script:  m.Source.Name,
+				Address: fmt.Sprintf("$%04X", m.Fingerprint.Address),
+				Label:   name,
+			})
+		}
+		jsonGroups = append(jsonGroups, jg)
+	}
+
+	if args.JsonFile != "" {
+		raw, err := json.MarshalIndent(jsonGroups, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(args.JsonFile, raw, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !args.Propagate {
+		return nil
+	}
+
+	count := propagate(groups)
+	fmt.Printf("\ncopied %d labels\n", count)
+
+	for _, src := range sources {
+		if !src.Changed {
+			continue
+		}
+
+		if src.LabelFile == "" {
+			fmt.Printf("%s: no label file for scripts in a .studybox\n", src.Name)
+			continue
+		}
+
+		fmt.Println("updating", src.LabelFile)
+		err = src.Script.WriteLabelsToFile(src.LabelFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+
+	err := run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/compiler"
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	Input        string `arg:"positional,required" help:"source file"`
+	Output       string `arg:"positional,required" help:"file to write the script to"`
+	StartAddr    string `arg:"--start" default:"0x6000" help:"address the script is loaded to"`
+	StackAddr    string `arg:"--stack" default:"0x0500" help:"stack address for the script header"`
+	AsmOutput    string `arg:"--asm" help:"also write the generated assembly to this file"`
+	Table        string `arg:"--table" help:"character table (.tbl) for script text"`
+	Instructions string `arg:"--instructions" help:"instruction table overrides"`
+	Enums        string `arg:"--enums" help:"argument enum overrides"`
+}
+
+func parseAddr(s string) (int, error) {
+	if strings.HasPrefix(s, "$") {
+		s = "0x"+s[1:]
+	}
+
+	val, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	return int(val), nil
+}
+
+func run(args *Arguments) error {
+	start, err := parseAddr(args.StartAddr)
+	if err != nil {
+		return err
+	}
+
+	stack, err := parseAddr(args.StackAddr)
+	if err != nil {
+		return err
+	}
+
+	if args.Instructions != "" {
+		err = script.LoadInstructionsFile(args.Instructions)
+		if err != nil {
+			return fmt.Errorf("Instruction table error: %w", err)
+		}
+	}
+
+	if args.Enums != "" {
+		err = script.LoadEnumsFile(args.Enums)
+		if err != nil {
+			return fmt.Errorf("Enum table error: %w", err)
+		}
+	}
+
+	if args.Table != "" {
+		err = script.LoadTableFile(args.Table)
+		if err != nil {
+			return fmt.Errorf("Character table error: %w", err)
+		}
+	}
+
+	if args.AsmOutput != "" {
+		file, err := os.Open(args.Input)
+		if err != nil {
+			return err
+		}
+		source, err := compiler.CompileAssembly(file, stack)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(args.AsmOutput, []byte(source), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(args.Input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	raw, err := compiler.Compile(file, start, stack)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(args.Output, raw, 0644)
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+
+	err := run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
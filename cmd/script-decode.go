@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"strconv"
 	"slices"
@@ -10,19 +11,47 @@ import (
 
 	"github.com/alexflint/go-arg"
 
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/rom"
 	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
 )
 
 type Arguments struct {
-	Input string `arg:"positional,required"`
+	Input string `arg:"positional" help:"script data file.  with --rom, this is the output file instead"`
 	Output string `arg:"positional"`
 	StartAddr string `arg:"--start" default:"0x6000" help:"base address for the start of the script"`
-	StatsFile string `arg:"--stats" help:"file to write some statistics to"`
+	StatsFile string `arg:"--stats" help:"file to write some statistics to (.json, .csv or text)"`
 	LabelFile string `arg:"--labels" help:"file containing address/label pairs"`
+	ImportLabels []string `arg:"--import-labels,separate" help:"emulator or assembler label file to import (.mlb, .nl, .dbg, .sym)"`
+	ExportLabels []string `arg:"--export-labels,separate" help:"emulator or assembler label file to write (.mlb, .nl, .dbg, .sym)"`
 	CDL string `arg:"--cdl" help:"CodeDataLog json file"`
 	CDLOutput string `arg:"--cdl-output"`
+	Traces []string `arg:"--trace,separate" help:"execution trace to merge into the CDL"`
+	XrefFile string `arg:"--xref" help:"file to write a JSON cross-reference report to"`
+	LintFile string `arg:"--lint" help:"file to write lint results to (.json for JSON, otherwise text)"`
 	Smart bool `arg:"--smart"`
 	NoAddrPrefix bool `arg:"--no-addr-prefix"`
+	Format string `arg:"--format" default:"text" help:"output format: text, json, html or pseudo"`
+	Instructions string `arg:"--instructions" help:"instruction table overrides"`
+	Enums string `arg:"--enums" help:"argument enum overrides"`
+	Table string `arg:"--table" help:"character table (.tbl) for script text"`
+	Relocate string `arg:"--relocate" help:"move the script to a new start address"`
+	RelocateBank int `arg:"--relocate-bank" default:"-1" help:"WRAM bank to move the script to (with --relocate)"`
+	BinOutput string `arg:"--bin-output" help:"file to write the script binary to, eg after --relocate"`
+
+	Rom string `arg:"--rom" help:"read the script from a .studybox file instead"`
+	Page int `arg:"--page" help:"page index in the .studybox file (with --rom)"`
+	Segment int `arg:"--segment" help:"script index in the page (with --rom)"`
+	Project bool `arg:"--project" help:"smart parse every script in the rom and write a combined disassembly (with --rom)"`
+
+	Database string `arg:"--db" help:"analysis database to read and update"`
+	Undo bool `arg:"--undo" help:"undo the last change to the database"`
+	SetLabels []string `arg:"--label,separate" help:"set a label in the database, eg '$6012=Name'.  An empty name removes it"`
+	SetComments []string `arg:"--comment,separate" help:"set a comment in the database, eg '$6012=text'"`
+	SetEntries []string `arg:"--entry,separate" help:"add an entry point to the database"`
+	RemoveEntries []string `arg:"--remove-entry,separate" help:"remove an entry point from the database"`
+	SetData []string `arg:"--data,separate" help:"set a data directive in the database, eg '$6040=string:12', 'words:4' or 'pointers:4'"`
+	SetEnums []string `arg:"--enum-at,separate" help:"show a push_word's value with an enum, eg '$6012=EnumName'"`
+	SaveCDL bool `arg:"--save-cdl" help:"store the --cdl and --trace input in the database"`
 
 	start int
 }
@@ -43,6 +72,33 @@ func run(args *Arguments) error {
 
 	args.start = int(val)
 
+	switch args.Format {
+	case "text", "json", "html", "pseudo":
+	default:
+		return fmt.Errorf("unknown output format %q", args.Format)
+	}
+
+	if args.Instructions != "" {
+		err = script.LoadInstructionsFile(args.Instructions)
+		if err != nil {
+			return fmt.Errorf("Instruction table error: %w", err)
+		}
+	}
+
+	if args.Enums != "" {
+		err = script.LoadEnumsFile(args.Enums)
+		if err != nil {
+			return fmt.Errorf("Enum table error: %w", err)
+		}
+	}
+
+	if args.Table != "" {
+		err = script.LoadTableFile(args.Table)
+		if err != nil {
+			return fmt.Errorf("Character table error: %w", err)
+		}
+	}
+
 	var cdl *script.CodeDataLog
 	if args.CDL != "" {
 		cdl, err = script.CdlFromJsonFile(args.CDL)
@@ -56,8 +112,109 @@ func run(args *Arguments) error {
 		}
 	}
 
+	if args.Rom != "" && args.Output == "" {
+		// The only positional argument is the output file
+		args.Output = args.Input
+	}
+
+	if args.Project {
+		if args.Format != "text" {
+			return fmt.Errorf("--project only supports the text format")
+		}
+
+		// These only apply to a single script.
+		unsupported := []struct {
+			flag string
+			set  bool
+		}{
+			{"--stats", args.StatsFile != ""},
+			{"--labels", args.LabelFile != ""},
+			{"--import-labels", len(args.ImportLabels) > 0},
+			{"--export-labels", len(args.ExportLabels) > 0},
+			{"--cdl", args.CDL != ""},
+			{"--cdl-output", args.CDLOutput != ""},
+			{"--trace", len(args.Traces) > 0},
+			{"--xref", args.XrefFile != ""},
+			{"--lint", args.LintFile != ""},
+			{"--no-addr-prefix", args.NoAddrPrefix},
+			{"--relocate", args.Relocate != "" || args.RelocateBank >= 0},
+			{"--bin-output", args.BinOutput != ""},
+			{"--db", args.Database != ""},
+		}
+		for _, u := range unsupported {
+			if u.set {
+				return fmt.Errorf("%s can't be used with --project", u.flag)
+			}
+		}
+		return runProject(args)
+	}
+
+	var seg *rom.DataSegment
+	traceBank := -1
+	if args.Rom != "" {
+		seg, err = findSegment(args)
+		if err != nil {
+			return err
+		}
+		traceBank = seg.Bank
+	}
+
+	if len(args.Traces) > 0 && cdl == nil {
+		cdl = script.NewCDL()
+	}
+
+	for _, filename := range args.Traces {
+		err = cdl.ImportTraceFile(filename, traceBank)
+		if err != nil {
+			return fmt.Errorf("Trace import error: %w", err)
+		}
+	}
+
+	if args.SaveCDL && args.Database == "" {
+		return fmt.Errorf("--save-cdl requires --db")
+	}
+
+	var db *script.Database
+	var sdb *script.ScriptDb
+	if args.Database != "" {
+		db, sdb, err = openDatabase(args)
+		if err != nil {
+			return err
+		}
+
+		if args.SaveCDL && cdl != nil {
+			err = sdb.SaveCDL(cdl)
+			if err != nil {
+				return fmt.Errorf("Database CDL error: %w", err)
+			}
+		}
+
+		raw, start := []byte{}, args.start
+		if seg != nil {
+			raw, start = seg.Data, seg.Address
+		} else if args.Input != "" {
+			raw, err = os.ReadFile(args.Input)
+			if err != nil {
+				return fmt.Errorf("unable to read file: %w", err)
+			}
+		}
+
+		cdl, err = sdb.PrepareCDL(cdl, raw, start)
+		if err != nil {
+			return fmt.Errorf("Database CDL error: %w", err)
+		}
+	}
+
 	var scr *script.Script
-	if args.Smart {
+	if seg != nil {
+		if args.Smart {
+			scr, err = script.SmartParseSegment(seg, cdl)
+		} else {
+			scr, err = script.ParseSegment(seg, cdl)
+		}
+	} else if args.Input == "" {
+		return fmt.Errorf("missing input file")
+	} else if args.Smart {
 		scr, err = script.SmartParseFile(args.Input, args.start, cdl)
 	} else {
 		scr, err = script.ParseFile(args.Input, args.start, cdl)
@@ -81,7 +238,22 @@ func run(args *Arguments) error {
 				return fmt.Errorf("Labels parse error: %w", err)
 			}
 		}
+	}
+
+	// The database takes priority over the json labels
+	if sdb != nil {
+		sdb.Apply(scr)
+	}
+
+	// Imported labels take priority over the json labels
+	for _, filename := range args.ImportLabels {
+		err = scr.ImportLabelsFile(filename)
+		if err != nil {
+			return fmt.Errorf("Label import error: %w", err)
+		}
+	}
 
+	if args.LabelFile != "" {
 		err = scr.WriteLabelsToFile(args.LabelFile)
 		if err != nil {
 			return fmt.Errorf("Labels write error: %w", err)
@@ -92,6 +264,36 @@ func run(args *Arguments) error {
 		//}
 	}
 
+	if db != nil {
+		if !args.Undo {
+			sdb.Update(scr)
+			err = db.Commit(dbNote(args))
+			if err != nil {
+				return fmt.Errorf("Database error: %w", err)
+			}
+		}
+
+		err = db.WriteToFile(args.Database)
+		if err != nil {
+			return fmt.Errorf("Database write error: %w", err)
+		}
+	}
+
+	// Relocate after the label file is updated so it keeps the original
+	// addresses.  A relocated CDL is only written to --cdl-output.
+	if args.Relocate != "" {
+		newStart, err := strconv.ParseInt(strings.Replace(args.Relocate, "$", "0x", 1), 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid relocation address %q: %w", args.Relocate, err)
+		}
+
+		warnings, err := scr.Relocate(args.RelocateBank, int(newStart))
+		if err != nil {
+			return fmt.Errorf("Relocation error: %w", err)
+		}
+		scr.Warnings = append(scr.Warnings, warnings...)
+	}
+
 	outfile := os.Stdout
 	if args.Output != "" {
 		outfile, err = os.Create(args.Output)
@@ -101,42 +303,95 @@ func run(args *Arguments) error {
 		defer outfile.Close()
 	}
 
-	for _, w := range scr.Warnings {
-		//fmt.Fprintln(os.Stderr, w)
-		if args.Output != "" {
-			fmt.Fprintln(outfile, "; "+w)
-		}
-	}
-
-	fmt.Fprintf(outfile, "; Start address: $%04X\n", scr.StartAddress)
-	fmt.Fprintf(outfile, "; Stack address: $%04X\n\n", scr.StackAddress)
-
 	slices.SortFunc(scr.Tokens, func(a, b *script.Token) int {
 		if a.Offset < b.Offset { return -1 }
 		if a.Offset > b.Offset { return 1 }
 		return 0
 	})
 
-	for _, token := range scr.Tokens {
-		fmt.Fprintln(outfile, token.String(scr.Labels, args.NoAddrPrefix))
+	switch args.Format {
+	case "json":
+		err = scr.WriteJson(outfile)
+		if err != nil {
+			return fmt.Errorf("Error writing JSON: %w", err)
+		}
+
+	case "html":
+		title := filepath.Base(args.Input)
+		if args.Rom != "" {
+			title = fmt.Sprintf("%s page %d script %d", filepath.Base(args.Rom), args.Page, args.Segment)
+		}
+
+		err = scr.WriteHtml(outfile, title)
+		if err != nil {
+			return fmt.Errorf("Error writing HTML: %w", err)
+		}
+
+	case "pseudo":
+		err = scr.WriteDecompiled(outfile)
+		if err != nil {
+			return fmt.Errorf("Error writing pseudo-code: %w", err)
+		}
+
+	default:
+		for _, w := range scr.Warnings {
+			//fmt.Fprintln(os.Stderr, w)
+			if args.Output != "" {
+				fmt.Fprintln(outfile, "; "+w)
+			}
+		}
+
+		fmt.Fprintf(outfile, "; Start address: $%04X\n", scr.StartAddress)
+		fmt.Fprintf(outfile, "; Stack address: $%04X\n\n", scr.StackAddress)
+
+		for _, token := range scr.Tokens {
+			fmt.Fprintln(outfile, token.String(scr.Labels, args.NoAddrPrefix))
+		}
 	}
 
 	if args.StatsFile != "" {
-		statfile, err := os.Create(args.StatsFile)
+		err = script.WriteStatsFile(args.StatsFile, scr.Stats())
 		if err != nil {
-			return fmt.Errorf("Unable to create stats file: %w", err)
+			return fmt.Errorf("Error writing stats: %w", err)
 		}
-		defer statfile.Close()
+	}
 
-		_, err = scr.Stats().WriteTo(statfile)
+	if args.BinOutput != "" {
+		raw, err := scr.Bytes()
 		if err != nil {
-			return fmt.Errorf("Error writing stats: %w", err)
+			return fmt.Errorf("Unable to encode script: %w", err)
+		}
+
+		err = os.WriteFile(args.BinOutput, raw, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing binary: %w", err)
+		}
+	}
+
+	for _, filename := range args.ExportLabels {
+		err = scr.ExportLabelsFile(filename)
+		if err != nil {
+			return fmt.Errorf("Label export error: %w", err)
+		}
+	}
+
+	if args.LintFile != "" {
+		err = script.WriteLintFile(args.LintFile, scr.Lint())
+		if err != nil {
+			return fmt.Errorf("Error writing lint file: %w", err)
+		}
+	}
+
+	if args.XrefFile != "" {
+		err = scr.WriteXrefsToFile(args.XrefFile)
+		if err != nil {
+			return fmt.Errorf("Error writing xref file: %w", err)
 		}
 	}
 
 	if scr.CDL != nil {
 		cdlout := args.CDL
-		if args.CDLOutput != "" {
+		if args.CDLOutput != "" || args.Relocate != "" {
 			cdlout = args.CDLOutput
 		}
 
@@ -158,6 +413,210 @@ func run(args *Arguments) error {
 	return nil
 }
 
+// openDatabase reads the --db file, or starts a new one, and makes the edits
+// given on the command line.  Scripts from a .studybox file are stored by
+// page and segment, and others by file name, so one database can hold every
+// script in a tape.
+func openDatabase(args *Arguments) (*script.Database, *script.ScriptDb, error) {
+	db, err := script.DatabaseFromJsonFile(args.Database)
+	if errors.Is(err, os.ErrNotExist) {
+		db = script.NewDatabase()
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Database read error: %w", err)
+	}
+
+	if args.Undo {
+		edits := len(args.SetLabels)+len(args.SetComments)+len(args.SetEntries)+len(args.RemoveEntries)+len(args.SetData)+len(args.SetEnums)
+		if edits > 0 || args.SaveCDL {
+			return nil, nil, fmt.Errorf("--undo can't be used with database edits")
+		}
+
+		note, err := db.Undo()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Database undo error: %w", err)
+		}
+		fmt.Println("Undid:", note)
+	}
+
+	name := filepath.Base(args.Input)
+	if args.Rom != "" {
+		name = fmt.Sprintf("page %d script %d", args.Page, args.Segment)
+	}
+	sdb := db.Script(name)
+
+	for _, edit := range args.SetLabels {
+		addr, val, err := parseEdit(edit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if val == "" {
+			delete(sdb.Labels, addr)
+		} else {
+			sdb.Labels[addr] = script.NewLabel(addr, val)
+		}
+	}
+
+	for _, edit := range args.SetComments {
+		addr, val, err := parseEdit(edit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if val == "" {
+			delete(sdb.Comments, addr)
+		} else {
+			sdb.Comments[addr] = val
+		}
+	}
+
+	for _, ent := range args.SetEntries {
+		addr, err := parseAddr(ent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !slices.Contains(sdb.EntryPoints, addr) {
+			sdb.EntryPoints = append(sdb.EntryPoints, addr)
+		}
+	}
+
+	for _, ent := range args.RemoveEntries {
+		addr, err := parseAddr(ent)
+		if err != nil {
+			return nil, nil, err
+		}
+		sdb.EntryPoints = slices.DeleteFunc(sdb.EntryPoints, func(a int) bool { return a == addr })
+	}
+
+	for _, edit := range args.SetData {
+		addr, val, err := parseEdit(edit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if val == "" {
+			delete(sdb.Directives, addr)
+			continue
+		}
+
+		dd, err := script.ParseDataDirective(addr, val)
+		if err != nil {
+			return nil, nil, err
+		}
+		sdb.Directives[addr] = dd
+	}
+
+	for _, edit := range args.SetEnums {
+		addr, val, err := parseEdit(edit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if val == "" {
+			delete(sdb.Enums, addr)
+			continue
+		}
+
+		if _, ok := script.Enums[val]; !ok {
+			return nil, nil, fmt.Errorf("unknown enum %q", val)
+		}
+		sdb.Enums[addr] = val
+	}
+
+	return db, sdb, nil
+}
+
+// dbNote describes the database edits on the command line for the undo
+// history.
+func dbNote(args *Arguments) string {
+	notes := []string{}
+	add := func(flag string, list []string) {
+		for _, val := range list {
+			notes = append(notes, flag+" "+val)
+		}
+	}
+
+	add("--label", args.SetLabels)
+	add("--comment", args.SetComments)
+	add("--entry", args.SetEntries)
+	add("--remove-entry", args.RemoveEntries)
+	add("--data", args.SetData)
+	add("--enum-at", args.SetEnums)
+	if args.SaveCDL {
+		notes = append(notes, "--save-cdl")
+	}
+	if len(notes) == 0 {
+		return "analysis update"
+	}
+	return strings.Join(notes, ", ")
+}
+
+func parseAddr(s string) (int, error) {
+	val, err := strconv.ParseInt(strings.Replace(strings.TrimSpace(s), "$", "0x", 1), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	return int(val), nil
+}
+
+// parseEdit splits an "ADDR=VALUE" database edit.
+func parseEdit(s string) (int, string, error) {
+	addrStr, val, found := strings.Cut(s, "=")
+	if !found {
+		return 0, "", fmt.Errorf("invalid edit %q: expected ADDR=VALUE", s)
+	}
+
+	addr, err := parseAddr(addrStr)
+	if err != nil {
+		return 0, "", err
+	}
+	return addr, val, nil
+}
+
+func runProject(args *Arguments) error {
+	if args.Rom == "" {
+		return fmt.Errorf("--project requires --rom")
+	}
+
+	sb, err := rom.ReadFile(args.Rom)
+	if err != nil {
+		return fmt.Errorf("unable to read rom: %w", err)
+	}
+
+	proj := script.NewProject(sb)
+	err = proj.Analyze()
+	if err != nil {
+		return err
+	}
+
+	outfile := os.Stdout
+	if args.Output != "" {
+		outfile, err = os.Create(args.Output)
+		if err != nil {
+			return fmt.Errorf("unable to create output file: %w", err)
+		}
+		defer outfile.Close()
+	}
+
+	_, err = proj.WriteTo(outfile)
+	return err
+}
+
+func findSegment(args *Arguments) (*rom.DataSegment, error) {
+	sb, err := rom.ReadFile(args.Rom)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rom: %w", err)
+	}
+
+	if args.Page < 0 || args.Page >= len(sb.Data.Pages) {
+		return nil, fmt.Errorf("page %d out of range (%d pages)", args.Page, len(sb.Data.Pages))
+	}
+
+	scripts := sb.Data.Pages[args.Page].Scripts()
+	if args.Segment < 0 || args.Segment >= len(scripts) {
+		return nil, fmt.Errorf("script segment %d out of range (%d scripts in page %d)",
+			args.Segment, len(scripts), args.Page)
+	}
+
+	return scripts[args.Segment], nil
+}
+
 func main() {
 	args := &Arguments{}
 	arg.MustParse(args)
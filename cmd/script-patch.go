@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	Input     string `arg:"positional,required" help:"script data file"`
+	Patch     string `arg:"positional,required" help:"patch file"`
+	Output    string `arg:"positional,required" help:"file to write the patched script to"`
+	StartAddr string `arg:"--start" default:"0x6000" help:"base address for the start of the script"`
+	LabelFile string `arg:"--labels" help:"file containing address/label pairs"`
+	CDL       string `arg:"--cdl" help:"CodeDataLog json file"`
+	CDLOutput string `arg:"--cdl-output" help:"file to write the patched CDL to"`
+	Table     string `arg:"--table" help:"character table (.tbl) for script text"`
+}
+
+func run(args *Arguments) error {
+	if strings.HasPrefix(args.StartAddr, "$") {
+		args.StartAddr = "0x"+args.StartAddr[1:]
+	}
+
+	start, err := strconv.ParseInt(args.StartAddr, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid start address %q: %w", args.StartAddr, err)
+	}
+
+	if args.Table != "" {
+		err = script.LoadTableFile(args.Table)
+		if err != nil {
+			return fmt.Errorf("Character table error: %w", err)
+		}
+	}
+
+	var cdl *script.CodeDataLog
+	if args.CDL != "" {
+		cdl, err = script.CdlFromJsonFile(args.CDL)
+		if err != nil {
+			return fmt.Errorf("CDL Parse error: %w", err)
+		}
+	}
+
+	patches, err := script.ReadPatchFile(args.Patch)
+	if err != nil {
+		return fmt.Errorf("Patch file error: %w", err)
+	}
+
+	scr, err := script.SmartParseFile(args.Input, int(start), cdl)
+	if err != nil {
+		if errors.Is(err, script.ErrEarlyEOF) || errors.Is(err, script.ErrNavigation) {
+			fmt.Println(err)
+		} else {
+			return fmt.Errorf("Script parse error: %w", err)
+		}
+	}
+
+	if args.LabelFile != "" {
+		err = scr.LabelsFromJsonFile(args.LabelFile)
+		if err != nil {
+			return fmt.Errorf("Labels parse error: %w", err)
+		}
+	}
+
+	for _, p := range patches {
+		warnings, err := scr.ApplyPatch(p)
+		if err != nil {
+			return err
+		}
+
+		for _, w := range warnings {
+			fmt.Fprintln(os.Stderr, "WARN:", w)
+		}
+	}
+
+	raw, err := scr.Bytes()
+	if err != nil {
+		return fmt.Errorf("Unable to encode script: %w", err)
+	}
+
+	err = os.WriteFile(args.Output, raw, 0644)
+	if err != nil {
+		return err
+	}
+
+	if args.CDLOutput != "" {
+		return scr.CDL.WriteToFile(args.CDLOutput)
+	}
+	return nil
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+
+	err := run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+type Arguments struct {
+	Extract *ArgExtract `arg:"subcommand:extract"`
+	Inject  *ArgInject  `arg:"subcommand:inject"`
+}
+
+type ArgExtract struct {
+	Input     string `arg:"positional,required" help:"script data file"`
+	Output    string `arg:"positional,required" help:"translation file to write (.json or .po)"`
+	StartAddr string `arg:"--start" default:"0x6000" help:"base address for the start of the script"`
+	CDL       string `arg:"--cdl" help:"CodeDataLog json file"`
+	Table     string `arg:"--table" help:"character table (.tbl) for script text"`
+}
+
+type ArgInject struct {
+	Input        string `arg:"positional,required" help:"script data file"`
+	Translations string `arg:"positional,required" help:"translation file (.json or .po)"`
+	Output       string `arg:"positional,required" help:"file to write the new script to"`
+	StartAddr    string `arg:"--start" default:"0x6000" help:"base address for the start of the script"`
+	CDL          string `arg:"--cdl" help:"CodeDataLog json file"`
+	Table        string `arg:"--table" help:"character table (.tbl) for script text"`
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+	var err error
+
+	switch {
+	case args.Extract != nil:
+		err = extract(args.Extract)
+	case args.Inject != nil:
+		err = inject(args.Inject)
+	default:
+		fmt.Fprintln(os.Stderr, "Missing command")
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func parseScript(filename, startAddr, cdlFile, table string) (*script.Script, error) {
+	if table != "" {
+		err := script.LoadTableFile(table)
+		if err != nil {
+			return nil, fmt.Errorf("Character table error: %w", err)
+		}
+	}
+
+	if strings.HasPrefix(startAddr, "$") {
+		startAddr = "0x"+startAddr[1:]
+	}
+
+	start, err := strconv.ParseInt(startAddr, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start address %q: %w", startAddr, err)
+	}
+
+	var cdl *script.CodeDataLog
+	if cdlFile != "" {
+		cdl, err = script.CdlFromJsonFile(cdlFile)
+		if err != nil {
+			return nil, fmt.Errorf("CDL Parse error: %w", err)
+		}
+	}
+
+	scr, err := script.SmartParseFile(filename, int(start), cdl)
+	if err != nil {
+		return nil, fmt.Errorf("Script parse error: %w", err)
+	}
+	return scr, nil
+}
+
+func extract(args *ArgExtract) error {
+	scr, err := parseScript(args.Input, args.StartAddr, args.CDL, args.Table)
+	if err != nil {
+		return err
+	}
+
+	return script.WriteStringsFile(args.Output, scr.Strings())
+}
+
+func inject(args *ArgInject) error {
+	scr, err := parseScript(args.Input, args.StartAddr, args.CDL, args.Table)
+	if err != nil {
+		return err
+	}
+
+	translated, err := script.ReadStringsFile(args.Translations)
+	if err != nil {
+		return fmt.Errorf("Translation file error: %w", err)
+	}
+
+	found := scr.Strings()
+	err = script.MatchStrings(found, translated)
+	if err != nil {
+		return err
+	}
+
+	raw, warnings, err := scr.InjectStrings(found)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "WARN:", w)
+	}
+
+	return os.WriteFile(args.Output, raw, 0644)
+}
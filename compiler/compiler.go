@@ -0,0 +1,771 @@
+// Package compiler compiles a small high level language to script bytecode.
+//
+//	const SPEED = 3
+//	var count = 0
+//	var name[32]
+//
+//	sub main {
+//	    load_rom_screen(SCREEN_GREEN_TITLE)
+//	    while count < 10 {
+//	        draw_string(2, 0, "HELLO")
+//	        count = count + 1
+//	    }
+//	    name = to_int_string(count)
+//	    show()
+//	}
+//
+//	sub show {
+//	    if count == 10 {
+//	        play_sound("C4E4G4")
+//	    } else {
+//	        wait_for_tape(1)
+//	    }
+//	}
+//
+// The program is compiled to assembly for the script Assembler.  Statements
+// end at the end of the line or with a semicolon.  Variables are bytes stored
+// after the code, or arrays with a size.  Subs are called with call_abs and
+// can't take arguments; values are shared through variables.  Every other
+// call is an instruction from the instruction table.  Its arguments are pushed
+// in order, and the last arguments fill the instruction's inline operands
+// (constants, or a variable for data operands).  Enum symbols from the enum
+// files can be used as constants.
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/script"
+)
+
+var (
+	ErrSyntax = errors.New("Syntax error")
+	ErrUndefined = errors.New("Undefined name")
+	ErrType = errors.New("Type error")
+)
+
+// Strings pushed with push_data are copied to a 32 byte buffer, including
+// the NUL.
+const maxStringLength = 31
+
+// Instructions for the operators.
+var binaryOps = map[string]byte{
+	"&":  0xC3, // and_a_b
+	"|":  0xC4, // or_a_b
+	"==": 0xC5, // equal
+	"!=": 0xC6, // not_equal
+	"<":  0xC7, // less_than
+	"<=": 0xC8, // less_than_equal
+	">":  0xC9, // greater_than
+	">=": 0xCA, // greater_than_equal
+	"+":  0xCB, // sum
+	"-":  0xCC, // subtract
+	"*":  0xCD, // multiply
+	"/":  0xCE, // signed_divide
+	"%":  0xE0, // modulo
+}
+
+var unaryOps = map[string]byte{
+	"!": 0xC2, // equals_zero
+	"-": 0xCF, // negate
+}
+
+// Instructions the language uses itself.  They can't be called directly.
+var reservedOps = []byte{
+	0x86, // return
+	0x8A, // pop_string_to_addr
+	0xB7, // push_var
+	0xB8, // push_word
+	0xB9, // push_var_indexed
+	0xBD, // pop_into
+}
+
+type compiler struct {
+	consts map[string]int
+	vars   map[string]*varDecl
+	subs   map[string]*subDecl
+
+	lines  []string
+	nextID int
+	loops  []loop
+	sub    *subDecl
+}
+
+type loop struct {
+	top string
+	end string
+}
+
+func errorf(line int, err error, format string, args ...any) error {
+	return fmt.Errorf("line %d: %w: %s", line, err, fmt.Sprintf(format, args...))
+}
+
+// Compile compiles a program into a script that loads at start.  The result
+// includes the stack address header, so it can be used as the file of a
+// script data segment in rom.Import.
+func Compile(r io.Reader, start, stack int) ([]byte, error) {
+	if start < 0x6000 || start > 0x7FFF {
+		return nil, fmt.Errorf("start address $%04X is outside of work RAM", start)
+	}
+
+	source, err := CompileAssembly(r, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := script.AssembleScript(strings.NewReader(source), start)
+	if err != nil {
+		return nil, fmt.Errorf("unable to assemble script: %w", err)
+	}
+
+	bankEnd := (start &^ 0x1FFF) + 0x2000
+	if start+len(raw) > bankEnd {
+		return nil, fmt.Errorf("script overflows the bank by %d bytes (ends at $%04X)",
+			start+len(raw)-bankEnd, start+len(raw)-1)
+	}
+
+	return raw, nil
+}
+
+// CompileAssembly compiles a program to script assembly.  The main sub is
+// placed first so it runs when the script starts, followed by the other subs
+// and then the variables.
+func CompileAssembly(r io.Reader, stack int) (string, error) {
+	source, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := lex(string(source))
+	if err != nil {
+		return "", err
+	}
+
+	prog, err := parse(tokens)
+	if err != nil {
+		return "", err
+	}
+
+	c := &compiler{
+		consts: make(map[string]int),
+		vars: make(map[string]*varDecl),
+		subs: make(map[string]*subDecl),
+	}
+
+	err = c.declare(prog)
+	if err != nil {
+		return "", err
+	}
+
+	main, ok := c.subs["main"]
+	if !ok {
+		return "", fmt.Errorf("%w: missing sub main", ErrUndefined)
+	}
+
+	c.lines = append(c.lines, fmt.Sprintf(".stack $%04X", stack))
+	err = c.compileSub(main)
+	if err != nil {
+		return "", err
+	}
+
+	for _, sub := range prog.subs {
+		if sub == main {
+			continue
+		}
+		err = c.compileSub(sub)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, v := range prog.vars {
+		err = c.compileVar(v)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(c.lines, "\n")+"\n", nil
+}
+
+// declare adds every top level name and evaluates the constants.  Names
+// become labels in the assembly, so they can't clash with each other,
+// instructions, enum symbols or the generated labels.
+func (c *compiler) declare(prog *program) error {
+	names := make(map[string]bool)
+	check := func(name string, line int) error {
+		switch {
+		case names[name]:
+			return errorf(line, ErrSyntax, "%s is already declared", name)
+		case strings.HasPrefix(name, "__"):
+			return errorf(line, ErrSyntax, "names starting with __ are reserved: %s", name)
+		}
+
+		if _, ok := script.InstructionByName(name); ok {
+			return errorf(line, ErrSyntax, "%s is an instruction", name)
+		}
+		if _, ok := script.LookupEnumSymbol(name); ok {
+			return errorf(line, ErrSyntax, "%s is an enum symbol", name)
+		}
+
+		names[name] = true
+		return nil
+	}
+
+	// Constants can only use constants declared before them.
+	for _, cd := range prog.consts {
+		if err := check(cd.name, cd.line); err != nil {
+			return err
+		}
+		val, err := c.constValue(cd.value)
+		if err != nil {
+			return err
+		}
+		c.consts[cd.name] = val
+	}
+
+	for _, v := range prog.vars {
+		if err := check(v.name, v.line); err != nil {
+			return err
+		}
+		c.vars[v.name] = v
+	}
+
+	for _, sub := range prog.subs {
+		if err := check(sub.name, sub.line); err != nil {
+			return err
+		}
+		c.subs[sub.name] = sub
+	}
+
+	return nil
+}
+
+// constValue evaluates an expression made of numbers, constants and enum
+// symbols.
+func (c *compiler) constValue(e expr) (int, error) {
+	switch e := e.(type) {
+	case *numberExpr:
+		return e.value, nil
+
+	case *identExpr:
+		if val, ok := c.consts[e.name]; ok {
+			return val, nil
+		}
+		if val, ok := script.LookupEnumSymbol(e.name); ok {
+			return val, nil
+		}
+
+	case *unaryExpr:
+		x, err := c.constValue(e.x)
+		if err != nil {
+			return 0, err
+		}
+		if e.op == "-" {
+			return -x, nil
+		}
+		if x == 0 {
+			return 1, nil
+		}
+		return 0, nil
+
+	case *binaryExpr:
+		x, err := c.constValue(e.x)
+		if err != nil {
+			return 0, err
+		}
+		y, err := c.constValue(e.y)
+		if err != nil {
+			return 0, err
+		}
+
+		bool2int := func(b bool) int {
+			if b {
+				return 1
+			}
+			return 0
+		}
+
+		switch e.op {
+		case "&": return x & y, nil
+		case "|": return x | y, nil
+		case "==": return bool2int(x == y), nil
+		case "!=": return bool2int(x != y), nil
+		case "<": return bool2int(x < y), nil
+		case "<=": return bool2int(x <= y), nil
+		case ">": return bool2int(x > y), nil
+		case ">=": return bool2int(x >= y), nil
+		case "+": return x + y, nil
+		case "-": return x - y, nil
+		case "*": return x * y, nil
+		}
+
+		if y == 0 {
+			return 0, errorf(e.line, ErrSyntax, "division by zero")
+		}
+		if e.op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	}
+
+	return 0, errorf(e.exprLine(), ErrSyntax, "expected a constant value")
+}
+
+func (c *compiler) emit(format string, args ...any) {
+	c.lines = append(c.lines, "    "+fmt.Sprintf(format, args...))
+}
+
+func (c *compiler) label(name string) {
+	c.lines = append(c.lines, name+":")
+}
+
+func (c *compiler) op(opcode byte) string {
+	return script.InstrMap[opcode].String()
+}
+
+// newLabels returns labels for an if or a while that won't clash with names
+// in the program.
+func (c *compiler) newLabels(kind string, names ...string) []string {
+	c.nextID++
+	labels := []string{}
+	for _, n := range names {
+		labels = append(labels, fmt.Sprintf("__%s_%d_%s", kind, c.nextID, n))
+	}
+	return labels
+}
+
+func (c *compiler) compileSub(sub *subDecl) error {
+	c.sub = sub
+	c.lines = append(c.lines, "")
+	c.label(sub.name)
+
+	err := c.compileBlock(sub.body)
+	if err != nil {
+		return err
+	}
+
+	if sub.name == "main" {
+		c.emit("%s", c.op(0x81)) // halt
+		return nil
+	}
+
+	if _, ok := lastStmt(sub.body).(*returnStmt); !ok {
+		c.emit("%s", c.op(0x86)) // return
+	}
+	return nil
+}
+
+func (c *compiler) compileVar(v *varDecl) error {
+	data := make([]byte, v.size)
+
+	switch init := v.init.(type) {
+	case nil:
+
+	case *stringExpr:
+		raw, err := c.stringBytes(init)
+		if err != nil {
+			return err
+		}
+		if len(raw) >= v.size {
+			return errorf(v.line, ErrType, "string doesn't fit in %s[%d]", v.name, v.size)
+		}
+		copy(data, raw)
+
+	default:
+		val, err := c.constValue(init)
+		if err != nil {
+			return err
+		}
+		if val < -128 || val > 0xFF {
+			return errorf(v.line, ErrType, "value %d doesn't fit in a byte", val)
+		}
+		data[0] = byte(val)
+	}
+
+	c.lines = append(c.lines, "")
+	c.label(v.name)
+	for len(data) > 0 {
+		n := min(len(data), 16)
+		vals := []string{}
+		for _, b := range data[:n] {
+			vals = append(vals, fmt.Sprintf("$%02X", b))
+		}
+		c.emit(".byte %s", strings.Join(vals, ", "))
+		data = data[n:]
+	}
+	return nil
+}
+
+func (c *compiler) compileBlock(stmts []stmt) error {
+	for _, st := range stmts {
+		if err := c.compileStmt(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) compileStmt(st stmt) error {
+	switch st := st.(type) {
+	case *assignStmt:
+		return c.compileAssign(st)
+
+	case *callStmt:
+		if sub, ok := c.subs[st.call.name]; ok {
+			if len(st.call.args) > 0 {
+				return errorf(st.call.line, ErrSyntax, "sub %s doesn't take arguments", sub.name)
+			}
+			c.emit("%s %s", c.op(0x85), sub.name) // call_abs
+			return nil
+		}
+
+		instr, err := c.builtin(st.call)
+		if err != nil {
+			return err
+		}
+		if instr.RetCount > 0 || isStringOp(instr) {
+			return errorf(st.call.line, ErrType, "result of %s is not used", instr)
+		}
+		return c.compileBuiltin(st.call, instr)
+
+	case *ifStmt:
+		labels := c.newLabels("if", "else", "end")
+		if err := c.compileCond(st.cond); err != nil {
+			return err
+		}
+		c.emit("%s %s", c.op(0xC0), labels[0]) // jump_zero
+
+		if err := c.compileBlock(st.then); err != nil {
+			return err
+		}
+
+		if len(st.els) == 0 {
+			c.label(labels[0])
+			return nil
+		}
+
+		if !jumpsAway(st.then) {
+			c.emit("%s %s", c.op(0x84), labels[1]) // jump_abs
+		}
+		c.label(labels[0])
+		if err := c.compileBlock(st.els); err != nil {
+			return err
+		}
+		c.label(labels[1])
+		return nil
+
+	case *whileStmt:
+		labels := c.newLabels("while", "top", "end")
+		c.label(labels[0])
+		if err := c.compileCond(st.cond); err != nil {
+			return err
+		}
+		c.emit("%s %s", c.op(0xC0), labels[1]) // jump_zero
+
+		c.loops = append(c.loops, loop{top: labels[0], end: labels[1]})
+		err := c.compileBlock(st.body)
+		c.loops = c.loops[:len(c.loops)-1]
+		if err != nil {
+			return err
+		}
+
+		c.emit("%s %s", c.op(0x84), labels[0]) // jump_abs
+		c.label(labels[1])
+		return nil
+
+	case *breakStmt:
+		if len(c.loops) == 0 {
+			return errorf(st.line, ErrSyntax, "break outside of a loop")
+		}
+		c.emit("%s %s", c.op(0x84), c.loops[len(c.loops)-1].end)
+		return nil
+
+	case *continueStmt:
+		if len(c.loops) == 0 {
+			return errorf(st.line, ErrSyntax, "continue outside of a loop")
+		}
+		c.emit("%s %s", c.op(0x84), c.loops[len(c.loops)-1].top)
+		return nil
+
+	case *returnStmt:
+		if c.sub.name == "main" {
+			return errorf(st.line, ErrSyntax, "main can't return, use halt() instead")
+		}
+		c.emit("%s", c.op(0x86))
+		return nil
+	}
+
+	return fmt.Errorf("unknown statement %T", st)
+}
+
+func lastStmt(stmts []stmt) stmt {
+	if len(stmts) == 0 {
+		return nil
+	}
+	return stmts[len(stmts)-1]
+}
+
+// jumpsAway returns true if the block never runs the code after it.
+func jumpsAway(stmts []stmt) bool {
+	switch lastStmt(stmts).(type) {
+	case *breakStmt, *continueStmt, *returnStmt:
+		return true
+	}
+	return false
+}
+
+func (c *compiler) compileAssign(st *assignStmt) error {
+	v, ok := c.vars[st.name]
+	if !ok {
+		return errorf(st.line, ErrUndefined, "%s is not a variable", st.name)
+	}
+	if st.index != nil {
+		return errorf(st.line, ErrSyntax, "can't assign to an element of %s", st.name)
+	}
+
+	isString, err := c.isString(st.x)
+	if err != nil {
+		return err
+	}
+
+	if err := c.compileExpr(st.x); err != nil {
+		return err
+	}
+
+	if isString {
+		if v.size < maxStringLength+1 {
+			return errorf(st.line, ErrType, "%s needs to be at least %d bytes to hold a string", st.name, maxStringLength+1)
+		}
+		c.emit("%s %s", c.op(0x8A), st.name) // pop_string_to_addr
+		return nil
+	}
+
+	c.emit("%s %s", c.op(0xBD), st.name) // pop_into
+	return nil
+}
+
+func (c *compiler) compileCond(e expr) error {
+	isString, err := c.isString(e)
+	if err != nil {
+		return err
+	}
+	if isString {
+		return errorf(e.exprLine(), ErrType, "a string can't be used as a condition")
+	}
+	return c.compileExpr(e)
+}
+
+// builtin finds the instruction for a call.
+func (c *compiler) builtin(call *callExpr) (*script.Instruction, error) {
+	instr, ok := script.InstructionByName(call.name)
+	if !ok {
+		return nil, errorf(call.line, ErrUndefined, "%s is not a sub or an instruction", call.name)
+	}
+
+	if slices.Contains(reservedOps, instr.Opcode) {
+		return nil, errorf(call.line, ErrSyntax, "%s can't be called directly", instr)
+	}
+
+	for _, ot := range instr.Operands {
+		switch ot {
+		case script.OperandCodeAddr, script.OperandCodeTable, script.OperandString:
+			return nil, errorf(call.line, ErrSyntax, "%s can't be called directly", instr)
+		}
+	}
+
+	return instr, nil
+}
+
+// isStringOp returns true if the instruction leaves a string on the stack.
+func isStringOp(instr *script.Instruction) bool {
+	return instr.RetCount == 16 || instr.Opcode == 0xBA || instr.Opcode == 0xBC
+}
+
+func (c *compiler) isString(e expr) (bool, error) {
+	switch e := e.(type) {
+	case *stringExpr:
+		return true, nil
+
+	case *callExpr:
+		if _, ok := c.subs[e.name]; ok {
+			return false, nil
+		}
+		instr, err := c.builtin(e)
+		if err != nil {
+			return false, err
+		}
+		return isStringOp(instr), nil
+	}
+	return false, nil
+}
+
+// compileBuiltin pushes the arguments for an instruction and emits it.  The
+// last arguments are its inline operands.
+func (c *compiler) compileBuiltin(call *callExpr, instr *script.Instruction) error {
+	if len(call.args) < len(instr.Operands) {
+		return errorf(call.line, ErrSyntax, "%s needs %d inline operands", instr, len(instr.Operands))
+	}
+
+	pushed := call.args[:len(call.args)-len(instr.Operands)]
+	strs := instr.StrCount
+	if len(pushed) != instr.ArgCount+strs {
+		return errorf(call.line, ErrSyntax, "%s needs %d arguments, found %d",
+			instr, instr.ArgCount+strs+len(instr.Operands), len(call.args))
+	}
+
+	if strs > 0 {
+		arg := pushed[len(pushed)-1]
+		isStr, err := c.isString(arg)
+		if err != nil {
+			return err
+		}
+		if !isStr {
+			return errorf(arg.exprLine(), ErrType, "the last argument of %s must be a string", instr)
+		}
+	}
+
+	for _, arg := range pushed {
+		if err := c.compileExpr(arg); err != nil {
+			return err
+		}
+	}
+
+	operands := []string{}
+	for i, ot := range instr.Operands {
+		arg := call.args[len(pushed)+i]
+
+		if ot == script.OperandDataAddr {
+			id, ok := arg.(*identExpr)
+			if !ok || c.vars[id.name] == nil {
+				return errorf(arg.exprLine(), ErrType, "operand %d of %s must be a variable", i+1, instr)
+			}
+			operands = append(operands, id.name)
+			continue
+		}
+
+		val, err := c.constValue(arg)
+		if err != nil {
+			return err
+		}
+		if ot.Size() == 1 && (val < -128 || val > 0xFF) {
+			return errorf(arg.exprLine(), ErrType, "operand %d of %s doesn't fit in a byte", i+1, instr)
+		}
+		operands = append(operands, fmt.Sprintf("$%0*X", ot.Size()*2, val & (1<<(ot.Size()*8)-1)))
+	}
+
+	if len(operands) > 0 {
+		c.emit("%s %s", instr, strings.Join(operands, " "))
+	} else {
+		c.emit("%s", instr)
+	}
+	return nil
+}
+
+func (c *compiler) stringBytes(e *stringExpr) ([]byte, error) {
+	raw, err := script.CharTable.Bytes(e.text)
+	if err != nil {
+		return nil, errorf(e.line, ErrSyntax, "%s", err)
+	}
+	return raw, nil
+}
+
+func (c *compiler) compileExpr(e expr) error {
+	switch e := e.(type) {
+	case *numberExpr:
+		if e.value < -0x8000 || e.value > 0xFFFF {
+			return errorf(e.line, ErrType, "%d doesn't fit in a word", e.value)
+		}
+		c.emit("%s $%04X", c.op(0xB8), e.value & 0xFFFF) // push_word
+		return nil
+
+	case *stringExpr:
+		raw, err := c.stringBytes(e)
+		if err != nil {
+			return err
+		}
+		if len(raw) > maxStringLength {
+			return errorf(e.line, ErrType, "string is %d bytes, the limit is %d", len(raw), maxStringLength)
+		}
+		c.emit("%s \"%s\"", c.op(0xBB), e.text) // push_data
+		return nil
+
+	case *identExpr:
+		switch {
+		case c.vars[e.name] != nil:
+			c.emit("%s %s", c.op(0xB7), e.name) // push_var
+		case c.subs[e.name] != nil:
+			c.emit("%s %s", c.op(0xB8), e.name)
+		default:
+			val, err := c.constValue(e)
+			if err != nil {
+				return errorf(e.line, ErrUndefined, "%s", e.name)
+			}
+			if _, ok := c.consts[e.name]; ok {
+				c.emit("%s $%04X", c.op(0xB8), val & 0xFFFF)
+			} else {
+				c.emit("%s %s", c.op(0xB8), e.name) // enum symbol
+			}
+		}
+		return nil
+
+	case *indexExpr:
+		if c.vars[e.name] == nil {
+			return errorf(e.line, ErrUndefined, "%s is not a variable", e.name)
+		}
+		if err := c.compileNumber(e.index); err != nil {
+			return err
+		}
+		c.emit("%s %s", c.op(0xB9), e.name) // push_var_indexed
+		return nil
+
+	case *unaryExpr:
+		if err := c.compileNumber(e.x); err != nil {
+			return err
+		}
+		c.emit("%s", c.op(unaryOps[e.op]))
+		return nil
+
+	case *binaryExpr:
+		if err := c.compileNumber(e.x); err != nil {
+			return err
+		}
+		if err := c.compileNumber(e.y); err != nil {
+			return err
+		}
+		c.emit("%s", c.op(binaryOps[e.op]))
+		return nil
+
+	case *callExpr:
+		if _, ok := c.subs[e.name]; ok {
+			return errorf(e.line, ErrType, "sub %s doesn't return a value", e.name)
+		}
+
+		instr, err := c.builtin(e)
+		if err != nil {
+			return err
+		}
+		if instr.RetCount == 0 && !isStringOp(instr) {
+			return errorf(e.line, ErrType, "%s doesn't return a value", instr)
+		}
+		return c.compileBuiltin(e, instr)
+	}
+
+	return fmt.Errorf("unknown expression %T", e)
+}
+
+// compileNumber compiles an expression that can't be a string.
+func (c *compiler) compileNumber(e expr) error {
+	isString, err := c.isString(e)
+	if err != nil {
+		return err
+	}
+	if isString {
+		return errorf(e.exprLine(), ErrType, "expected a number, found a string")
+	}
+	return c.compileExpr(e)
+}
@@ -0,0 +1,130 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokNewline
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	typ  tokenType
+	text string // identifier, punctuation, or the string without quotes
+	num  int
+	line int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of file"
+	case tokNewline:
+		return "end of line"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// Two character operators are matched first.
+var punctuation = []string{
+	"==", "!=", "<=", ">=",
+	"{", "}", "(", ")", "[", "]", ",", ";",
+	"=", "<", ">", "+", "-", "*", "/", "%", "&", "|", "!",
+}
+
+// lex splits the source into tokens.  Comments start with "//" and run to
+// the end of the line.  Newlines end statements, so they are tokens too.
+func lex(source string) ([]token, error) {
+	tokens := []token{}
+	line := 1
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			tokens = append(tokens, token{typ: tokNewline, text: "\n", line: line})
+			line++
+			i++
+
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+
+		case c == '"':
+			// Escapes are left alone; they're the same as the assembler's.
+			end := i+1
+			for end < len(source) && source[end] != '"' && source[end] != '\n' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) || source[end] != '"' {
+				return nil, fmt.Errorf("line %d: %w: unterminated string", line, ErrSyntax)
+			}
+			tokens = append(tokens, token{typ: tokString, text: source[i+1:end], line: line})
+			i = end+1
+
+		case c == '$' || (c >= '0' && c <= '9'):
+			end := i+1
+			for end < len(source) && isIdentChar(rune(source[end])) {
+				end++
+			}
+
+			text := source[i:end]
+			num := strings.Replace(text, "$", "0x", 1)
+			val, err := strconv.ParseInt(num, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w: invalid number %q", line, ErrSyntax, text)
+			}
+			tokens = append(tokens, token{typ: tokNumber, text: text, num: int(val), line: line})
+			i = end
+
+		case isIdentChar(rune(c)):
+			end := i
+			for end < len(source) && isIdentChar(rune(source[end])) {
+				end++
+			}
+			tokens = append(tokens, token{typ: tokIdent, text: source[i:end], line: line})
+			i = end
+
+		default:
+			found := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(source[i:], p) {
+					tokens = append(tokens, token{typ: tokPunct, text: p, line: line})
+					i += len(p)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return nil, fmt.Errorf("line %d: %w: unexpected character %q", line, ErrSyntax, c)
+			}
+		}
+	}
+
+	tokens = append(tokens, token{typ: tokEOF, line: line})
+	return tokens, nil
+}
+
+// Identifiers become assembler labels, so they're limited to ASCII.
+func isIdentChar(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,496 @@
+package compiler
+
+import (
+	"fmt"
+	"slices"
+)
+
+type program struct {
+	consts []*constDecl
+	vars   []*varDecl
+	subs   []*subDecl
+}
+
+type constDecl struct {
+	name  string
+	value expr
+	line  int
+}
+
+// varDecl is a variable stored in the script after the code.  Variables are
+// one byte unless they have a size.
+type varDecl struct {
+	name string
+	size int
+	init expr // nil for zero
+	line int
+}
+
+type subDecl struct {
+	name string
+	body []stmt
+	line int
+}
+
+type expr interface {
+	exprLine() int
+}
+
+type (
+	numberExpr struct{ value int; line int }
+	stringExpr struct{ text string; line int }
+	identExpr  struct{ name string; line int }
+	indexExpr  struct{ name string; index expr; line int }
+	unaryExpr  struct{ op string; x expr; line int }
+	binaryExpr struct{ op string; x, y expr; line int }
+	callExpr   struct{ name string; args []expr; line int }
+)
+
+func (e *numberExpr) exprLine() int { return e.line }
+func (e *stringExpr) exprLine() int { return e.line }
+func (e *identExpr) exprLine() int  { return e.line }
+func (e *indexExpr) exprLine() int  { return e.line }
+func (e *unaryExpr) exprLine() int  { return e.line }
+func (e *binaryExpr) exprLine() int { return e.line }
+func (e *callExpr) exprLine() int   { return e.line }
+
+type stmt interface{}
+
+type (
+	assignStmt   struct{ name string; index expr; x expr; line int }
+	callStmt     struct{ call *callExpr }
+	breakStmt    struct{ line int }
+	continueStmt struct{ line int }
+	returnStmt   struct{ line int }
+)
+
+type ifStmt struct {
+	cond expr
+	then []stmt
+	els  []stmt
+	line int
+}
+
+type whileStmt struct {
+	cond expr
+	body []stmt
+	line int
+}
+
+var keywords = []string{"const", "var", "sub", "if", "else", "while", "break", "continue", "return"}
+
+// Binary operators from lowest to highest precedence.
+var precedence = [][]string{
+	{"|"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.typ == tokPunct || t.typ == tokIdent) && t.text == text
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("line %d: %w: %s", t.line, ErrSyntax, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(text string) (token, error) {
+	t := p.next()
+	if (t.typ != tokPunct && t.typ != tokIdent) || t.text != text {
+		return t, p.errorf(t, "expected %q, found %s", text, t)
+	}
+	return t, nil
+}
+
+func (p *parser) ident() (token, error) {
+	t := p.next()
+	if t.typ != tokIdent {
+		return t, p.errorf(t, "expected a name, found %s", t)
+	}
+	if slices.Contains(keywords, t.text) {
+		return t, p.errorf(t, "%q is a keyword", t.text)
+	}
+	return t, nil
+}
+
+func (p *parser) skipNewlines() {
+	for p.peek().typ == tokNewline || p.is(";") {
+		p.next()
+	}
+}
+
+// endStatement expects the end of a line, a semicolon, or the closing brace
+// of a block.
+func (p *parser) endStatement() error {
+	t := p.peek()
+	switch {
+	case t.typ == tokNewline, t.typ == tokEOF, p.is(";"):
+		p.next()
+		return nil
+	case p.is("}"):
+		return nil
+	}
+	return p.errorf(t, "expected end of line, found %s", t)
+}
+
+func parse(tokens []token) (*program, error) {
+	p := &parser{tokens: tokens}
+	prog := &program{}
+
+	for {
+		p.skipNewlines()
+		t := p.peek()
+		if t.typ == tokEOF {
+			return prog, nil
+		}
+
+		switch {
+		case p.is("const"):
+			p.next()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("="); err != nil {
+				return nil, err
+			}
+			value, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			prog.consts = append(prog.consts, &constDecl{name: name.text, value: value, line: name.line})
+
+		case p.is("var"):
+			p.next()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+
+			v := &varDecl{name: name.text, size: 1, line: name.line}
+			if p.is("[") {
+				p.next()
+				size := p.next()
+				if size.typ != tokNumber || size.num < 1 {
+					return nil, p.errorf(size, "invalid size %s", size)
+				}
+				v.size = size.num
+				if _, err := p.expect("]"); err != nil {
+					return nil, err
+				}
+			}
+
+			if p.is("=") {
+				p.next()
+				v.init, err = p.expr()
+				if err != nil {
+					return nil, err
+				}
+			}
+			prog.vars = append(prog.vars, v)
+
+		case p.is("sub"):
+			p.next()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			prog.subs = append(prog.subs, &subDecl{name: name.text, body: body, line: name.line})
+
+		default:
+			return nil, p.errorf(t, "expected const, var or sub, found %s", t)
+		}
+
+		if err := p.endStatement(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) block() ([]stmt, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	stmts := []stmt{}
+	for {
+		p.skipNewlines()
+		if p.is("}") {
+			p.next()
+			return stmts, nil
+		}
+		if p.peek().typ == tokEOF {
+			return nil, p.errorf(p.peek(), "missing \"}\"")
+		}
+
+		st, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, st)
+
+		if err := p.endStatement(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	if t.typ != tokIdent {
+		return nil, p.errorf(t, "expected a statement, found %s", t)
+	}
+
+	switch t.text {
+	case "if":
+		return p.ifStatement()
+
+	case "while":
+		p.next()
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{cond: cond, body: body, line: t.line}, nil
+
+	case "break":
+		p.next()
+		return &breakStmt{t.line}, nil
+
+	case "continue":
+		p.next()
+		return &continueStmt{t.line}, nil
+
+	case "return":
+		p.next()
+		return &returnStmt{t.line}, nil
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.is("(") {
+		call, err := p.call(name)
+		if err != nil {
+			return nil, err
+		}
+		return &callStmt{call}, nil
+	}
+
+	assign := &assignStmt{name: name.text, line: name.line}
+	if p.is("[") {
+		p.next()
+		assign.index, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.expect("="); err != nil {
+		return nil, err
+	}
+	assign.x, err = p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return assign, nil
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	t, err := p.expect("if")
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	st := &ifStmt{cond: cond, then: then, line: t.line}
+
+	// else can be on the line after the closing brace
+	save := p.pos
+	p.skipNewlines()
+	if !p.is("else") {
+		p.pos = save
+		return st, nil
+	}
+	p.next()
+
+	if p.is("if") {
+		elseif, err := p.ifStatement()
+		if err != nil {
+			return nil, err
+		}
+		st.els = []stmt{elseif}
+		return st, nil
+	}
+
+	st.els, err = p.block()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.binary(0)
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	x, err := p.binary(level+1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.typ != tokPunct || !slices.Contains(precedence[level], t.text) {
+			return x, nil
+		}
+		p.next()
+
+		y, err := p.binary(level+1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: t.text, x: x, y: y, line: t.line}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.is("-") || p.is("!") {
+		t := p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		// Negative numbers are constants, not negate instructions.
+		if n, ok := x.(*numberExpr); ok && t.text == "-" {
+			return &numberExpr{value: -n.value, line: t.line}, nil
+		}
+		return &unaryExpr{op: t.text, x: x, line: t.line}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokNumber:
+		p.next()
+		return &numberExpr{value: t.num, line: t.line}, nil
+
+	case tokString:
+		p.next()
+		return &stringExpr{text: t.text, line: t.line}, nil
+
+	case tokIdent:
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case p.is("("):
+			return p.call(name)
+
+		case p.is("["):
+			p.next()
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return &indexExpr{name: name.text, index: index, line: name.line}, nil
+		}
+		return &identExpr{name: name.text, line: name.line}, nil
+	}
+
+	if p.is("(") {
+		p.next()
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+
+	return nil, p.errorf(t, "expected an expression, found %s", t)
+}
+
+func (p *parser) call(name token) (*callExpr, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := &callExpr{name: name.text, args: []expr{}, line: name.line}
+	if p.is(")") {
+		p.next()
+		return call, nil
+	}
+
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+
+		if p.is(")") {
+			p.next()
+			return call, nil
+		}
+		if _, err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package gfx
+
+import (
+	"image/color"
+)
+
+// NesColors maps NES colour values to RGB.
+var NesColors map[byte]color.Color = map[byte]color.Color{
+	0x00: color.RGBA{0x66, 0x66, 0x66, 0xFF},
+	0x10: color.RGBA{0xAD, 0xAD, 0xAD, 0xFF},
+	0x20: color.RGBA{0xFF, 0xFF, 0xEF, 0xFF},
+	0x30: color.RGBA{0xFF, 0xFF, 0xEF, 0xFF},
+
+	0x01: color.RGBA{0x00, 0x2A, 0x88, 0xFF},
+	0x11: color.RGBA{0x15, 0x5F, 0xD9, 0xFF},
+	0x21: color.RGBA{0x64, 0xB0, 0xFF, 0xFF},
+	0x31: color.RGBA{0xC0, 0xDF, 0xFF, 0xFF},
+
+	0x02: color.RGBA{0x14, 0x12, 0xA7, 0xFF},
+	0x12: color.RGBA{0x42, 0x40, 0xFF, 0xFF},
+	0x22: color.RGBA{0x92, 0x90, 0xFF, 0xFF},
+	0x32: color.RGBA{0xD3, 0xD2, 0xFF, 0xFF},
+
+	0x03: color.RGBA{0x3B, 0x00, 0xA4, 0xFF},
+	0x13: color.RGBA{0x75, 0x27, 0xFE, 0xFF},
+	0x23: color.RGBA{0xC6, 0x76, 0xFF, 0xFF},
+	0x33: color.RGBA{0xE8, 0xC8, 0xFF, 0xFF},
+
+	0x04: color.RGBA{0x5C, 0x00, 0x7E, 0xFF},
+	0x14: color.RGBA{0xA0, 0x1A, 0xCC, 0xFF},
+	0x24: color.RGBA{0xF3, 0x6A, 0xFF, 0xFF},
+	0x34: color.RGBA{0xFB, 0xC2, 0xFF, 0xFF},
+
+	0x05: color.RGBA{0x6E, 0x00, 0x40, 0xFF},
+	0x15: color.RGBA{0xB7, 0x1E, 0x7B, 0xFF},
+	0x25: color.RGBA{0xFE, 0x6E, 0xCC, 0xFF},
+	0x35: color.RGBA{0xFE, 0xC4, 0xEA, 0xFF},
+
+	0x06: color.RGBA{0x6C, 0x06, 0x00, 0xFF},
+	0x16: color.RGBA{0xB5, 0x31, 0x20, 0xFF},
+	0x26: color.RGBA{0xFE, 0x81, 0x70, 0xFF},
+	0x36: color.RGBA{0xFE, 0xCC, 0xC5, 0xFF},
+
+	0x07: color.RGBA{0x56, 0x1D, 0x00, 0xFF},
+	0x17: color.RGBA{0x99, 0x4E, 0x00, 0xFF},
+	0x27: color.RGBA{0xEA, 0x9E, 0x22, 0xFF},
+	0x37: color.RGBA{0xF7, 0xD8, 0xA5, 0xFF},
+
+	0x08: color.RGBA{0x33, 0x35, 0x00, 0xFF},
+	0x18: color.RGBA{0x6B, 0x6D, 0x00, 0xFF},
+	0x28: color.RGBA{0xBC, 0xBE, 0x00, 0xFF},
+	0x38: color.RGBA{0xE4, 0xE5, 0x94, 0xFF},
+
+	0x09: color.RGBA{0x0B, 0x48, 0x00, 0xFF},
+	0x19: color.RGBA{0x38, 0x87, 0x00, 0xFF},
+	0x29: color.RGBA{0x88, 0xD8, 0x00, 0xFF},
+	0x39: color.RGBA{0xCF, 0xEF, 0x96, 0xFF},
+
+	0x0A: color.RGBA{0x00, 0x52, 0x00, 0xFF},
+	0x1A: color.RGBA{0x0C, 0x93, 0x00, 0xFF},
+	0x2A: color.RGBA{0x5C, 0xE4, 0x30, 0xFF},
+	0x3A: color.RGBA{0xBD, 0xF4, 0xAB, 0xFF},
+
+	0x0B: color.RGBA{0x00, 0x4F, 0x08, 0xFF},
+	0x1B: color.RGBA{0x00, 0x8F, 0x32, 0xFF},
+	0x2B: color.RGBA{0x45, 0xE0, 0x82, 0xFF},
+	0x3B: color.RGBA{0xB3, 0xF3, 0xCC, 0xFF},
+
+	0x0C: color.RGBA{0x00, 0x40, 0x4D, 0xFF},
+	0x1C: color.RGBA{0x00, 0x7C, 0x8D, 0xFF},
+	0x2C: color.RGBA{0x48, 0xCD, 0xDE, 0xFF},
+	0x3C: color.RGBA{0xB5, 0xEB, 0xF2, 0xFF},
+
+	0x0D: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x1D: color.RGBA{0x00, 0x7C, 0x8D, 0xFF},
+	0x2D: color.RGBA{0x4F, 0x4F, 0x4F, 0xFF},
+	0x3D: color.RGBA{0xB8, 0xB8, 0xB8, 0xFF},
+
+	0x0E: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x1E: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x2E: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x3E: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+
+	0x0F: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x1F: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x2F: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	0x3F: color.RGBA{0x00, 0x00, 0x00, 0xFF},
+}
+
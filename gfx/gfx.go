@@ -0,0 +1,275 @@
+// Package gfx decodes StudyBox graphics.
+//
+// Images are stored in two segments: CHR data with the tiles, and a tile
+// segment with one or more images made of those tiles.  Images are either
+// nametable (background) data or sprite data.  The format is described in
+// docs/images.md.
+//
+// ParseSegment reads a tile segment into its headers, images and palettes.
+// DecodeChr reads the tiles, and Segment.Layers combines the two into
+// images that can be drawn with the image/draw package:
+//
+//	seg, err := gfx.ParseSegment(ntData)
+//	tiles, err := gfx.DecodeChr(chrData)
+//	layers, err := seg.Layers(tiles, isSprites)
+package gfx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Size of the headers in bytes.
+const (
+	DataHeaderSize  = 5
+	ImageHeaderSize = 6
+)
+
+// Number of palettes in a segment, and colours in each palette.  The
+// palette area is twice the size of the palettes; the rest of it and
+// anything after it seems to be padding.
+const (
+	PaletteCount    = 4
+	PaletteSize     = 4
+	PaletteAreaSize = 32
+)
+
+// Screen size in tiles.  Background layers are always a full screen.
+const (
+	ScreenWidth  = 32
+	ScreenHeight = 30
+)
+
+// Background attributes are always a full screen: 8x8 bytes, each covering
+// 4x4 tiles.
+const BgAttributeSize = 64
+
+type DataHeader struct {
+	PaletteOffset uint16 // offset from the ImageCount byte
+	ArgB uint16 // ?? unused i think?
+	ImageCount uint8
+}
+
+func (h DataHeader) String() string {
+	return fmt.Sprintf("{DataHeader PaletteOffset:$%04X ArgB:$%04X ImageCount:%d}",
+		h.PaletteOffset,
+		h.ArgB,
+		h.ImageCount,
+	)
+}
+
+type ImageHeader struct {
+	// in tiles
+	Width uint8
+	Height uint8
+
+	// in bytes
+	AttrLength uint16
+
+	// in pixels
+	X uint8
+	Y uint8
+}
+
+func (h ImageHeader) String() string {
+	return fmt.Sprintf("{ImageHeader Width:%d[%02X] Height:%d[%02X] AttrLength:$%04X XCoord:%d[%02X] YCoord:%d[%02X]}",
+		h.Width, h.Width,
+		h.Height, h.Height,
+		h.AttrLength,
+		h.X, h.X,
+		h.Y, h.Y,
+	)
+}
+
+// Image is one image in a tile segment, as it is stored.
+type Image struct {
+	Header     ImageHeader
+	Tiles      []byte // tile IDs, row by row
+	Attributes []byte // one byte per tile for sprites, 64 bytes for backgrounds
+}
+
+// Palette is one of the palettes in a tile segment.
+type Palette struct {
+	IDs    [PaletteSize]byte // NES colour values as stored
+	Colors color.Palette
+}
+
+// Segment is a decoded tile segment.
+type Segment struct {
+	Header   DataHeader
+	Images   []*Image
+	Palettes []*Palette
+
+	// Bytes after the palette area.  These seem to be padding.
+	Padding []byte
+
+	// Things that look wrong but don't stop decoding.
+	Warnings []string
+}
+
+// PaletteStart returns the offset of the palette data in the segment.
+func (h DataHeader) PaletteStart() int {
+	return int(h.PaletteOffset)+4
+}
+
+// ParseSegment reads a tile segment.
+func ParseSegment(raw []byte) (*Segment, error) {
+	seg := &Segment{
+		Images:   []*Image{},
+		Palettes: []*Palette{},
+		Warnings: []string{},
+	}
+
+	_, err := binary.Decode(raw, binary.LittleEndian, &seg.Header)
+	if err != nil {
+		return nil, fmt.Errorf("data header: %w", err)
+	}
+
+	offset := DataHeaderSize
+	for i := 0; i < int(seg.Header.ImageCount); i++ {
+		img := &Image{}
+		if offset+ImageHeaderSize > len(raw) {
+			return nil, fmt.Errorf("image header %d: not enough data", i)
+		}
+
+		_, err = binary.Decode(raw[offset:], binary.LittleEndian, &img.Header)
+		if err != nil {
+			return nil, fmt.Errorf("image header %d: %w", i, err)
+		}
+		seg.Images = append(seg.Images, img)
+		offset += ImageHeaderSize
+	}
+
+	for i, img := range seg.Images {
+		tileLen := int(img.Header.Width)*int(img.Header.Height)
+		attrLen := int(img.Header.AttrLength)
+		if offset+tileLen+attrLen > len(raw) {
+			return nil, fmt.Errorf("image %d: not enough data", i)
+		}
+
+		img.Tiles = raw[offset:offset+tileLen]
+		offset += tileLen
+		img.Attributes = raw[offset:offset+attrLen]
+		offset += attrLen
+	}
+
+	palStart := seg.Header.PaletteStart()
+	if offset != palStart {
+		seg.Warnings = append(seg.Warnings, fmt.Sprintf("image data ends at $%04X but the palettes start at $%04X", offset, palStart))
+	}
+
+	palEnd := palStart+PaletteCount*PaletteSize
+	if palEnd > len(raw) {
+		return nil, fmt.Errorf("palettes: not enough data")
+	}
+
+	for i := 0; i < PaletteCount; i++ {
+		p := &Palette{Colors: color.Palette{}}
+		for j := 0; j < PaletteSize; j++ {
+			v := raw[palStart+i*PaletteSize+j]
+			p.IDs[j] = v
+
+			// $3D is treated as black.
+			if v == 0x3D {
+				v = 0x0F
+			}
+			c, ok := NesColors[v]
+			if !ok {
+				return nil, fmt.Errorf("Color value $%02X invalid", v)
+			}
+			p.Colors = append(p.Colors, c)
+		}
+		seg.Palettes = append(seg.Palettes, p)
+	}
+
+	seg.Padding = raw[min(palStart+PaletteAreaSize, len(raw)):]
+	for _, b := range seg.Padding {
+		if b != 0x00 {
+			seg.Warnings = append(seg.Warnings, fmt.Sprintf("%d bytes of extra data", len(seg.Padding)))
+			break
+		}
+	}
+
+	return seg, nil
+}
+
+// Layers returns a layer for each image in the segment, using the tiles
+// from the CHR data.  Nametable data expects the four SolidTiles before the
+// CHR tiles; they are added here.  Tile IDs past the end of the tiles are
+// left empty.
+func (seg *Segment) Layers(tiles []*Tile, isSprites bool) ([]*Layer, error) {
+	if !isSprites {
+		tiles = append(SolidTiles(), tiles...)
+	}
+
+	palettes := []color.Palette{}
+	for _, p := range seg.Palettes {
+		palettes = append(palettes, p.Colors)
+	}
+
+	layers := []*Layer{}
+	for i, img := range seg.Images {
+		head := img.Header
+		width, height := ScreenWidth, ScreenHeight
+		if isSprites {
+			width, height = int(head.Width), int(head.Height)
+		}
+
+		l := NewLayer(width, height, palettes)
+		l.Transparency = isSprites
+		l.IsSprite = isSprites
+		l.Location = image.Pt(int(head.X), int(head.Y))
+
+		for idx, id := range img.Tiles {
+			if int(id) >= len(tiles) {
+				continue
+			}
+
+			if isSprites {
+				l.Tiles[idx] = tiles[id]
+				continue
+			}
+
+			row := idx/int(head.Width)+int(head.Y/8)
+			col := idx%int(head.Width)+int(head.X/8)
+			if row >= ScreenHeight || col >= ScreenWidth {
+				return nil, fmt.Errorf("image %d: tile %d is off the screen", i, idx)
+			}
+			l.Tiles[row*ScreenWidth+col] = tiles[id]
+		}
+
+		if isSprites {
+			copy(l.Attributes, img.Attributes)
+		} else {
+			// FIXME: This will break on background chunks that aren't a full screen.
+			//        Need to verify the anchor point in the firmware for this case (for
+			//        when the tile anchor point isn't aligned to an attribute byte).
+			err := l.SetAttributes(img.Attributes)
+			if err != nil {
+				return nil, fmt.Errorf("image %d: %w", i, err)
+			}
+		}
+
+		for _, a := range l.Attributes {
+			if int(a) >= len(palettes) {
+				return nil, fmt.Errorf("image %d: palette %d out of range", i, a)
+			}
+		}
+
+		layers = append(layers, l)
+	}
+
+	return layers, nil
+}
+
+// ReadData parses a tile segment and returns its layers.  See ParseSegment
+// and Segment.Layers.
+func ReadData(raw []byte, tiles []*Tile, isSprites bool) ([]*Layer, error) {
+	seg, err := ParseSegment(raw)
+	if err != nil {
+		return nil, err
+	}
+	return seg.Layers(tiles, isSprites)
+}
@@ -0,0 +1,385 @@
+package gfx
+
+import (
+	"encoding/hex"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// Sprite segment from docs/images.md.
+const spriteHex = `
+79 00 2b 00 03 03 05 0f  00 40 38 05 06 1e 00 78
+28 03 02 06 00 60 40 00  01 02 03 04 05 06 07 08
+09 0a 0b 0c 0d 0e 00 02  02 02 02 03 03 03 03 02
+03 02 00 00 02 0c 0f 10  11 12 00 13 14 15 16 17
+18 19 1a 1b 1c 1d 1e 1f  20 21 22 23 24 25 26 27
+28 29 2a 00 00 00 00 00  00 00 00 00 00 00 00 00
+00 00 01 00 00 00 00 01  01 01 01 01 01 01 01 01
+00 2b 2c 2d 2e 2f 30 00  00 00 00 00 00 3d 01 17
+37 3d 01 26 37 3d 01 20  37 3d 01 20 02 00 00 00
+00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00
+00 00 00 00 00 00 00 00
+`
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	raw, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// fullBackground builds a one image, full screen background segment.  Every
+// tile uses tileID and every attribute byte is attr.
+func fullBackground(tileID, attr byte, palettes []byte) []byte {
+	tileLen := ScreenWidth*ScreenHeight
+	palOffset := ImageHeaderSize+tileLen+BgAttributeSize+1
+
+	raw := []byte{
+		byte(palOffset), byte(palOffset>>8), 0x2B, 0x00, 0x01,
+		ScreenWidth, ScreenHeight, BgAttributeSize, 0x00, 0x00, 0x00,
+	}
+	for i := 0; i < tileLen; i++ {
+		raw = append(raw, tileID)
+	}
+	for i := 0; i < BgAttributeSize; i++ {
+		raw = append(raw, attr)
+	}
+	return append(raw, palettes...)
+}
+
+var bgPalettes = []byte{
+	0x0F, 0x12, 0x20, 0x16,
+	0x0F, 0x27, 0x20, 0x16,
+	0x0F, 0x27, 0x20, 0x12,
+	0x0F, 0x28, 0x20, 0x12,
+}
+
+func TestDecodeChr(t *testing.T) {
+	raw := make([]byte, TileBytes*2)
+	raw[0] = 0x80  // low plane, row 0: pixel 0
+	raw[8] = 0x81  // high plane, row 0: pixels 0 and 7
+	raw[15] = 0x01 // high plane, row 7: pixel 7
+	raw[16+3] = 0xFF
+
+	tiles, err := DecodeChr(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tiles) != 2 {
+		t.Fatalf("expected 2 tiles, got %d", len(tiles))
+	}
+
+	checks := []struct {
+		tile, x, y int
+		want uint8
+	}{
+		{0, 0, 0, 3},
+		{0, 7, 0, 2},
+		{0, 1, 0, 0},
+		{0, 7, 7, 2},
+		{1, 4, 3, 1},
+		{1, 4, 2, 0},
+	}
+	for _, c := range checks {
+		got := tiles[c.tile].ColorIndexAt(c.x, c.y)
+		if got != c.want {
+			t.Errorf("tile %d (%d, %d): expected %d, got %d", c.tile, c.x, c.y, c.want, got)
+		}
+	}
+
+	_, err = DecodeChr(raw[:20])
+	if err == nil {
+		t.Error("expected an error for a partial tile")
+	}
+}
+
+func TestSolidTiles(t *testing.T) {
+	tiles := SolidTiles()
+	if len(tiles) != 4 {
+		t.Fatalf("expected 4 tiles, got %d", len(tiles))
+	}
+
+	for i, tile := range tiles {
+		for _, p := range tile.Pixels {
+			if p != uint8(i) {
+				t.Fatalf("tile %d has pixel %d", i, p)
+			}
+		}
+	}
+}
+
+func TestParseSegmentSprites(t *testing.T) {
+	seg, err := ParseSegment(decodeHex(t, spriteHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seg.Header.PaletteStart() != 0x7D || seg.Header.ImageCount != 3 {
+		t.Errorf("unexpected header: %s", seg.Header)
+	}
+
+	if len(seg.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", seg.Warnings)
+	}
+
+	heads := []ImageHeader{
+		{Width: 3, Height: 5, AttrLength: 15, X: 64, Y: 56},
+		{Width: 5, Height: 6, AttrLength: 30, X: 120, Y: 40},
+		{Width: 3, Height: 2, AttrLength: 6, X: 96, Y: 64},
+	}
+	if len(seg.Images) != len(heads) {
+		t.Fatalf("expected %d images, got %d", len(heads), len(seg.Images))
+	}
+
+	for i, img := range seg.Images {
+		if img.Header != heads[i] {
+			t.Errorf("image %d: expected %s, got %s", i, heads[i], img.Header)
+		}
+
+		if len(img.Tiles) != int(heads[i].Width)*int(heads[i].Height) {
+			t.Errorf("image %d: wrong tile count %d", i, len(img.Tiles))
+		}
+
+		if len(img.Attributes) != int(heads[i].AttrLength) {
+			t.Errorf("image %d: wrong attribute count %d", i, len(img.Attributes))
+		}
+	}
+
+	if seg.Images[2].Tiles[0] != 0x2B || seg.Images[0].Attributes[1] != 0x02 {
+		t.Error("image data read from the wrong offset")
+	}
+
+	if len(seg.Palettes) != PaletteCount {
+		t.Fatalf("expected %d palettes, got %d", PaletteCount, len(seg.Palettes))
+	}
+
+	pal := seg.Palettes[0]
+	if pal.IDs != [PaletteSize]byte{0x3D, 0x01, 0x17, 0x37} {
+		t.Errorf("unexpected palette IDs: %02X", pal.IDs)
+	}
+
+	// $3D is drawn as black
+	if pal.Colors[0] != NesColors[0x0F] || pal.Colors[3] != NesColors[0x37] {
+		t.Errorf("unexpected palette colors: %v", pal.Colors)
+	}
+
+	if len(seg.Padding) != 11 {
+		t.Errorf("expected 11 bytes of padding, got %d", len(seg.Padding))
+	}
+}
+
+func TestParseSegmentWarnings(t *testing.T) {
+	raw := decodeHex(t, spriteHex)
+	raw[0] = 0x7A
+	raw[len(raw)-1] = 0x01
+
+	seg, err := ParseSegment(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seg.Warnings) != 2 {
+		t.Errorf("expected 2 warnings, got %v", seg.Warnings)
+	}
+}
+
+func TestParseSegmentErrors(t *testing.T) {
+	raw := decodeHex(t, spriteHex)
+
+	tests := map[string][]byte{
+		"data header":  raw[:3],
+		"image header": raw[:14],
+		"image data":   raw[:0x40],
+		"palettes":     raw[:0x85],
+	}
+
+	badColor := append([]byte{}, raw...)
+	badColor[0x7E] = 0x40
+	tests["invalid color"] = badColor
+
+	for name, data := range tests {
+		_, err := ParseSegment(data)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSetAttributes(t *testing.T) {
+	data := make([]byte, BgAttributeSize)
+	data[0] = 0xE4  // br:3 bl:2 tr:1 tl:0
+	data[63] = 0xE4 // bottom row only has the top half
+
+	l := NewLayer(ScreenWidth, ScreenHeight, nil)
+	err := l.SetAttributes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		col, row int
+		want byte
+	}{
+		{0, 0, 0}, {1, 1, 0},
+		{2, 0, 1}, {3, 1, 1},
+		{0, 2, 2}, {1, 3, 2},
+		{2, 2, 3}, {3, 3, 3},
+		{4, 0, 0},
+		{28, 28, 0}, {30, 29, 1},
+	}
+	for _, c := range checks {
+		got := l.Attributes[c.row*ScreenWidth+c.col]
+		if got != c.want {
+			t.Errorf("(%d, %d): expected %d, got %d", c.col, c.row, c.want, got)
+		}
+	}
+
+	if l.SetAttributes(data[:32]) == nil {
+		t.Error("expected an error for short attribute data")
+	}
+}
+
+func TestBackgroundLayers(t *testing.T) {
+	// One CHR tile with colour 1 on the top row and 2 everywhere else.
+	chr := make([]byte, TileBytes)
+	chr[0] = 0xFF
+	for i := 9; i < 16; i++ {
+		chr[i] = 0xFF
+	}
+	tiles, err := DecodeChr(chr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tile $04 is the first CHR tile, after the solid tiles.
+	seg, err := ParseSegment(fullBackground(0x04, 0x55, bgPalettes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := seg.Layers(tiles, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(layers))
+	}
+
+	l := layers[0]
+	if l.Bounds().Dx() != ScreenWidth*8 || l.Bounds().Dy() != ScreenHeight*8 {
+		t.Errorf("unexpected bounds: %v", l.Bounds())
+	}
+
+	// Attribute $55 selects palette 1 everywhere.
+	if l.At(0, 0) != NesColors[0x27] || l.At(10, 3) != NesColors[0x20] {
+		t.Errorf("unexpected colors: %v %v", l.At(0, 0), l.At(10, 3))
+	}
+
+	// Solid tile 3 with palette 0.
+	seg, err = ParseSegment(fullBackground(0x03, 0x00, bgPalettes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err = seg.Layers(tiles, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layers[0].At(100, 100) != NesColors[0x16] {
+		t.Errorf("expected solid color, got %v", layers[0].At(100, 100))
+	}
+
+	// Tiles past the end of the CHR data are left empty.
+	seg, err = ParseSegment(fullBackground(0x05, 0x00, bgPalettes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err = seg.Layers(tiles, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layers[0].At(0, 0) != (color.RGBA{}) {
+		t.Errorf("expected a transparent pixel, got %v", layers[0].At(0, 0))
+	}
+}
+
+func TestSpriteLayers(t *testing.T) {
+	// 49 tiles, tile N is solid colour N%4.
+	chr := []byte{}
+	for i := 0; i < 0x31; i++ {
+		lo, hi := byte(0x00), byte(0x00)
+		if i&1 != 0 {
+			lo = 0xFF
+		}
+		if i&2 != 0 {
+			hi = 0xFF
+		}
+		for j := 0; j < 8; j++ {
+			chr = append(chr, lo)
+		}
+		for j := 0; j < 8; j++ {
+			chr = append(chr, hi)
+		}
+	}
+
+	tiles, err := DecodeChr(chr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg, err := ParseSegment(decodeHex(t, spriteHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := seg.Layers(tiles, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(layers))
+	}
+
+	l := layers[0]
+	if l.Bounds().Dx() != 3*8 || l.Bounds().Dy() != 5*8 {
+		t.Errorf("unexpected bounds: %v", l.Bounds())
+	}
+
+	if l.Location.X != 64 || l.Location.Y != 56 {
+		t.Errorf("unexpected location: %v", l.Location)
+	}
+
+	// Tile $00 is colour 0, which is transparent for sprites.
+	if l.At(0, 0) != (color.RGBA{}) {
+		t.Errorf("expected a transparent pixel, got %v", l.At(0, 0))
+	}
+
+	// Tile $01, palette 2, colour 1.
+	if l.At(8, 0) != NesColors[0x01] {
+		t.Errorf("expected $01, got %v", l.At(8, 0))
+	}
+
+	// Tile $03, palette 2, colour 3.
+	if l.At(0, 8) != NesColors[0x37] {
+		t.Errorf("expected $37, got %v", l.At(0, 8))
+	}
+
+	// Tile $2C, palette 0, colour 0.
+	if layers[2].At(8, 0) != (color.RGBA{}) {
+		t.Errorf("expected a transparent pixel, got %v", layers[2].At(8, 0))
+	}
+
+	// Tile $2D, palette 0, colour 1.
+	if layers[2].At(16, 0) != NesColors[0x01] {
+		t.Errorf("expected $01, got %v", layers[2].At(16, 0))
+	}
+}
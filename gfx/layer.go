@@ -0,0 +1,120 @@
+package gfx
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Layer draws an image from a tile segment.  It implements image.Image.
+//
+// Background layers are a full screen with the image's tiles placed at its
+// location.  Sprite layers are the size of the image and drawn at Location.
+type Layer struct {
+	Tiles      []*Tile // row by row.  nil tiles are transparent.
+	Attributes []byte  // palette index for each tile
+	Palettes   []color.Palette
+
+	Location image.Point // in pixels
+
+	Width  int // in tiles
+	Height int
+	Transparency bool // true for sprites
+	IsSprite bool
+
+	Solid bool
+}
+
+func NewLayer(width, height int, palettes []color.Palette) *Layer {
+	return &Layer{
+		Tiles: make([]*Tile, width*height),
+		Attributes: make([]byte, width*height),
+		Location: image.Pt(0, 0),
+		Width: width,
+		Height: height,
+		Palettes: palettes,
+	}
+}
+
+func (l *Layer) At(x, y int) color.Color {
+	if l.Solid {
+		return color.RGBA{0x00, 0x00, 0x00, 0xFF}
+	}
+
+	if !(image.Point{x, y}.In(l.Bounds())) {
+		return color.RGBA{0x00, 0x00, 0x00, 0x00}
+	}
+
+	row := y / 8
+	col := x / 8
+	tileIdx := (row*l.Width)+col
+
+	if l.Tiles[tileIdx] == nil {
+		return color.RGBA{0x00, 0x00, 0x00, 0x00}
+	}
+
+	colorIdx := l.Tiles[tileIdx].ColorIndexAt(x % 8, y % 8)
+	if l.Transparency && colorIdx == 0 {
+		return color.RGBA{0x00, 0x00, 0x00, 0x00}
+	}
+
+	palIdx := l.Attributes[tileIdx]
+	return l.Palettes[palIdx][colorIdx]
+}
+
+func (l *Layer) Bounds() image.Rectangle {
+	return image.Rect(0, 0, 8*l.Width, 8*l.Height)
+}
+
+func (l *Layer) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+// SetAttributes expands 64 bytes of background attribute data to a palette
+// index for each tile on the screen.  Each byte covers 4x4 tiles, two bits
+// for each 2x2 quarter.  The bottom row of bytes only covers half the
+// height, as the screen is 30 tiles tall.
+func (sc *Layer) SetAttributes(data []byte) error {
+	if len(data) != BgAttributeSize {
+		return fmt.Errorf("Attribute data must be 64 bytes")
+	}
+
+	sc.Attributes = make([]byte, ScreenWidth*ScreenHeight)
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			src := row*8+col
+			start := (row*32)*4 + (col*4)
+
+			raw := data[src]
+
+			br := (raw >> 6) & 0x03
+			bl := (raw >> 4) & 0x03
+			tr := (raw >> 2) & 0x03
+			tl := raw & 0x03
+
+			sc.Attributes[start+0+(32*0)] = tl
+			sc.Attributes[start+1+(32*0)] = tl
+			sc.Attributes[start+0+(32*1)] = tl
+			sc.Attributes[start+1+(32*1)] = tl
+
+			sc.Attributes[start+2+(32*0)] = tr
+			sc.Attributes[start+3+(32*0)] = tr
+			sc.Attributes[start+2+(32*1)] = tr
+			sc.Attributes[start+3+(32*1)] = tr
+
+			if row < 7 {
+				sc.Attributes[start+0+(32*2)] = bl
+				sc.Attributes[start+1+(32*2)] = bl
+				sc.Attributes[start+0+(32*3)] = bl
+				sc.Attributes[start+1+(32*3)] = bl
+
+				sc.Attributes[start+2+(32*2)] = br
+				sc.Attributes[start+3+(32*2)] = br
+				sc.Attributes[start+2+(32*3)] = br
+				sc.Attributes[start+3+(32*3)] = br
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package gfx
+
+import (
+	"fmt"
+)
+
+// Size of one 2bpp tile in CHR data.
+const TileBytes = 16
+
+// Tile is an 8x8 CHR tile.  Each pixel is a colour index from 0 to 3.
+type Tile struct {
+	Pixels [64]uint8 // row by row
+}
+
+// NewTileFromPlanes builds a tile from its two bit planes, eight bytes each,
+// in the same order as they are stored in CHR data.
+func NewTileFromPlanes(lo, hi [8]byte) *Tile {
+	t := &Tile{}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			bit := uint(7-x)
+			t.Pixels[y*8+x] = (lo[y]>>bit)&1 | ((hi[y]>>bit)&1)<<1
+		}
+	}
+	return t
+}
+
+// ColorIndexAt returns the colour index of a pixel in the tile.
+func (t *Tile) ColorIndexAt(x, y int) uint8 {
+	return t.Pixels[y*8+x]
+}
+
+// DecodeChr reads every tile in CHR data.  CHR segments have no header, so
+// the data must be a whole number of tiles.
+func DecodeChr(raw []byte) ([]*Tile, error) {
+	if len(raw) % TileBytes != 0 {
+		return nil, fmt.Errorf("CHR data is %d bytes, which isn't a whole number of tiles", len(raw))
+	}
+
+	tiles := []*Tile{}
+	for i := 0; i < len(raw); i += TileBytes {
+		var lo, hi [8]byte
+		copy(lo[:], raw[i:i+8])
+		copy(hi[:], raw[i+8:i+16])
+		tiles = append(tiles, NewTileFromPlanes(lo, hi))
+	}
+	return tiles, nil
+}
+
+// SolidTiles returns the four tiles that nametable data expects before the
+// CHR tiles, one filled with each colour index.
+func SolidTiles() []*Tile {
+	tiles := []*Tile{}
+	for idx := uint8(0); idx < 4; idx++ {
+		t := &Tile{}
+		for i := range t.Pixels {
+			t.Pixels[i] = idx
+		}
+		tiles = append(tiles, t)
+	}
+	return tiles
+}
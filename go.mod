@@ -6,7 +6,6 @@ require (
 	github.com/alexflint/go-arg v1.6.0
 	github.com/go-audio/audio v1.0.0
 	github.com/go-audio/wav v1.1.0
-	github.com/zorchenhimer/go-retroimg v0.0.0-20251111010417-7299e86df5a9
 )
 
 require (
@@ -0,0 +1,64 @@
+package rom
+
+// DataSegment is a block of data that is loaded into RAM, re-assembled from
+// the bulk data packets between a start and end packet.
+type DataSegment struct {
+	Type    string // "script", "nametable", or "pattern"
+	Bank    int
+	Address int    // CPU address the data is loaded to
+	Data    []byte
+
+	PacketIndex int // index of the start packet in Page.Packets
+}
+
+// DataSegments returns all of the data segments in the page, in order.
+func (page *Page) DataSegments() []*DataSegment {
+	segments := []*DataSegment{}
+	var current *DataSegment
+
+	for i, packet := range page.Packets {
+		switch p := packet.(type) {
+		case *packetWorkRamLoad:
+			current = &DataSegment{
+				Type: "script",
+				Bank: int(p.bankId),
+				Address: int(p.loadAddressHigh) << 8,
+				Data: []byte{},
+				PacketIndex: i,
+			}
+
+		case *packetMarkDataStart:
+			current = &DataSegment{
+				Type: p.dataType(),
+				Bank: int(p.ArgA),
+				Address: int(p.ArgB) << 8,
+				Data: []byte{},
+				PacketIndex: i,
+			}
+
+		case *packetBulkData:
+			if current != nil {
+				current.Data = append(current.Data, p.Data...)
+			}
+
+		case *packetMarkDataEnd:
+			if current != nil {
+				segments = append(segments, current)
+			}
+			current = nil
+		}
+	}
+
+	return segments
+}
+
+// Scripts returns only the script segments of the page.
+func (page *Page) Scripts() []*DataSegment {
+	scripts := []*DataSegment{}
+	for _, seg := range page.DataSegments() {
+		if seg.Type == "script" {
+			scripts = append(scripts, seg)
+		}
+	}
+	return scripts
+}
@@ -0,0 +1,329 @@
+package script
+
+import (
+	"fmt"
+	"slices"
+)
+
+// AddrMode is the addressing mode of a 6502 instruction.
+type AddrMode int
+
+const (
+	ModeImplied AddrMode = iota
+	ModeAccumulator
+	ModeImmediate
+	ModeZeroPage
+	ModeZeroPageX
+	ModeZeroPageY
+	ModeAbsolute
+	ModeAbsoluteX
+	ModeAbsoluteY
+	ModeIndirect
+	ModeIndirectX
+	ModeIndirectY
+	ModeRelative
+)
+
+var addrModeNames = map[AddrMode]string{
+	ModeImplied:     "implied",
+	ModeAccumulator: "accumulator",
+	ModeImmediate:   "immediate",
+	ModeZeroPage:    "zero_page",
+	ModeZeroPageX:   "zero_page_x",
+	ModeZeroPageY:   "zero_page_y",
+	ModeAbsolute:    "absolute",
+	ModeAbsoluteX:   "absolute_x",
+	ModeAbsoluteY:   "absolute_y",
+	ModeIndirect:    "indirect",
+	ModeIndirectX:   "indirect_x",
+	ModeIndirectY:   "indirect_y",
+	ModeRelative:    "relative",
+}
+
+func (m AddrMode) String() string {
+	if name, ok := addrModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("AddrMode(%d)", int(m))
+}
+
+// Size returns the number of operand bytes for the mode.
+func (m AddrMode) Size() int {
+	switch m {
+	case ModeImplied, ModeAccumulator:
+		return 0
+	case ModeAbsolute, ModeAbsoluteX, ModeAbsoluteY, ModeIndirect:
+		return 2
+	}
+	return 1
+}
+
+// NativeOp is an official 6502 instruction.  call_asm runs native code in the
+// script's bank, which is decoded with these instead of the VM instructions.
+type NativeOp struct {
+	Opcode byte
+	Name   string
+	Mode   AddrMode
+}
+
+var NativeOps map[byte]*NativeOp
+var nativeOpsByName map[string]map[AddrMode]*NativeOp
+
+// The modes of the ALU instructions (adc, and, cmp, eor, lda, ora, sbc) in
+// the order they're listed below.
+var aluModes = []AddrMode{
+	ModeImmediate, ModeZeroPage, ModeZeroPageX, ModeAbsolute,
+	ModeAbsoluteX, ModeAbsoluteY, ModeIndirectX, ModeIndirectY,
+}
+
+// The modes of the shifts and rotates (asl, lsr, rol, ror).
+var shiftModes = []AddrMode{
+	ModeAccumulator, ModeZeroPage, ModeZeroPageX, ModeAbsolute, ModeAbsoluteX,
+}
+
+func init() {
+	NativeOps = make(map[byte]*NativeOp)
+	nativeOpsByName = make(map[string]map[AddrMode]*NativeOp)
+
+	add := func(name string, mode AddrMode, opcode byte) {
+		op := &NativeOp{Opcode: opcode, Name: name, Mode: mode}
+		NativeOps[opcode] = op
+		if _, ok := nativeOpsByName[name]; !ok {
+			nativeOpsByName[name] = make(map[AddrMode]*NativeOp)
+		}
+		nativeOpsByName[name][mode] = op
+	}
+
+	addModes := func(name string, modes []AddrMode, opcodes ...byte) {
+		for i, op := range opcodes {
+			add(name, modes[i], op)
+		}
+	}
+
+	addModes("adc", aluModes, 0x69, 0x65, 0x75, 0x6D, 0x7D, 0x79, 0x61, 0x71)
+	addModes("and", aluModes, 0x29, 0x25, 0x35, 0x2D, 0x3D, 0x39, 0x21, 0x31)
+	addModes("cmp", aluModes, 0xC9, 0xC5, 0xD5, 0xCD, 0xDD, 0xD9, 0xC1, 0xD1)
+	addModes("eor", aluModes, 0x49, 0x45, 0x55, 0x4D, 0x5D, 0x59, 0x41, 0x51)
+	addModes("lda", aluModes, 0xA9, 0xA5, 0xB5, 0xAD, 0xBD, 0xB9, 0xA1, 0xB1)
+	addModes("ora", aluModes, 0x09, 0x05, 0x15, 0x0D, 0x1D, 0x19, 0x01, 0x11)
+	addModes("sbc", aluModes, 0xE9, 0xE5, 0xF5, 0xED, 0xFD, 0xF9, 0xE1, 0xF1)
+	addModes("sta", aluModes[1:], 0x85, 0x95, 0x8D, 0x9D, 0x99, 0x81, 0x91)
+
+	addModes("asl", shiftModes, 0x0A, 0x06, 0x16, 0x0E, 0x1E)
+	addModes("lsr", shiftModes, 0x4A, 0x46, 0x56, 0x4E, 0x5E)
+	addModes("rol", shiftModes, 0x2A, 0x26, 0x36, 0x2E, 0x3E)
+	addModes("ror", shiftModes, 0x6A, 0x66, 0x76, 0x6E, 0x7E)
+	addModes("dec", shiftModes[1:], 0xC6, 0xD6, 0xCE, 0xDE)
+	addModes("inc", shiftModes[1:], 0xE6, 0xF6, 0xEE, 0xFE)
+
+	addModes("ldx", []AddrMode{ModeImmediate, ModeZeroPage, ModeZeroPageY, ModeAbsolute, ModeAbsoluteY},
+		0xA2, 0xA6, 0xB6, 0xAE, 0xBE)
+	addModes("ldy", []AddrMode{ModeImmediate, ModeZeroPage, ModeZeroPageX, ModeAbsolute, ModeAbsoluteX},
+		0xA0, 0xA4, 0xB4, 0xAC, 0xBC)
+	addModes("stx", []AddrMode{ModeZeroPage, ModeZeroPageY, ModeAbsolute}, 0x86, 0x96, 0x8E)
+	addModes("sty", []AddrMode{ModeZeroPage, ModeZeroPageX, ModeAbsolute}, 0x84, 0x94, 0x8C)
+	addModes("cpx", []AddrMode{ModeImmediate, ModeZeroPage, ModeAbsolute}, 0xE0, 0xE4, 0xEC)
+	addModes("cpy", []AddrMode{ModeImmediate, ModeZeroPage, ModeAbsolute}, 0xC0, 0xC4, 0xCC)
+	addModes("bit", []AddrMode{ModeZeroPage, ModeAbsolute}, 0x24, 0x2C)
+	addModes("jmp", []AddrMode{ModeAbsolute, ModeIndirect}, 0x4C, 0x6C)
+	add("jsr", ModeAbsolute, 0x20)
+
+	for name, op := range map[string]byte{
+		"bpl": 0x10, "bmi": 0x30, "bvc": 0x50, "bvs": 0x70,
+		"bcc": 0x90, "bcs": 0xB0, "bne": 0xD0, "beq": 0xF0,
+	} {
+		add(name, ModeRelative, op)
+	}
+
+	for name, op := range map[string]byte{
+		"brk": 0x00, "php": 0x08, "clc": 0x18, "plp": 0x28, "sec": 0x38,
+		"rti": 0x40, "pha": 0x48, "cli": 0x58, "rts": 0x60, "pla": 0x68,
+		"sei": 0x78, "dey": 0x88, "txa": 0x8A, "tya": 0x98, "txs": 0x9A,
+		"tay": 0xA8, "tax": 0xAA, "clv": 0xB8, "tsx": 0xBA, "iny": 0xC8,
+		"dex": 0xCA, "cld": 0xD8, "inx": 0xE8, "nop": 0xEA, "sed": 0xF8,
+	} {
+		add(name, ModeImplied, op)
+	}
+}
+
+// EndsFlow returns true if execution never continues to the next
+// instruction.
+func (op NativeOp) EndsFlow() bool {
+	switch op.Opcode {
+	case 0x00, 0x40, 0x60, 0x4C, 0x6C: // brk, rti, rts, jmp, jmp (ind)
+		return true
+	}
+	return false
+}
+
+// IsCall returns true for jsr.
+func (op NativeOp) IsCall() bool {
+	return op.Opcode == 0x20
+}
+
+// IsBranch returns true for instructions with a code target that can be
+// followed: branches, jmp and jsr.  Indirect jumps aren't followed.
+func (op NativeOp) IsBranch() bool {
+	return op.Mode == ModeRelative || op.Opcode == 0x4C || op.Opcode == 0x20
+}
+
+// Format returns the instruction with the given operand text in the usual
+// 6502 syntax, eg "lda ($10),y".
+func (op NativeOp) Format(operand string) string {
+	switch op.Mode {
+	case ModeImplied:
+		return op.Name
+	case ModeAccumulator:
+		return op.Name+" a"
+	case ModeImmediate:
+		return op.Name+" #"+operand
+	case ModeZeroPageX, ModeAbsoluteX:
+		return op.Name+" "+operand+",x"
+	case ModeZeroPageY, ModeAbsoluteY:
+		return op.Name+" "+operand+",y"
+	case ModeIndirect:
+		return op.Name+" ("+operand+")"
+	case ModeIndirectX:
+		return op.Name+" ("+operand+",x)"
+	case ModeIndirectY:
+		return op.Name+" ("+operand+"),y"
+	}
+	return op.Name+" "+operand
+}
+
+// NativeTarget returns the address a native token refers to.  Branch targets
+// are resolved from the relative offset.  Returns false for tokens without
+// an address, ie implied, immediate and indexed indirect.
+func (t Token) NativeTarget() (int, bool) {
+	if t.Native == nil || len(t.Inline) == 0 {
+		return 0, false
+	}
+
+	switch t.Native.Mode {
+	case ModeRelative:
+		return t.Offset+2+int(int8(t.Inline[0].Int())), true
+	case ModeImplied, ModeAccumulator, ModeImmediate, ModeIndirectX, ModeIndirectY:
+		return 0, false
+	}
+	return t.Inline[0].Int(), true
+}
+
+// nativeText returns the native instruction with its operand, using a label
+// for the target if there is one.
+func (t Token) nativeText(labels map[int]*Label) string {
+	if len(t.Inline) == 0 {
+		return t.Native.Format("")
+	}
+
+	if addr, ok := t.NativeTarget(); ok {
+		// Zero page operands are left as numbers so they assemble to the
+		// same size.
+		zeroPage := t.Native.Mode.Size() == 1 && t.Native.Mode != ModeRelative
+		if lbl, ok := labels[addr]; ok && lbl.Name != "" && !zeroPage {
+			return t.Native.Format(lbl.Name)
+		}
+		if zeroPage {
+			return t.Native.Format(fmt.Sprintf("$%02X", addr))
+		}
+		return t.Native.Format(fmt.Sprintf("$%04X", addr))
+	}
+
+	return t.Native.Format(fmt.Sprintf("$%02X", t.Inline[0].Int()))
+}
+
+// nativeToken decodes the 6502 instruction at offset in the script.
+func (p *Parser) nativeToken(offset int) (*Token, error) {
+	raw := p.rawinput[offset]
+	op, ok := NativeOps[raw]
+	if !ok {
+		return nil, fmt.Errorf("invalid 6502 opcode $%02X at $%04X", raw, offset+p.startAddr)
+	}
+
+	size := op.Mode.Size()
+	if offset+size >= len(p.rawinput) {
+		return nil, fmt.Errorf("6502 instruction at $%04X runs past the end of the script", offset+p.startAddr)
+	}
+
+	token := &Token{
+		Offset: offset+p.startAddr,
+		Raw: raw,
+		Inline: []InlineVal{},
+		Native: op,
+	}
+
+	switch size {
+	case 1:
+		token.Inline = append(token.Inline, ByteVal(p.rawinput[offset+1]))
+	case 2:
+		token.Inline = append(token.Inline, WordVal([2]byte{p.rawinput[offset+1], p.rawinput[offset+2]}))
+	}
+
+	return token, nil
+}
+
+// parseNative decodes the 6502 code at each entry point, following branches,
+// jmp and jsr that stay inside the script.  Code run with call_asm is assumed
+// to be in the script's own bank.  Decoding stops at bytes that were already
+// decoded, and invalid opcodes are added to the warnings.
+func (p *Parser) parseNative(entries []int, visited []bool) {
+	inScript := func(a int) bool {
+		return a-p.startAddr >= 2 && a-p.startAddr < len(p.rawinput)
+	}
+
+	for len(entries) > 0 {
+		addr := entries[0]
+		entries = entries[1:]
+
+		for inScript(addr) && !visited[addr-p.startAddr] {
+			offset := addr-p.startAddr
+			token, err := p.nativeToken(offset)
+			if err != nil {
+				p.script.Warnings = append(p.script.Warnings, err.Error())
+				break
+			}
+
+			size := token.Size()
+			if slices.Contains(visited[offset:offset+size], true) {
+				p.script.Warnings = append(p.script.Warnings,
+					fmt.Sprintf("6502 instruction at $%04X overlaps decoded code", addr))
+				break
+			}
+			for i := offset; i < offset+size; i++ {
+				visited[i] = true
+			}
+			p.script.Tokens = append(p.script.Tokens, token)
+
+			p.script.CDL.set(addr, cdlCode | cdlNative | cdlOpCode)
+			for i := 1; i < size; i++ {
+				bit := cdlCode | cdlNative | cdlOperand
+				if size == 3 {
+					bit |= cdlWord
+				}
+				p.script.CDL.set(addr+i, bit)
+			}
+
+			op := token.Native
+			if target, ok := token.NativeTarget(); ok && inScript(target) {
+				switch {
+				case op.IsBranch():
+					entries = append(entries, target)
+					if _, ok := p.script.Labels[target]; !ok {
+						p.script.Labels[target] = AutoLabel(target)
+					}
+					p.script.CDL.set(target, cdlJumpTarget)
+
+				case op.Mode != ModeIndirect:
+					if _, ok := p.script.Labels[target]; !ok {
+						p.script.Labels[target] = AutoLabelVar(target)
+					}
+					p.script.CDL.set(target, cdlData)
+				}
+			}
+
+			if op.EndsFlow() {
+				break
+			}
+			addr += size
+		}
+	}
+}
@@ -0,0 +1,684 @@
+package script
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUndefinedLabel = errors.New("Undefined label")
+	ErrSyntax = errors.New("Syntax error")
+)
+
+// Assembler turns script assembly back into bytecode.  The syntax is the same
+// as the output of Token.String(), so a disassembly can be re-assembled:
+//
+//	; comment
+//	Label:
+//	    push_word SCREEN_GREEN_TITLE
+//	    load_rom_screen
+//	    jump_switch L6010 L6020
+//	    push_data "HELLO"
+//	    .byte $00, 1, 2
+//	    .word Label
+//	    lda ($10),y
+//
+// 6502 mnemonics are assembled as native code for call_asm.  One or two hex
+// digit numbers use zero page addressing where the instruction has it.
+// Address prefixes ("[6002]") and the raw byte column ("B8 05 00 :") are
+// ignored.  Labels that are not defined in the source but follow the
+// automatic label format (L6010, Var_6040, F6010) resolve to their address if
+// it's outside of the script.  Inside the script they must be defined, so
+// typos and references to removed code are caught.
+type Assembler struct {
+	Labels map[string]int // pre-populate to resolve external labels
+
+	// Set with the .stack directive.  -1 if not set.
+	StackAddress int
+
+	// Address range of the script, for automatic label names.  Assemble sets
+	// it to the assembled code if ScriptEnd is zero.
+	ScriptStart int
+	ScriptEnd   int
+
+	lines []*asmLine
+}
+
+type asmLine struct {
+	num     int // line number in the source
+	address int
+	label   string
+	op      string // mnemonic or directive
+	args    []string
+	size    int
+
+	instr  *Instruction
+	native map[AddrMode]*NativeOp // 6502 instruction, by mode
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{
+		Labels: make(map[string]int),
+		StackAddress: -1,
+	}
+}
+
+// AssembleFile assembles a full script file.  See AssembleScript.
+func AssembleFile(filename string, startAddr int) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return AssembleScript(file, startAddr)
+}
+
+// AssembleScript assembles a full script, including the stack address header.
+// The source must contain a .stack directive.
+func AssembleScript(r io.Reader, startAddr int) ([]byte, error) {
+	return NewAssembler().AssembleScript(r, startAddr)
+}
+
+// AssembleScript assembles a full script with the assembler's labels.  See
+// the AssembleScript function.
+func (a *Assembler) AssembleScript(r io.Reader, startAddr int) ([]byte, error) {
+	if a.ScriptEnd == 0 {
+		a.ScriptStart = startAddr
+	}
+
+	raw, err := a.Assemble(r, startAddr+2)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.StackAddress == -1 {
+		return nil, fmt.Errorf("missing .stack directive")
+	}
+
+	return append([]byte{byte(a.StackAddress & 0xFF), byte(a.StackAddress >> 8)}, raw...), nil
+}
+
+// Assemble the source into raw bytecode starting at origin.  Labels defined in
+// the source are added to a.Labels.
+func (a *Assembler) Assemble(r io.Reader, origin int) ([]byte, error) {
+	a.lines = []*asmLine{}
+
+	err := a.readLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// first pass: sizes and label addresses
+	addr := origin
+	for _, ln := range a.lines {
+		if ln.op == ".org" {
+			if len(ln.args) != 1 {
+				return nil, ln.errorf(".org requires one address")
+			}
+			val, err := parseNumber(ln.args[0])
+			if err != nil {
+				return nil, ln.errorf("%w", err)
+			}
+			if val < addr {
+				return nil, ln.errorf(".org $%04X is before current address $%04X", val, addr)
+			}
+			ln.size = val-addr
+		}
+
+		ln.address = addr
+		if ln.label != "" {
+			if _, ok := a.Labels[ln.label]; ok {
+				return nil, ln.errorf("label %q redefined", ln.label)
+			}
+			a.Labels[ln.label] = addr
+		}
+
+		if ln.op != ".org" {
+			ln.size, err = a.lineSize(ln)
+			if err != nil {
+				return nil, ln.errorf("%w", err)
+			}
+		}
+		addr += ln.size
+	}
+
+	if a.ScriptEnd == 0 {
+		if a.ScriptStart == 0 {
+			a.ScriptStart = origin
+		}
+		a.ScriptEnd = addr
+	}
+
+	// second pass: encode
+	out := []byte{}
+	for _, ln := range a.lines {
+		raw, err := a.encode(ln)
+		if err != nil {
+			return nil, ln.errorf("%w", err)
+		}
+
+		if len(raw) != ln.size {
+			return nil, ln.errorf("size missmatch: expected %d got %d", ln.size, len(raw))
+		}
+		out = append(out, raw...)
+	}
+
+	return out, nil
+}
+
+func (ln *asmLine) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %w", ln.num, fmt.Errorf(format, args...))
+}
+
+var (
+	reAddrPrefix = regexp.MustCompile(`^\[[0-9A-Fa-f]+\]\s*`)
+	reLabel      = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*):$`)
+	reNumber     = regexp.MustCompile(`^-?[0-9]+(\s+\$[0-9A-Fa-f]+)?$`)
+)
+
+func (a *Assembler) readLines(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	num := 0
+	label := ""
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		line = reAddrPrefix.ReplaceAllString(line, "")
+
+		// Raw byte column from the disassembler
+		if idx := strings.Index(line, " : "); idx != -1 && !strings.HasPrefix(line, ".") && !strings.Contains(line[:idx], "\"") {
+			line = strings.TrimSpace(line[idx+3:])
+
+			// Data bytes are printed as decimal (and hex for variables)
+			if reNumber.MatchString(line) {
+				line = ".byte "+strings.Fields(line)[0]
+			}
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if m := reLabel.FindStringSubmatch(line); m != nil {
+			if label != "" {
+				// Two labels on the same address.  Keep both.
+				a.lines = append(a.lines, &asmLine{num: num, label: label})
+			}
+			label = m[1]
+			continue
+		}
+
+		op, rest, _ := strings.Cut(line, " ")
+		ln := &asmLine{
+			num: num,
+			label: label,
+			op: op,
+			args: splitArgs(strings.TrimSpace(rest)),
+		}
+		label = ""
+
+		if ln.op == ".stack" {
+			if len(ln.args) != 1 {
+				return ln.errorf(".stack requires one address")
+			}
+			val, err := parseNumber(ln.args[0])
+			if err != nil {
+				return ln.errorf("%w", err)
+			}
+			a.StackAddress = val
+			continue
+		}
+
+		if !strings.HasPrefix(ln.op, ".") {
+			instr, ok := InstructionByName(ln.op)
+			if ops, isNative := nativeOpsByName[strings.ToLower(ln.op)]; !ok && isNative {
+				ln.native = ops
+			} else if !ok {
+				return ln.errorf("%w: unknown instruction %q", ErrSyntax, ln.op)
+			}
+			ln.instr = instr
+		}
+
+		a.lines = append(a.lines, ln)
+	}
+
+	if label != "" {
+		a.lines = append(a.lines, &asmLine{num: num, label: label})
+	}
+
+	return scanner.Err()
+}
+
+// stripComment removes everything after a semicolon that isn't in a string
+// or byte list.
+func stripComment(line string) string {
+	quote := false
+	bracket := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quote {
+				i++
+			}
+		case '"':
+			if !bracket {
+				quote = !quote
+			}
+		case '[':
+			if !quote {
+				bracket = true
+			}
+		case ']':
+			if !quote {
+				bracket = false
+			}
+		case '{':
+			if bracket {
+				// character annotation, eg 0x3B{;}
+				i += 2
+			}
+		case ';':
+			if !quote && !bracket {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// splitArgs splits on whitespace and commas, keeping quoted strings and
+// bracketed byte lists intact.
+func splitArgs(s string) []string {
+	args := []string{}
+	current := ""
+	quote := false
+	bracket := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote:
+			current += s[i:i+1]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				current += s[i:i+1]
+			} else if c == '"' {
+				quote = false
+			}
+
+		case bracket:
+			current += s[i:i+1]
+			if c == '{' && i+2 < len(s) {
+				// character annotation, eg 0x20{ }
+				current += s[i+1:i+3]
+				i += 2
+			} else if c == ']' {
+				bracket = false
+			}
+
+		case c == '"':
+			quote = true
+			current += s[i:i+1]
+
+		case c == '[':
+			bracket = true
+			current += s[i:i+1]
+
+		case c == ' ' || c == '\t' || c == ',':
+			if current != "" {
+				args = append(args, current)
+				current = ""
+			}
+
+		default:
+			current += s[i:i+1]
+		}
+	}
+
+	if current != "" {
+		args = append(args, current)
+	}
+	return args
+}
+
+func parseNumber(s string) (int, error) {
+	var val int64
+	var err error
+
+	switch {
+	case strings.HasPrefix(s, "$"):
+		val, err = strconv.ParseInt(s[1:], 16, 32)
+	case strings.HasPrefix(s, "%"):
+		val, err = strconv.ParseInt(strings.ReplaceAll(s[1:], "_", ""), 2, 32)
+	default:
+		val, err = strconv.ParseInt(s, 0, 32)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid number %q", ErrSyntax, s)
+	}
+	return int(val), nil
+}
+
+var reAutoLabel = regexp.MustCompile(`^(L|Var_|F)([0-9A-F]{4})$`)
+
+// value resolves a number, label, or enum symbol.
+func (a *Assembler) value(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("%w: missing value", ErrSyntax)
+	}
+
+	if c := s[0]; c == '$' || c == '%' || c == '-' || (c >= '0' && c <= '9') {
+		return parseNumber(s)
+	}
+
+	if addr, ok := a.Labels[s]; ok {
+		return addr, nil
+	}
+
+	if val, ok := LookupEnumSymbol(s); ok {
+		return val, nil
+	}
+
+	if m := reAutoLabel.FindStringSubmatch(s); m != nil {
+		val, _ := strconv.ParseInt(m[2], 16, 32)
+		if int(val) < a.ScriptStart || int(val) >= a.ScriptEnd {
+			return int(val), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUndefinedLabel, s)
+}
+
+func (a *Assembler) lineSize(ln *asmLine) (int, error) {
+	switch ln.op {
+	case "":
+		return 0, nil
+	case ".byte":
+		return len(ln.args), nil
+	case ".word":
+		return len(ln.args)*2, nil
+	}
+
+	if ln.native != nil {
+		op, _, err := ln.nativeOp()
+		if err != nil {
+			return 0, err
+		}
+		return 1+op.Mode.Size(), nil
+	}
+
+	if ln.instr == nil {
+		return 0, fmt.Errorf("%w: unknown directive %q", ErrSyntax, ln.op)
+	}
+
+	raw, err := a.encodeInstruction(ln, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
+
+func (a *Assembler) encode(ln *asmLine) ([]byte, error) {
+	switch ln.op {
+	case "":
+		return []byte{}, nil
+
+	case ".org":
+		// pad with zeros
+		return make([]byte, ln.size), nil
+
+	case ".byte":
+		raw := []byte{}
+		for _, arg := range ln.args {
+			val, err := a.value(arg)
+			if err != nil {
+				return nil, err
+			}
+			if val < -128 || val > 0xFF {
+				return nil, fmt.Errorf("byte value out of range: %s", arg)
+			}
+			raw = append(raw, byte(val))
+		}
+		return raw, nil
+
+	case ".word":
+		raw := []byte{}
+		for _, arg := range ln.args {
+			val, err := a.value(arg)
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, byte(val & 0xFF), byte((val >> 8) & 0xFF))
+		}
+		return raw, nil
+	}
+
+	if ln.native != nil {
+		return a.encodeNative(ln)
+	}
+	return a.encodeInstruction(ln, false)
+}
+
+// nativeOp picks the 6502 instruction for the line from the operand syntax.
+// Returns the instruction and the operand's value.
+func (ln *asmLine) nativeOp() (*NativeOp, string, error) {
+	// splitArgs drops the commas
+	operand := strings.Join(ln.args, ",")
+	lower := strings.ToLower(operand)
+	mode := ModeAbsolute
+	value := operand
+
+	switch {
+	case operand == "":
+		mode = ModeImplied
+		if _, ok := ln.native[mode]; !ok {
+			mode = ModeAccumulator
+		}
+	case lower == "a":
+		mode = ModeAccumulator
+		value = ""
+	case strings.HasPrefix(operand, "#"):
+		mode = ModeImmediate
+		value = operand[1:]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(lower, ",x)"):
+		mode = ModeIndirectX
+		value = operand[1:len(operand)-3]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(lower, "),y"):
+		mode = ModeIndirectY
+		value = operand[1:len(operand)-3]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")"):
+		mode = ModeIndirect
+		value = operand[1:len(operand)-1]
+	case strings.HasSuffix(lower, ",x"):
+		mode = ModeAbsoluteX
+		value = operand[:len(operand)-2]
+	case strings.HasSuffix(lower, ",y"):
+		mode = ModeAbsoluteY
+		value = operand[:len(operand)-2]
+	}
+
+	if _, ok := ln.native[ModeRelative]; ok && mode == ModeAbsolute {
+		mode = ModeRelative
+	}
+
+	zeroPage := map[AddrMode]AddrMode{
+		ModeAbsolute: ModeZeroPage,
+		ModeAbsoluteX: ModeZeroPageX,
+		ModeAbsoluteY: ModeZeroPageY,
+	}
+	if zp, ok := zeroPage[mode]; ok && isZeroPageValue(value) {
+		if _, ok := ln.native[zp]; ok {
+			mode = zp
+		}
+	}
+
+	op, ok := ln.native[mode]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s doesn't have %s addressing", ErrSyntax, ln.op, mode)
+	}
+	return op, value, nil
+}
+
+var reZeroPage = regexp.MustCompile(`^\$[0-9A-Fa-f]{1,2}$`)
+
+func isZeroPageValue(s string) bool {
+	if reZeroPage.MatchString(s) {
+		return true
+	}
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return false
+	}
+	val, err := parseNumber(s)
+	return err == nil && val < 0x100
+}
+
+func (a *Assembler) encodeNative(ln *asmLine) ([]byte, error) {
+	op, value, err := ln.nativeOp()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := []byte{op.Opcode}
+	if op.Mode.Size() == 0 {
+		return raw, nil
+	}
+
+	val, err := a.value(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case op.Mode == ModeRelative:
+		rel := val-(ln.address+2)
+		if rel < -128 || rel > 127 {
+			return nil, fmt.Errorf("branch target out of range: %s", value)
+		}
+		raw = append(raw, byte(rel))
+
+	case op.Mode.Size() == 1:
+		if val < -128 || val > 0xFF {
+			return nil, fmt.Errorf("byte value out of range: %s", value)
+		}
+		raw = append(raw, byte(val))
+
+	default:
+		raw = append(raw, byte(val & 0xFF), byte((val >> 8) & 0xFF))
+	}
+	return raw, nil
+}
+
+// encodeInstruction encodes the instruction on the line.  When sizeOnly is
+// true, labels are not resolved.
+func (a *Assembler) encodeInstruction(ln *asmLine, sizeOnly bool) ([]byte, error) {
+	raw := []byte{ln.instr.Opcode}
+	args := ln.args
+
+	value := func(s string) (int, error) {
+		if sizeOnly {
+			return 0, nil
+		}
+		return a.value(s)
+	}
+
+	for _, ot := range ln.instr.Operands {
+		switch ot {
+		case OperandString:
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%w: %s requires one string", ErrSyntax, ln.op)
+			}
+
+			data, err := parseStringArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, data...)
+			raw = append(raw, 0x00)
+			args = args[1:]
+
+		case OperandCodeTable:
+			// The disassembler prints the count first.
+			if len(args) > 1 {
+				if count, err := parseNumber(args[0]); err == nil && count == len(args)-1 {
+					args = args[1:]
+				}
+			}
+
+			if len(args) > 0xFF {
+				return nil, fmt.Errorf("too many table entries: %d", len(args))
+			}
+
+			raw = append(raw, byte(len(args)))
+			for _, arg := range args {
+				val, err := value(arg)
+				if err != nil {
+					return nil, err
+				}
+				raw = append(raw, byte(val & 0xFF), byte((val >> 8) & 0xFF))
+			}
+			args = nil
+
+		default:
+			if len(args) == 0 {
+				return nil, fmt.Errorf("%w: %s missing %s operand", ErrSyntax, ln.op, ot)
+			}
+
+			val, err := value(args[0])
+			if err != nil {
+				return nil, err
+			}
+			args = args[1:]
+
+			if ot.Size() == 1 {
+				raw = append(raw, byte(val))
+			} else {
+				raw = append(raw, byte(val & 0xFF), byte((val >> 8) & 0xFF))
+			}
+		}
+	}
+
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%w: too many operands for %s", ErrSyntax, ln.op)
+	}
+
+	return raw, nil
+}
+
+var reByteList = regexp.MustCompile(`0x([0-9A-Fa-f]{2})(\{.\})?`)
+
+// parseStringArg parses either a quoted string or a bracketed list of bytes
+// as printed by the disassembler: [0x8A 0x41{A}].  Quoted strings are encoded
+// with CharTable.
+func parseStringArg(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "\"") {
+		if len(s) < 2 || !strings.HasSuffix(s, "\"") {
+			return nil, fmt.Errorf("%w: invalid string %s", ErrSyntax, s)
+		}
+
+		raw, err := CharTable.Bytes(s[1:len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrSyntax, err)
+		}
+		return raw, nil
+	}
+
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		raw := []byte{}
+		for _, m := range reByteList.FindAllStringSubmatch(s, -1) {
+			val, _ := strconv.ParseUint(m[1], 16, 8)
+			raw = append(raw, byte(val))
+		}
+		return raw, nil
+	}
+
+	return nil, fmt.Errorf("%w: expected string or byte list: %s", ErrSyntax, s)
+}
@@ -0,0 +1,108 @@
+package script
+
+import (
+	"slices"
+)
+
+// BasicBlock is a run of instructions that is only entered at the top and
+// only left at the bottom.
+type BasicBlock struct {
+	Start int // address of the first instruction
+	End   int // address of the last byte of the last instruction
+
+	Tokens     []*Token
+	Successors []int // addresses of the blocks that can run next
+}
+
+// Last returns the final instruction in the block.
+func (bb *BasicBlock) Last() *Token {
+	return bb.Tokens[len(bb.Tokens)-1]
+}
+
+// BasicBlocks splits the script's instructions into basic blocks, sorted by
+// address.  Blocks start at labels, branch targets and after anything that
+// branches.  Calls don't end a block.  Data tokens are skipped.
+func (s *Script) BasicBlocks() []*BasicBlock {
+	tokens := []*Token{}
+	for _, t := range s.Tokens {
+		if !t.IsData && t.Instruction != nil {
+			tokens = append(tokens, t)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	leaders := make(map[int]bool)
+	for addr := range s.Labels {
+		leaders[addr] = true
+	}
+	for _, t := range tokens {
+		for _, target := range codeTargets(t) {
+			leaders[target] = true
+		}
+	}
+
+	blocks := []*BasicBlock{}
+	var current *BasicBlock
+	for _, t := range tokens {
+		if current != nil && (leaders[t.Offset] || t.Offset != current.End+1) {
+			current = nil
+		}
+
+		if current == nil {
+			current = &BasicBlock{Start: t.Offset, Tokens: []*Token{}, Successors: []int{}}
+			blocks = append(blocks, current)
+		}
+
+		current.Tokens = append(current.Tokens, t)
+		current.End = t.Offset+t.Size()-1
+
+		if endsFlow(t.Raw) || len(branchTargets(t)) > 0 {
+			current = nil
+		}
+	}
+
+	starts := make(map[int]bool)
+	for _, bb := range blocks {
+		starts[bb.Start] = true
+	}
+
+	for _, bb := range blocks {
+		last := bb.Last()
+		for _, target := range branchTargets(last) {
+			if !slices.Contains(bb.Successors, target) {
+				bb.Successors = append(bb.Successors, target)
+			}
+		}
+
+		next := bb.End+1
+		if !endsFlow(last.Raw) && starts[next] && !slices.Contains(bb.Successors, next) {
+			bb.Successors = append(bb.Successors, next)
+		}
+	}
+
+	return blocks
+}
+
+// branchTargets returns the code addresses a jump or jump table can go to.
+// Calls return to the next instruction so their targets aren't included.
+func branchTargets(t *Token) []int {
+	switch t.Raw {
+	case 0x85, 0xEE: // call_abs, call_switch
+		return nil
+	}
+	return codeTargets(t)
+}
+
+// codeTargets returns every code address operand of an instruction.
+func codeTargets(t *Token) []int {
+	targets := []int{}
+	types := t.InlineTypes()
+	for i, v := range t.Inline {
+		if types[i] == OperandCodeAddr {
+			targets = append(targets, v.Int())
+		}
+	}
+	return targets
+}
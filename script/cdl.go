@@ -7,17 +7,32 @@ import (
 	"strconv"
 	"fmt"
 	"slices"
-	"bytes"
 )
 
+// CodeDataLog records what is known about each byte of a script in one work
+// RAM bank.  Flags are kept in a bitmap covering $6000-$7FFF and are written
+// to JSON as lists of address ranges, one list per flag.  Files that only have
+// Code, Data and EntryPoints are still valid.
 type CodeDataLog struct {
+	// Work RAM bank of the script.  nil if it isn't known, which matches any
+	// bank.
+	Bank *int `json:",omitempty"`
+
 	Code []CdlRange
 	Data []CdlRange
 
+	OpCodes       []CdlRange `json:",omitempty"`
+	Operands      []CdlRange `json:",omitempty"`
+	Strings       []CdlRange `json:",omitempty"`
+	Words         []CdlRange `json:",omitempty"`
+	PointerTables []CdlRange `json:",omitempty"`
+	JumpTargets   []CdlRange `json:",omitempty"`
+	Native        []CdlRange `json:",omitempty"`
+
 	EntryPoints []string
 
 	entries []int
-	cache map[int]cdlBit
+	bitmap []cdlBit
 }
 
 type CdlRange struct {
@@ -26,17 +41,29 @@ type CdlRange struct {
 	End   string
 }
 
-type cdlBit byte
+// Addresses covered by the bitmap.  Anything outside of work RAM is ignored.
+const (
+	cdlStart = 0x6000
+	cdlSize  = 0x2000
+)
+
+type cdlBit uint16
 
 var (
-	cdlUnknown cdlBit = 0x00
-	cdlCode    cdlBit = 0x01
-	cdlData    cdlBit = 0x02
-	//cdlOpCode  cdlBit = 0x04
+	cdlUnknown      cdlBit = 0x00
+	cdlCode         cdlBit = 0x01
+	cdlData         cdlBit = 0x02
+	cdlOpCode       cdlBit = 0x04 // first byte of an instruction
+	cdlOperand      cdlBit = 0x08 // inline operand of an instruction
+	cdlString       cdlBit = 0x10 // inline string of push_data
+	cdlWord         cdlBit = 0x20 // part of a 16-bit value
+	cdlPointerTable cdlBit = 0x40 // count or address in a jump/call switch table
+	cdlJumpTarget   cdlBit = 0x80 // target of a jump, call or switch
+	cdlNative       cdlBit = 0x100 // 6502 code run with call_asm
 )
 
 func (c cdlBit) String() string {
-	switch c {
+	switch c & (cdlCode | cdlData) {
 	case cdlUnknown:
 		return "UNKN"
 	case cdlCode:
@@ -48,10 +75,48 @@ func (c cdlBit) String() string {
 	}
 }
 
+var cdlFlagNames = []struct{ bit cdlBit; name string }{
+	{cdlCode, "code"},
+	{cdlData, "data"},
+	{cdlOpCode, "opcode"},
+	{cdlOperand, "operand"},
+	{cdlString, "string"},
+	{cdlWord, "word"},
+	{cdlPointerTable, "pointer_table"},
+	{cdlJumpTarget, "jump_target"},
+	{cdlNative, "native"},
+}
+
+// flags returns the names of the flags that are set.
+func (c cdlBit) flags() []string {
+	names := []string{}
+	for _, f := range cdlFlagNames {
+		if c & f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// The flags that are written to JSON, and which range list they go in.
+func (cdl *CodeDataLog) rangeLists() []struct{ bit cdlBit; list *[]CdlRange } {
+	return []struct{ bit cdlBit; list *[]CdlRange }{
+		{cdlCode, &cdl.Code},
+		{cdlData, &cdl.Data},
+		{cdlOpCode, &cdl.OpCodes},
+		{cdlOperand, &cdl.Operands},
+		{cdlString, &cdl.Strings},
+		{cdlWord, &cdl.Words},
+		{cdlPointerTable, &cdl.PointerTables},
+		{cdlJumpTarget, &cdl.JumpTargets},
+		{cdlNative, &cdl.Native},
+	}
+}
+
 func NewCDL() *CodeDataLog {
 	return &CodeDataLog{
 		entries: []int{},
-		cache: make(map[int]cdlBit),
+		bitmap: make([]cdlBit, cdlSize),
 	}
 }
 
@@ -74,6 +139,16 @@ func (cdl *CodeDataLog) getEntries() []int {
 	return cdl.entries
 }
 
+// AddEntry adds an entry point for SmartParse.  Returns false if the entry
+// point already exists.
+func (cdl *CodeDataLog) AddEntry(addr int) bool {
+	if slices.Contains(cdl.entries, addr) {
+		return false
+	}
+	cdl.entries = append(cdl.entries, addr)
+	return true
+}
+
 func getRanges(list []int) []CdlRange {
 	//fmt.Printf("getRanges(%v)\n", list)
 	data := []CdlRange{}
@@ -114,38 +189,21 @@ func getRanges(list []int) []CdlRange {
 
 func (cdl *CodeDataLog) WriteTo(w io.Writer) (int64, error) {
 	clean := &CodeDataLog{
+		Bank: cdl.Bank,
 		Code: []CdlRange{},
 		Data: []CdlRange{},
 	}
 
-	keys := []int{}
-	for k, _ := range cdl.cache {
-		keys = append(keys, k)
-	}
-
-	slices.Sort(keys)
-
-	code := []int{}
-	data := []int{}
-
-	for _, k := range keys {
-		if k < 0x6000 {
-			continue
-		}
-
-		b := cdl.cache[k]
-		if b & cdlCode == cdlCode {
-			code = append(code, k)
-		}
-
-		if b & cdlData == cdlData {
-			data = append(data, k)
+	for _, rl := range clean.rangeLists() {
+		addrs := []int{}
+		for i, b := range cdl.bitmap {
+			if b & rl.bit == rl.bit {
+				addrs = append(addrs, i+cdlStart)
+			}
 		}
+		*rl.list = getRanges(addrs)
 	}
 
-	clean.Code = getRanges(code)
-	clean.Data = getRanges(data)
-
 	for _, ent := range cdl.entries {
 		clean.EntryPoints = append(clean.EntryPoints, fmt.Sprintf("0x%X", ent))
 	}
@@ -159,78 +217,190 @@ func (cdl *CodeDataLog) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (cdl *CodeDataLog) set(addr int, bit cdlBit) {
+	if addr < cdlStart || addr >= cdlStart+cdlSize {
+		return
+	}
+	cdl.bitmap[addr-cdlStart] |= bit
+}
+
+func (cdl *CodeDataLog) get(addr int) cdlBit {
+	if addr < cdlStart || addr >= cdlStart+cdlSize {
+		return cdlUnknown
+	}
+	return cdl.bitmap[addr-cdlStart]
+}
+
 func (cdl *CodeDataLog) setData(addr int) {
-	cdl.cache[addr] |= cdlData
+	cdl.set(addr, cdlData)
 }
 
 func (cdl *CodeDataLog) setCode(addr int) {
-	cdl.cache[addr] |= cdlCode
+	cdl.set(addr, cdlCode)
 }
 
-func (cdl *CodeDataLog) doCache(size int) error {
-	cdl.cache = make(map[int]cdlBit)
-	for i := 0x6000; i < size+0x6000; i++ {
-		cdl.cache[i] = cdlUnknown
+// loadRanges fills the bitmap and entry points from the JSON fields.
+func (cdl *CodeDataLog) loadRanges() error {
+	cdl.bitmap = make([]cdlBit, cdlSize)
+
+	for _, rl := range cdl.rangeLists() {
+		for _, rng := range *rl.list {
+			start, err := strconv.ParseInt(rng.Start, 0, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid start: %q", rng.Start)
+			}
+
+			end, err := strconv.ParseInt(rng.End, 0, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid end: %q", rng.End)
+			}
+
+			for i := int(start); i <= int(end); i++ {
+				cdl.set(i, rl.bit)
+			}
+		}
 	}
 
-	for _, rng := range cdl.Code {
-		start, err := strconv.ParseInt(rng.Start, 0, 32)
+	cdl.entries = []int{}
+	for _, ent := range cdl.EntryPoints {
+		addr, err := strconv.ParseInt(ent, 0, 32)
 		if err != nil {
-			return fmt.Errorf("Invalid start: %q", rng.Start)
+			return fmt.Errorf("Invalid entry point: %q", ent)
 		}
 
-		end, err := strconv.ParseInt(rng.End, 0, 32)
-		if err != nil {
-			return fmt.Errorf("Invalid end: %q", rng.End)
-		}
+		cdl.entries = append(cdl.entries, int(addr))
+	}
 
-		for i := int(start); i <= int(end); i++ {
-			cdl.cache[i] |= cdlCode
-		}
+	return nil
+}
+
+// SetBank records the work RAM bank of the script.
+func (cdl *CodeDataLog) SetBank(bank int) {
+	cdl.Bank = &bank
+}
+
+// SameBank returns true if both logs are for the same bank, or if either
+// bank isn't known.
+func (cdl *CodeDataLog) SameBank(other *CodeDataLog) bool {
+	return cdl.Bank == nil || other.Bank == nil || *cdl.Bank == *other.Bank
+}
+
+func (cdl *CodeDataLog) bankString() string {
+	if cdl.Bank == nil {
+		return "unknown"
 	}
+	return fmt.Sprintf("%d", *cdl.Bank)
+}
 
-	for _, rng := range cdl.Data {
-		start, err := strconv.ParseInt(rng.Start, 0, 32)
-		if err != nil {
-			return fmt.Errorf("Invalid start: %q", rng.Start)
+// Merge adds all of the flags and entry points from other.  Both logs must be
+// for the same bank, unless one of the banks isn't known.  The bank is taken
+// from other if this log doesn't have one.
+func (cdl *CodeDataLog) Merge(other *CodeDataLog) error {
+	if !cdl.SameBank(other) {
+		return fmt.Errorf("cannot merge CDL for bank %s into bank %s", other.bankString(), cdl.bankString())
+	}
+
+	if cdl.Bank == nil && other.Bank != nil {
+		cdl.SetBank(*other.Bank)
+	}
+
+	for i, b := range other.bitmap {
+		cdl.bitmap[i] |= b
+	}
+
+	for _, ent := range other.entries {
+		cdl.AddEntry(ent)
+	}
+	return nil
+}
+
+// Diff returns a new log with only the flags and entry points in other that
+// are not in this log.  Useful for finding what a new trace or analysis
+// added.
+func (cdl *CodeDataLog) Diff(other *CodeDataLog) *CodeDataLog {
+	diff := NewCDL()
+	if other.Bank != nil {
+		diff.SetBank(*other.Bank)
+	}
+
+	for i, b := range other.bitmap {
+		diff.bitmap[i] = b &^ cdl.bitmap[i]
+	}
+
+	for _, ent := range other.entries {
+		if !slices.Contains(cdl.entries, ent) {
+			diff.entries = append(diff.entries, ent)
 		}
+	}
+	return diff
+}
 
-		end, err := strconv.ParseInt(rng.End, 0, 32)
-		if err != nil {
-			return fmt.Errorf("Invalid end: %q", rng.End)
+// relocate moves the flags and entry points for start through end-1 by delta.
+func (cdl *CodeDataLog) relocate(start, end, delta int) {
+	old := cdl.bitmap
+	cdl.bitmap = make([]cdlBit, cdlSize)
+
+	for i, b := range old {
+		addr := i+cdlStart
+		if addr < start || addr >= end {
+			cdl.set(addr, b)
 		}
+	}
 
-		for i := int(start); i <= int(end); i++ {
-			cdl.cache[i] |= cdlData
+	for i, b := range old {
+		addr := i+cdlStart
+		if addr >= start && addr < end {
+			cdl.set(addr+delta, b)
 		}
 	}
 
-	cdl.entries = []int{}
-	for _, ent := range cdl.EntryPoints {
-		addr, err := strconv.ParseInt(ent, 0, 32)
-		if err != nil {
-			return fmt.Errorf("Invalid entry point: %q", ent)
+	for i, ent := range cdl.entries {
+		if ent >= start && ent < end {
+			cdl.entries[i] = ent+delta
 		}
+	}
+}
 
-		cdl.entries = append(cdl.entries, int(addr))
+// patch drops the flags for addr through end-1 and moves the flags and entry
+// points from end up to scriptEnd by delta.  Flags at addr are kept.
+func (cdl *CodeDataLog) patch(addr, end, scriptEnd, delta int) {
+	old := cdl.bitmap
+	cdl.bitmap = make([]cdlBit, cdlSize)
+
+	for i, b := range old {
+		a := i+cdlStart
+		switch {
+		case a < addr || a >= scriptEnd:
+			cdl.set(a, b)
+		case a >= end:
+			cdl.set(a+delta, b)
+		}
 	}
 
-	return nil
+	entries := []int{}
+	for _, ent := range cdl.entries {
+		switch {
+		case ent <= addr || ent >= scriptEnd:
+			entries = append(entries, ent)
+		case ent >= end:
+			entries = append(entries, ent+delta)
+		}
+	}
+	cdl.entries = entries
 }
 
 func CdlFromJson(r io.Reader) (*CodeDataLog, error) {
-	raw, err := io.ReadAll(r)
-	buf := bytes.NewReader(raw)
-
 	cdl := NewCDL()
-	dec := json.NewDecoder(buf)
-	err = dec.Decode(cdl)
+	dec := json.NewDecoder(r)
+	err := dec.Decode(cdl)
 	if err != nil {
 		return nil, err
 	}
 
-	//cdl.Data = []CdlRange{}
-	cdl.doCache(len(raw))
+	err = cdl.loadRanges()
+	if err != nil {
+		return nil, err
+	}
 
 	return cdl, nil
 }
@@ -245,19 +415,23 @@ func CdlFromJsonFile(filename string) (*CodeDataLog, error) {
 }
 
 func (cdl *CodeDataLog) IsData(addr int) bool {
-	val, ok := cdl.cache[addr]
-	if !ok {
-		return false
-	}
-
-	return val & cdlData == cdlData
+	return cdl.get(addr) & cdlData == cdlData
 }
 
 func (cdl *CodeDataLog) IsCode(addr int) bool {
-	val, ok := cdl.cache[addr]
-	if !ok {
-		return false
-	}
+	return cdl.get(addr) & cdlCode == cdlCode
+}
+
+// IsOpCode returns true if an instruction starts at addr.
+func (cdl *CodeDataLog) IsOpCode(addr int) bool {
+	return cdl.get(addr) & cdlOpCode == cdlOpCode
+}
+
+func (cdl *CodeDataLog) IsJumpTarget(addr int) bool {
+	return cdl.get(addr) & cdlJumpTarget == cdlJumpTarget
+}
 
-	return val & cdlCode == cdlCode
+// IsNative returns true if addr is 6502 code rather than script code.
+func (cdl *CodeDataLog) IsNative(addr int) bool {
+	return cdl.get(addr) & cdlNative == cdlNative
 }
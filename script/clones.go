@@ -0,0 +1,141 @@
+package script
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint identifies a function by its instructions, so the same code
+// can be found in other scripts.  Addresses inside the function are made
+// relative to its start and addresses outside of it are left out, so copies
+// loaded at different addresses or calling different code still match.
+type Fingerprint struct {
+	Hash    string
+	Address int // entry point of the function
+	Size    int // number of instructions
+
+	tokens []*Token // in address order
+}
+
+// Fingerprints returns a fingerprint for each function in the script with at
+// least minSize instructions.  Functions are split the same way as the
+// decompiler splits them, so the script should come from SmartParse.
+func (s *Script) Fingerprints(minSize int) []*Fingerprint {
+	d := &decompiler{script: s}
+	list := []*Fingerprint{}
+
+	for _, f := range d.functions() {
+		fp := &Fingerprint{Address: f.address, tokens: []*Token{}}
+		for _, bb := range f.blocks {
+			fp.tokens = append(fp.tokens, bb.Tokens...)
+		}
+		fp.Size = len(fp.tokens)
+		if fp.Size < minSize {
+			continue
+		}
+
+		inside := make(map[int]bool)
+		for _, t := range fp.tokens {
+			inside[t.Offset] = true
+		}
+
+		sb := &strings.Builder{}
+		for _, t := range fp.tokens {
+			fmt.Fprintf(sb, "%d:%02X", t.Offset-fp.Address, t.Raw)
+
+			types := t.InlineTypes()
+			for i, val := range t.Inline {
+				switch {
+				case types[i].IsAddress() && inside[val.Int()]:
+					fmt.Fprintf(sb, " r%d", val.Int()-fp.Address)
+				case types[i].IsAddress():
+					sb.WriteString(" x")
+				default:
+					fmt.Fprintf(sb, " %s", val.HexString())
+				}
+			}
+			sb.WriteString("\n")
+		}
+
+		fp.Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(sb.String())))[:16]
+		list = append(list, fp)
+	}
+
+	return list
+}
+
+// CopyCloneLabels copies labels and comments from a function in another
+// script that has the same fingerprint.  Labels on the instructions and on
+// the addresses they use inside the function are copied.  Addresses outside
+// of the function aren't part of the fingerprint so their labels are left
+// alone.  Auto labels aren't copied, and named labels in this script are
+// never replaced.  Returns the number of labels copied.
+func (s *Script) CopyCloneLabels(fp *Fingerprint, from *Script, fromFp *Fingerprint) int {
+	if fp.Hash != fromFp.Hash || len(fp.tokens) != len(fromFp.tokens) {
+		return 0
+	}
+
+	names := make(map[string]bool)
+	for _, lbl := range s.Labels {
+		names[lbl.Name] = true
+	}
+
+	inside := make(map[int]bool)
+	for _, t := range fp.tokens {
+		inside[t.Offset] = true
+	}
+
+	count := 0
+	copyLabel := func(src, dst int) {
+		lbl, ok := from.Labels[src]
+		if !ok || lbl.IsAuto() {
+			return
+		}
+
+		if old, ok := s.Labels[dst]; ok && !old.IsAuto() {
+			return
+		}
+
+		if lbl.Name != "" && names[lbl.Name] {
+			return
+		}
+
+		s.Labels[dst] = &Label{
+			Address:  dst,
+			Name:     lbl.Name,
+			Comment:  lbl.Comment,
+			FarLabel: lbl.FarLabel,
+		}
+		names[lbl.Name] = true
+		count++
+	}
+
+	for i, t := range fp.tokens {
+		src := fromFp.tokens[i]
+		copyLabel(src.Offset, t.Offset)
+
+		types := t.InlineTypes()
+		for j, val := range t.Inline {
+			if types[j].IsAddress() && inside[val.Int()] && j < len(src.Inline) {
+				copyLabel(src.Inline[j].Int(), val.Int())
+			}
+		}
+	}
+
+	return count
+}
+
+// IsAuto returns true for labels made by the parser that don't have a
+// comment.
+func (l Label) IsAuto() bool {
+	if l.Comment != "" {
+		return false
+	}
+
+	switch l.Name {
+	case "", AutoLabel(l.Address).Name, AutoLabelVar(l.Address).Name, AutoLabelFar(l.Address).Name:
+		return true
+	}
+	return false
+}
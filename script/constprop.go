@@ -0,0 +1,159 @@
+package script
+
+import (
+	"slices"
+	"strings"
+)
+
+// pushDataIndirectSize is the number of bytes push_data_indirect reads.
+const pushDataIndirectSize = 32
+
+// markTable flags the data read by instructions that take a table address
+// instead of a variable.  Only bytes inside the script are flagged.
+func (p *Parser) markTable(token *Token, addr int) bool {
+	inScript := func(a int) bool {
+		return a-p.startAddr >= 2 && a-p.startAddr < len(p.rawinput)
+	}
+
+	switch token.Raw {
+	case 0xBA: // push_data_indirect
+		for a := addr; a < addr+pushDataIndirectSize && inScript(a); a++ {
+			p.script.CDL.set(a, cdlData)
+		}
+		return true
+
+	case 0xBC: // push_string_from_table
+		for a := addr; inScript(a); a++ {
+			p.script.CDL.set(a, cdlData|cdlString)
+			if p.rawinput[a-p.startAddr] == 0x00 {
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// constVal is a value on the simulated stack.
+type constVal struct {
+	value int
+	known bool
+	push  *Token // instruction that pushed the value
+}
+
+// propagateConstants follows the values pushed by push_word and push_var
+// through straight-line code to find the targets of jump_arg_a.  A push_var
+// is only a constant if nothing in the script writes to either byte of the
+// variable.
+// Targets are added to the CDL as entry points and the push_word gets the
+// target's label in Label.  Returns true if new entry points were added.
+func (s *Script) propagateConstants() bool {
+	tokens := slices.Clone(s.Tokens)
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	tokenMap := make(map[int]*Token)
+	for _, t := range tokens {
+		tokenMap[t.Offset] = t
+	}
+
+	start := s.StartAddress+2
+	end := s.StartAddress+s.origSize
+
+	// The value is the little-endian word at addr.  Both bytes must be
+	// data in the script that nothing writes to.
+	constVar := func(addr int) (int, bool) {
+		val := 0
+		for i := 0; i < 2; i++ {
+			a := addr+i
+			if a < start || a >= end {
+				return 0, false
+			}
+			for _, x := range s.Xrefs[a] {
+				if x.Type == XrefWrite {
+					return 0, false
+				}
+			}
+			t, ok := tokenMap[a]
+			if !ok || !t.IsData {
+				return 0, false
+			}
+			val |= int(t.Raw) << (8*i)
+		}
+		return val, true
+	}
+
+	stack := []constVal{}
+	pop := func() constVal {
+		if len(stack) == 0 {
+			return constVal{}
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+
+	added := false
+	next := -1
+	for _, t := range tokens {
+		if t.IsData || t.Instruction == nil {
+			stack = stack[:0]
+			next = -1
+			continue
+		}
+
+		// Anything that can be jumped to may have a different stack.
+		if _, ok := s.Labels[t.Offset]; ok || t.Offset != next {
+			stack = stack[:0]
+		}
+		next = t.Offset+t.Size()
+
+		switch t.Raw {
+		case 0xB8: // push_word
+			stack = append(stack, constVal{value: t.Inline[0].Int(), known: true, push: t})
+			continue
+
+		case 0xB7: // push_var
+			val, ok := constVar(t.Inline[0].Int())
+			stack = append(stack, constVal{value: val, known: ok})
+			continue
+
+		case 0xFB: // jump_arg_a
+			v := pop()
+			if !v.known || v.value < start || v.value >= end {
+				continue
+			}
+
+			s.CDL.set(v.value, cdlJumpTarget)
+			if s.CDL.AddEntry(v.value) {
+				added = true
+			}
+			if v.push == nil {
+				continue
+			}
+			v.push.codePush = true
+			if lbl, ok := s.Labels[v.value]; ok {
+				v.push.Label = lbl.Name
+			}
+			continue
+
+		case 0x85, 0xEE: // call_abs, call_switch
+			// The called code can do anything to the stack.
+			stack = stack[:0]
+			continue
+		}
+
+		for i := 0; i < t.Instruction.ArgCount; i++ {
+			pop()
+		}
+		for i := 0; i < t.Instruction.RetCount; i++ {
+			stack = append(stack, constVal{})
+		}
+		if strings.HasPrefix(t.Instruction.Name, "push_") {
+			stack = append(stack, constVal{})
+		}
+	}
+
+	return added
+}
@@ -0,0 +1,555 @@
+package script
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Data directive types
+const (
+	DataString       = "string"   // text read by push_string_from_table and friends
+	DataWordTable    = "words"    // table of 16-bit values
+	DataPointerTable = "pointers" // table of code addresses
+)
+
+// Number of previous versions kept in a database for undo.
+const dbHistory = 50
+
+// Database is the analysis of one script, or of every script in a tape: the
+// labels, comments, CDL, data directives, enum annotations and entry points
+// added while working on it.  Everything is kept in one file so an
+// annotation session doesn't get out of sync.  Scripts are keyed by name.
+//
+// Every saved change keeps a copy of the previous version, so it can be
+// undone.
+type Database struct {
+	Scripts map[string]*ScriptDb
+	History []*DbVersion
+
+	saved []byte // scripts as of the last load or save
+}
+
+// ScriptDb is the analysis of one script.
+type ScriptDb struct {
+	Labels      map[int]*Label
+	Comments    map[int]string
+	CDL         *CodeDataLog
+	Directives  map[int]*DataDirective
+	Enums       map[int]string // push_word address to enum name
+	EntryPoints []int          // entry points for SmartParse
+}
+
+// DataDirective marks a run of data.  Count is the length in bytes for
+// strings and the number of entries for tables.
+type DataDirective struct {
+	Address int
+	Type    string
+	Count   int
+}
+
+// DbVersion is a previous version of the scripts in a database.
+type DbVersion struct {
+	Time    string
+	Note    string
+	Scripts json.RawMessage
+}
+
+type JsonDatabase struct {
+	Scripts map[string]*JsonScriptDb
+	History []*DbVersion `json:",omitempty"`
+}
+
+type JsonScriptDb struct {
+	Labels      []JsonLabel
+	Comments    []JsonDbComment
+	CDL         json.RawMessage `json:",omitempty"`
+	Directives  []JsonDataDirective
+	Enums       []JsonDbEnum
+	EntryPoints []string
+}
+
+type JsonDbComment struct {
+	Address string
+	Comment string
+}
+
+type JsonDataDirective struct {
+	Address string
+	Type    string
+	Count   int
+}
+
+type JsonDbEnum struct {
+	Address string
+	Enum    string
+}
+
+func NewDatabase() *Database {
+	db := &Database{
+		Scripts: make(map[string]*ScriptDb),
+		History: []*DbVersion{},
+	}
+	db.saved, _ = db.scriptsJson()
+	return db
+}
+
+func newScriptDb() *ScriptDb {
+	return &ScriptDb{
+		Labels:      make(map[int]*Label),
+		Comments:    make(map[int]string),
+		Directives:  make(map[int]*DataDirective),
+		Enums:       make(map[int]string),
+		EntryPoints: []int{},
+	}
+}
+
+// Script returns the analysis for the named script, adding it if it doesn't
+// exist.
+func (db *Database) Script(name string) *ScriptDb {
+	if sdb, ok := db.Scripts[name]; ok {
+		return sdb
+	}
+
+	sdb := newScriptDb()
+	db.Scripts[name] = sdb
+	return sdb
+}
+
+func dbAddr(addr int) string {
+	return fmt.Sprintf("0x%X", addr)
+}
+
+func parseDbAddr(s string) (int, error) {
+	addr, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid address: %q", s)
+	}
+	return int(addr), nil
+}
+
+func (sdb *ScriptDb) JsonScriptDb() (*JsonScriptDb, error) {
+	js := &JsonScriptDb{
+		Labels:      []JsonLabel{},
+		Comments:    []JsonDbComment{},
+		Directives:  []JsonDataDirective{},
+		Enums:       []JsonDbEnum{},
+		EntryPoints: []string{},
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(sdb.Labels)) {
+		js.Labels = append(js.Labels, sdb.Labels[addr].JsonLabel())
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(sdb.Comments)) {
+		js.Comments = append(js.Comments, JsonDbComment{dbAddr(addr), sdb.Comments[addr]})
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(sdb.Directives)) {
+		dd := sdb.Directives[addr]
+		js.Directives = append(js.Directives, JsonDataDirective{dbAddr(addr), dd.Type, dd.Count})
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(sdb.Enums)) {
+		js.Enums = append(js.Enums, JsonDbEnum{dbAddr(addr), sdb.Enums[addr]})
+	}
+
+	for _, addr := range slices.Sorted(slices.Values(sdb.EntryPoints)) {
+		js.EntryPoints = append(js.EntryPoints, dbAddr(addr))
+	}
+
+	if sdb.CDL != nil {
+		buf := &bytes.Buffer{}
+		_, err := sdb.CDL.WriteTo(buf)
+		if err != nil {
+			return nil, err
+		}
+		js.CDL = buf.Bytes()
+	}
+
+	return js, nil
+}
+
+func (js *JsonScriptDb) ScriptDb() (*ScriptDb, error) {
+	sdb := newScriptDb()
+
+	for _, jl := range js.Labels {
+		lbl, err := jl.Label()
+		if err != nil {
+			return nil, err
+		}
+		sdb.Labels[lbl.Address] = lbl
+	}
+
+	for _, jc := range js.Comments {
+		addr, err := parseDbAddr(jc.Address)
+		if err != nil {
+			return nil, err
+		}
+		sdb.Comments[addr] = jc.Comment
+	}
+
+	for _, jd := range js.Directives {
+		addr, err := parseDbAddr(jd.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		switch jd.Type {
+		case DataString, DataWordTable, DataPointerTable:
+		default:
+			return nil, fmt.Errorf("Invalid data directive type: %q", jd.Type)
+		}
+		sdb.Directives[addr] = &DataDirective{Address: addr, Type: jd.Type, Count: jd.Count}
+	}
+
+	for _, je := range js.Enums {
+		addr, err := parseDbAddr(je.Address)
+		if err != nil {
+			return nil, err
+		}
+		sdb.Enums[addr] = je.Enum
+	}
+
+	for _, ent := range js.EntryPoints {
+		addr, err := parseDbAddr(ent)
+		if err != nil {
+			return nil, err
+		}
+		sdb.EntryPoints = append(sdb.EntryPoints, addr)
+	}
+
+	if len(js.CDL) > 0 && string(js.CDL) != "null" {
+		cdl, err := CdlFromJson(bytes.NewReader(js.CDL))
+		if err != nil {
+			return nil, fmt.Errorf("CDL: %w", err)
+		}
+		sdb.CDL = cdl
+	}
+
+	return sdb, nil
+}
+
+func (db *Database) scriptsJson() ([]byte, error) {
+	scripts := make(map[string]*JsonScriptDb)
+	for name, sdb := range db.Scripts {
+		js, err := sdb.JsonScriptDb()
+		if err != nil {
+			return nil, err
+		}
+		scripts[name] = js
+	}
+
+	// Map keys are sorted, so the same scripts always give the same JSON.
+	return json.Marshal(scripts)
+}
+
+func (db *Database) loadScriptsJson(raw []byte) error {
+	scripts := make(map[string]*JsonScriptDb)
+	err := json.Unmarshal(raw, &scripts)
+	if err != nil {
+		return err
+	}
+
+	db.Scripts = make(map[string]*ScriptDb)
+	for name, js := range scripts {
+		sdb, err := js.ScriptDb()
+		if err != nil {
+			return fmt.Errorf("script %q: %w", name, err)
+		}
+		db.Scripts[name] = sdb
+	}
+	return nil
+}
+
+// Changed returns true if the scripts have changed since the database was
+// loaded or last saved.
+func (db *Database) Changed() (bool, error) {
+	raw, err := db.scriptsJson()
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(raw, db.saved), nil
+}
+
+// Commit adds the last saved version to the history if anything has changed,
+// with a note describing the change.  Only the newest versions are kept.
+func (db *Database) Commit(note string) error {
+	raw, err := db.scriptsJson()
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(raw, db.saved) {
+		return nil
+	}
+
+	db.History = append(db.History, &DbVersion{
+		Time:    time.Now().Format(time.RFC3339),
+		Note:    note,
+		Scripts: db.saved,
+	})
+	if len(db.History) > dbHistory {
+		db.History = db.History[len(db.History)-dbHistory:]
+	}
+
+	db.saved = raw
+	return nil
+}
+
+// Undo replaces the scripts with the newest version in the history and
+// removes it from the history.  Returns the version's note.
+func (db *Database) Undo() (string, error) {
+	if len(db.History) == 0 {
+		return "", fmt.Errorf("nothing to undo")
+	}
+
+	last := db.History[len(db.History)-1]
+	err := db.loadScriptsJson(last.Scripts)
+	if err != nil {
+		return "", err
+	}
+
+	db.History = db.History[:len(db.History)-1]
+	db.saved, err = db.scriptsJson()
+	return last.Note, err
+}
+
+func DatabaseFromJson(r io.Reader) (*Database, error) {
+	raw := struct {
+		Scripts json.RawMessage
+		History []*DbVersion
+	}{}
+
+	dec := json.NewDecoder(r)
+	err := dec.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewDatabase()
+	if raw.History != nil {
+		db.History = raw.History
+	}
+
+	if len(raw.Scripts) > 0 && string(raw.Scripts) != "null" {
+		err = db.loadScriptsJson(raw.Scripts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.saved, err = db.scriptsJson()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func DatabaseFromJsonFile(filename string) (*Database, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return DatabaseFromJson(file)
+}
+
+func (db *Database) WriteJson(w io.Writer) error {
+	out := JsonDatabase{
+		Scripts: make(map[string]*JsonScriptDb),
+		History: db.History,
+	}
+
+	for name, sdb := range db.Scripts {
+		js, err := sdb.JsonScriptDb()
+		if err != nil {
+			return err
+		}
+		out.Scripts[name] = js
+	}
+
+	raw, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(raw)
+	return err
+}
+
+// WriteToFile saves the database.  Call Commit first to keep the previous
+// version in the history.
+func (db *Database) WriteToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	werr := db.WriteJson(file)
+	err = file.Close()
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+
+	db.saved, err = db.scriptsJson()
+	return err
+}
+
+// SaveCDL merges a CDL given by the user into the stored one, so it's used
+// on every run.
+func (sdb *ScriptDb) SaveCDL(cdl *CodeDataLog) error {
+	if sdb.CDL == nil {
+		sdb.CDL = NewCDL()
+	}
+	return sdb.CDL.Merge(cdl)
+}
+
+// PrepareCDL returns the CDL to parse the script with: the stored CDL with
+// the data directives and entry points added.  It's rebuilt on every run, so
+// removing a directive or entry point removes its flags.  Targets of pointer tables are
+// read from raw, the script loaded at start, and added as entry points.  cdl
+// is merged in if it isn't nil.
+func (sdb *ScriptDb) PrepareCDL(cdl *CodeDataLog, raw []byte, start int) (*CodeDataLog, error) {
+	out := NewCDL()
+	if sdb.CDL != nil {
+		if err := out.Merge(sdb.CDL); err != nil {
+			return nil, err
+		}
+	}
+
+	if cdl != nil {
+		if sdb.CDL != nil && !sdb.CDL.SameBank(cdl) {
+			return nil, fmt.Errorf("CDL is for bank %s but the database has bank %s", cdl.bankString(), sdb.CDL.bankString())
+		}
+		if err := out.Merge(cdl); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, addr := range sdb.EntryPoints {
+		out.AddEntry(addr)
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(sdb.Directives)) {
+		dd := sdb.Directives[addr]
+		switch dd.Type {
+		case DataString:
+			for a := addr; a < addr+dd.Count; a++ {
+				out.set(a, cdlData | cdlString)
+			}
+
+		case DataWordTable, DataPointerTable:
+			for a := addr; a < addr+dd.Count*2; a++ {
+				out.set(a, cdlData | cdlWord)
+			}
+		}
+
+		if dd.Type != DataPointerTable {
+			continue
+		}
+
+		for i := 0; i < dd.Count; i++ {
+			off := addr+i*2-start
+			if off < 2 || off+1 >= len(raw) {
+				break
+			}
+
+			target := int(raw[off]) | int(raw[off+1])<<8
+			if target >= start+2 && target < start+len(raw) {
+				out.AddEntry(target)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Apply adds the stored labels, comments and enum annotations to a script
+// parsed with the CDL from PrepareCDL.  Data directives without a label get
+// an auto label.
+func (sdb *ScriptDb) Apply(s *Script) {
+	for addr := range sdb.Directives {
+		if _, ok := s.Labels[addr]; !ok {
+			s.Labels[addr] = AutoLabelVar(addr)
+		}
+	}
+
+	for addr, lbl := range sdb.Labels {
+		l := *lbl
+		s.Labels[addr] = &l
+	}
+
+	for addr, comment := range sdb.Comments {
+		if lbl, ok := s.Labels[addr]; ok {
+			lbl.Comment = comment
+		} else {
+			s.Labels[addr] = &Label{Address: addr, Comment: comment}
+		}
+	}
+
+	for _, t := range s.Tokens {
+		name, ok := sdb.Enums[t.Offset]
+		if !ok || t.Raw != 0xB8 || t.Instruction == nil || len(t.Inline) != 1 {
+			continue
+		}
+
+		if e, ok := Enums[name]; ok {
+			if sym, ok := e.Symbol(t.Inline[0].Int()); ok {
+				t.Symbol = sym
+			}
+		}
+	}
+}
+
+// Update records the script's named labels.  Comments on labels are kept
+// separately from the labels, so labels added by the parser aren't stored
+// just for their comment.  The script's CDL isn't stored as it's made from the
+// directives and entry points, see SaveCDL.
+func (sdb *ScriptDb) Update(s *Script) {
+	sdb.Labels = make(map[int]*Label)
+	for addr, lbl := range s.Labels {
+		if lbl.Comment != "" {
+			sdb.Comments[addr] = lbl.Comment
+		}
+
+		l := *lbl
+		l.Comment = ""
+		if !l.IsAuto() {
+			sdb.Labels[addr] = &l
+		}
+	}
+}
+
+// ParseDataDirective reads a directive in the form "TYPE" or "TYPE:COUNT",
+// eg "string:12".  The count defaults to one.
+func ParseDataDirective(addr int, s string) (*DataDirective, error) {
+	typ, count, found := strings.Cut(s, ":")
+	dd := &DataDirective{Address: addr, Type: typ, Count: 1}
+
+	switch typ {
+	case DataString, DataWordTable, DataPointerTable:
+	default:
+		return nil, fmt.Errorf("Invalid data directive type: %q", typ)
+	}
+
+	if found {
+		n, err := strconv.ParseInt(count, 0, 32)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid data directive count: %q", count)
+		}
+		dd.Count = int(n)
+	}
+	return dd, nil
+}
@@ -0,0 +1,631 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// The decompiler turns the basic blocks of a smart parsed script into
+// structured pseudo-code.  Values pushed onto the stack are collected into
+// expressions using the stack argument and return counts from the
+// instruction table, and jumps are turned into if, while and switch
+// statements where the code is laid out the usual way.  Anything else is
+// left as labels and gotos.
+
+// Infix operators for instructions that take two arguments and return one.
+var dcBinaryOps = map[byte]string{
+	0xC3: "&",  // and_a_b
+	0xC4: "|",  // or_a_b
+	0xC5: "==", // equal
+	0xC6: "!=", // not_equal
+	0xC7: "<",  // less_than
+	0xC8: "<=", // less_than_equal
+	0xC9: ">",  // greater_than
+	0xCA: ">=", // greater_than_equal
+	0xCB: "+",  // sum
+	0xCC: "-",  // subtract
+	0xCD: "*",  // multiply
+	0xCE: "/",  // signed_divide
+	0xE0: "%",  // modulo
+}
+
+// Prefix operators for instructions that take one argument and return one.
+var dcUnaryOps = map[byte]string{
+	0xC2: "!", // equals_zero
+	0xCF: "-", // negate
+}
+
+type dcExpr interface {
+	String() string
+}
+
+// dcConst is a value from push_word.
+type dcConst struct {
+	value int
+	name  string // enum symbol or label
+}
+
+func (e dcConst) String() string {
+	if e.name != "" {
+		return e.name
+	}
+	if e.value < 0x100 {
+		return fmt.Sprintf("%d", e.value)
+	}
+	return fmt.Sprintf("$%04X", e.value)
+}
+
+// dcVar is a variable read by push_var or push_var_indexed.
+type dcVar struct {
+	name  string
+	index dcExpr
+}
+
+func (e dcVar) String() string {
+	if e.index != nil {
+		return fmt.Sprintf("%s[%s]", e.name, e.index)
+	}
+	return e.name
+}
+
+// dcString is inline data from push_data, as it's printed in the disassembly.
+type dcString string
+
+func (e dcString) String() string {
+	return string(e)
+}
+
+// dcPop is a value that was pushed before the current block.
+type dcPop struct{}
+
+func (e dcPop) String() string {
+	return "pop()"
+}
+
+type dcUnary struct {
+	op string
+	x  dcExpr
+}
+
+func (e dcUnary) String() string {
+	return e.op+dcParen(e.x)
+}
+
+type dcBinary struct {
+	op   string
+	x, y dcExpr
+}
+
+func (e dcBinary) String() string {
+	return dcParen(e.x)+" "+e.op+" "+dcParen(e.y)
+}
+
+type dcCall struct {
+	name string
+	args []dcExpr
+}
+
+func (e dcCall) String() string {
+	args := []string{}
+	for _, a := range e.args {
+		args = append(args, a.String())
+	}
+	return e.name+"("+strings.Join(args, ", ")+")"
+}
+
+func dcParen(e dcExpr) string {
+	if _, ok := e.(dcBinary); ok {
+		return "("+e.String()+")"
+	}
+	return e.String()
+}
+
+// dcNot negates a condition.
+func dcNot(e dcExpr) dcExpr {
+	if u, ok := e.(dcUnary); ok && u.op == "!" {
+		return u.x
+	}
+	return dcUnary{"!", e}
+}
+
+type dcStmt interface{}
+
+type (
+	dcExprStmt   struct{ x dcExpr }
+	dcAssignStmt struct{ name string; x dcExpr }
+	dcPushStmt   struct{ x dcExpr }
+	dcReturnStmt struct{ name string }
+	dcGotoStmt   struct{ target int }
+	dcLabelStmt  struct{ address int }
+	dcRawStmt    struct{ t *Token } // instruction missing its operands
+	dcBreakStmt     struct{}
+	dcContinueStmt  struct{}
+)
+
+type dcIfStmt struct {
+	cond dcExpr
+	then []dcStmt
+	els  []dcStmt
+}
+
+type dcWhileStmt struct {
+	cond dcExpr
+	body []dcStmt
+}
+
+type dcSwitchStmt struct {
+	x       dcExpr
+	targets []int
+	call    bool // call_switch instead of jump_switch
+}
+
+// dcFunction is the code reachable from an entry point without following
+// calls.
+type dcFunction struct {
+	address int
+	blocks  []*BasicBlock
+	index   map[int]int // block start address to index in blocks
+	body    []dcStmt
+}
+
+// dcRegion is the context a range of blocks is decompiled in.
+type dcRegion struct {
+	join     int // where execution goes after the range
+	loopHead int // -1 outside of loops
+	loopExit int
+}
+
+type decompiler struct {
+	script  *Script
+	targets map[int]bool // addresses used by gotos, switches and calls into functions
+	starts  map[int]bool // start of every block
+	entries map[int]bool // start of every function
+}
+
+// Decompile returns pseudo-code for the script.  It should come from
+// SmartParse; data decoded as instructions makes a mess.
+func (s *Script) Decompile() string {
+	sb := &strings.Builder{}
+	s.WriteDecompiled(sb)
+	return sb.String()
+}
+
+// WriteDecompiled writes pseudo-code for the script, one function for each
+// entry point.  See Decompile.
+func (s *Script) WriteDecompiled(w io.Writer) error {
+	d := &decompiler{
+		script: s,
+		targets: make(map[int]bool),
+		starts: make(map[int]bool),
+		entries: make(map[int]bool),
+	}
+
+	funcs := d.functions()
+	for _, f := range funcs {
+		d.entries[f.address] = true
+		for _, bb := range f.blocks {
+			d.starts[bb.Start] = true
+		}
+	}
+
+	for _, f := range funcs {
+		f.body = d.emitRange(f, 0, len(f.blocks), dcRegion{join: -1, loopHead: -1, loopExit: -1})
+	}
+
+	for i, f := range funcs {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+
+		lines := []string{fmt.Sprintf("func %s() {", d.name(f.address))}
+		lines = d.printStmts(lines, f.body, 1)
+		lines = append(lines, "}")
+
+		if _, err := fmt.Fprintln(w, strings.Join(lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// functions splits the blocks into functions.  The script's entry point and
+// call targets come first, then any blocks that weren't reached from them.
+func (d *decompiler) functions() []*dcFunction {
+	blocks := d.script.BasicBlocks()
+	byStart := make(map[int]*BasicBlock)
+	for _, bb := range blocks {
+		byStart[bb.Start] = bb
+	}
+
+	roots := []int{d.script.StartAddress+2}
+	calls := []int{}
+	for _, bb := range blocks {
+		for _, t := range bb.Tokens {
+			if t.Raw == 0x85 || t.Raw == 0xEE { // call_abs, call_switch
+				calls = append(calls, codeTargets(t)...)
+			}
+		}
+	}
+	slices.Sort(calls)
+	roots = append(roots, calls...)
+	for _, bb := range blocks {
+		roots = append(roots, bb.Start)
+	}
+
+	claimed := make(map[int]bool)
+	funcs := []*dcFunction{}
+	for _, root := range roots {
+		if _, ok := byStart[root]; !ok || claimed[root] {
+			continue
+		}
+
+		f := &dcFunction{address: root, index: make(map[int]int)}
+		queue := []int{root}
+		for len(queue) > 0 {
+			addr := queue[0]
+			queue = queue[1:]
+
+			bb, ok := byStart[addr]
+			if !ok || claimed[addr] {
+				continue
+			}
+			claimed[addr] = true
+			f.blocks = append(f.blocks, bb)
+			queue = append(queue, bb.Successors...)
+		}
+
+		slices.SortFunc(f.blocks, func(a, b *BasicBlock) int {
+			return a.Start - b.Start
+		})
+		for i, bb := range f.blocks {
+			f.index[bb.Start] = i
+		}
+		funcs = append(funcs, f)
+	}
+
+	slices.SortStableFunc(funcs[min(1, len(funcs)):], func(a, b *dcFunction) int {
+		return a.address - b.address
+	})
+	return funcs
+}
+
+// emitRange structures blocks lo up to hi of a function.
+func (d *decompiler) emitRange(f *dcFunction, lo, hi int, region dcRegion) []dcStmt {
+	body := []dcStmt{}
+
+	// index returns the block index for an address.  The join point counts
+	// as the end of the range.
+	index := func(addr int) (int, bool) {
+		if addr == region.join {
+			return hi, true
+		}
+		i, ok := f.index[addr]
+		return i, ok && i > lo && i <= hi
+	}
+
+	for i := lo; i < hi; {
+		bb := f.blocks[i]
+		stmts, last, x := d.translate(bb)
+		body = append(body, dcLabelStmt{bb.Start})
+
+		next := -1
+		if i+1 < hi {
+			next = f.blocks[i+1].Start
+		} else {
+			next = region.join
+		}
+
+		if !hasOperands(last) {
+			// A truncated jump has no target to follow.
+			body = append(body, stmts...)
+			i++
+			continue
+		}
+
+		switch last.Raw {
+		case 0xBF, 0xC0: // jump_not_zero, jump_zero
+			target := last.Inline[0].Int()
+
+			// The condition for falling through to the next block.
+			cond := x
+			if last.Raw == 0xBF {
+				cond = dcNot(x)
+			}
+
+			t, ok := index(target)
+			if ok && t > i+1 {
+				end := f.blocks[t-1]
+				jump := end.Last()
+
+				// while: the block before the exit jumps back here
+				if jump.Raw == 0x84 && hasOperands(jump) && jump.Inline[0].Int() == bb.Start {
+					loop := dcRegion{join: bb.Start, loopHead: bb.Start, loopExit: target}
+					inner := d.emitRange(f, i+1, t, loop)
+
+					if len(stmts) == 0 {
+						body = append(body, dcWhileStmt{cond, inner})
+					} else {
+						stmts = append(stmts, dcIfStmt{cond: dcNot(cond), then: []dcStmt{dcBreakStmt{}}})
+						body = append(body, dcWhileStmt{dcConst{1, "true"}, append(stmts, inner...)})
+					}
+					i = t
+					continue
+				}
+
+				body = append(body, stmts...)
+
+				// if/else: the then block jumps over the else block
+				if jump.Raw == 0x84 && hasOperands(jump) && t-1 > i {
+					if k, ok := index(jump.Inline[0].Int()); ok && k > t {
+						inner := region
+						inner.join = jump.Inline[0].Int()
+						body = append(body, dcIfStmt{
+							cond: cond,
+							then: d.emitRange(f, i+1, t, inner),
+							els: d.emitRange(f, t, k, inner),
+						})
+						i = k
+						continue
+					}
+				}
+
+				inner := region
+				inner.join = target
+				body = append(body, dcIfStmt{cond: cond, then: d.emitRange(f, i+1, t, inner)})
+				i = t
+				continue
+			}
+
+			body = append(body, stmts...)
+			if target == next {
+				body = append(body, dcExprStmt{x})
+			} else {
+				body = append(body, dcIfStmt{cond: dcNot(cond), then: []dcStmt{d.jump(target, region)}})
+			}
+
+		case 0x84: // jump_abs
+			body = append(body, stmts...)
+			target := last.Inline[0].Int()
+			if target != next {
+				body = append(body, d.jump(target, region))
+			}
+
+		default:
+			body = append(body, stmts...)
+			if !endsFlow(last.Raw) && next != bb.End+1 && d.starts[bb.End+1] {
+				// Falls through to a block outside of this range
+				body = append(body, d.jump(bb.End+1, region))
+			}
+		}
+		i++
+	}
+
+	return body
+}
+
+// hasOperands returns false for an instruction that was cut off by the end of
+// the script before its inline operands.
+func hasOperands(t *Token) bool {
+	return t.Instruction != nil && len(t.Inline) >= len(t.Instruction.Operands)
+}
+
+// jump returns the statement for a jump to target.
+func (d *decompiler) jump(target int, region dcRegion) dcStmt {
+	switch target {
+	case region.loopHead:
+		return dcContinueStmt{}
+	case region.loopExit:
+		return dcBreakStmt{}
+	}
+	d.targets[target] = true
+	return dcGotoStmt{target}
+}
+
+// translate turns the instructions of a block into statements.  The last
+// instruction is returned along with its stack argument, if it's a jump that
+// takes one.
+func (d *decompiler) translate(bb *BasicBlock) ([]dcStmt, *Token, dcExpr) {
+	stmts := []dcStmt{}
+	stack := []dcExpr{}
+
+	// popN removes n values, in the order they were pushed.
+	popN := func(n int) []dcExpr {
+		args := make([]dcExpr, n)
+		for i := n-1; i >= 0; i-- {
+			if len(stack) == 0 {
+				args[i] = dcPop{}
+				continue
+			}
+			args[i] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+		return args
+	}
+	pop := func() dcExpr {
+		return popN(1)[0]
+	}
+	flush := func() {
+		for _, x := range stack {
+			stmts = append(stmts, dcPushStmt{x})
+		}
+		stack = []dcExpr{}
+	}
+
+	last := bb.Last()
+	var lastArg dcExpr
+
+	for _, t := range bb.Tokens {
+		instr := t.Instruction
+		if !hasOperands(t) {
+			flush()
+			stmts = append(stmts, dcRawStmt{t})
+			continue
+		}
+
+		operand := func(i int) dcExpr {
+			v := t.Inline[i].Int()
+			if t.InlineTypes()[i].IsAddress() {
+				return dcVar{name: d.name(v)}
+			}
+			if t.Label != "" {
+				return dcConst{v, t.Label}
+			}
+			return dcConst{v, t.Symbol}
+		}
+
+		if op, ok := dcBinaryOps[t.Raw]; ok {
+			args := popN(2)
+			stack = append(stack, dcBinary{op, args[0], args[1]})
+			continue
+		}
+
+		if op, ok := dcUnaryOps[t.Raw]; ok {
+			stack = append(stack, dcUnary{op, pop()})
+			continue
+		}
+
+		switch t.Raw {
+		case 0xB8: // push_word
+			stack = append(stack, operand(0))
+
+		case 0xB7: // push_var
+			stack = append(stack, operand(0))
+
+		case 0xB9: // push_var_indexed
+			stack = append(stack, dcVar{name: d.name(t.Inline[0].Int()), index: pop()})
+
+		case 0xBB: // push_data
+			stack = append(stack, dcString(t.stringText()))
+
+		case 0xBA, 0xBC: // push_data_indirect, push_string_from_table
+			stack = append(stack, dcCall{instr.Name, []dcExpr{operand(0)}})
+
+		case 0xBD, 0x8A: // pop_into, pop_string_to_addr
+			x := pop()
+			flush()
+			stmts = append(stmts, dcAssignStmt{d.name(t.Inline[0].Int()), x})
+
+		case 0x86, 0xAC: // return, long_return
+			flush()
+			stmts = append(stmts, dcReturnStmt{instr.Name})
+
+		case 0x85: // call_abs
+			flush()
+			target := t.Inline[0].Int()
+			if !d.entries[target] {
+				d.targets[target] = true
+			}
+			stmts = append(stmts, dcExprStmt{dcCall{d.name(target), nil}})
+
+		case 0xC1, 0xEE: // jump_switch, call_switch
+			x := pop()
+			flush()
+			targets := codeTargets(t)
+			for _, target := range targets {
+				if t.Raw == 0xC1 || !d.entries[target] {
+					d.targets[target] = true
+				}
+			}
+			stmts = append(stmts, dcSwitchStmt{x, targets, t.Raw == 0xEE})
+
+		case 0x84: // jump_abs
+			flush()
+
+		case 0xBF, 0xC0: // jump_not_zero, jump_zero
+			// Both test the top of the stack.
+			lastArg = pop()
+			flush()
+
+		case 0x87: // loop
+			// Reads its arguments from the stack directly.
+			flush()
+			stmts = append(stmts, dcExprStmt{dcCall{instr.String(), nil}})
+
+		default:
+			args := popN(instr.ArgCount + instr.StrCount)
+			for i := range t.Inline {
+				args = append(args, operand(i))
+			}
+
+			call := dcCall{instr.String(), args}
+			if instr.RetCount > 0 {
+				stack = append(stack, call)
+			} else {
+				// Anything left on the stack was pushed first.  Some
+				// instructions use it without counting it as an argument.
+				flush()
+				stmts = append(stmts, dcExprStmt{call})
+			}
+		}
+	}
+
+	flush()
+	return stmts, last, lastArg
+}
+
+// name returns the label for an address, or the address.
+func (d *decompiler) name(addr int) string {
+	if lbl, ok := d.script.Labels[addr]; ok && lbl.Name != "" {
+		return lbl.Name
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
+
+func (d *decompiler) printStmts(lines []string, stmts []dcStmt, depth int) []string {
+	indent := strings.Repeat("\t", depth)
+	for _, st := range stmts {
+		switch st := st.(type) {
+		case dcLabelStmt:
+			if d.targets[st.address] {
+				lines = append(lines, strings.Repeat("\t", depth-1)+d.name(st.address)+":")
+			}
+		case dcExprStmt:
+			lines = append(lines, indent+st.x.String())
+		case dcAssignStmt:
+			lines = append(lines, indent+st.name+" = "+st.x.String())
+		case dcPushStmt:
+			lines = append(lines, indent+"push("+st.x.String()+")")
+		case dcReturnStmt:
+			lines = append(lines, indent+st.name)
+		case dcGotoStmt:
+			lines = append(lines, indent+"goto "+d.name(st.target))
+		case dcRawStmt:
+			lines = append(lines, fmt.Sprintf("%s// $%04X: %s is missing its operands", indent, st.t.Offset, st.t.Instruction))
+		case dcBreakStmt:
+			lines = append(lines, indent+"break")
+		case dcContinueStmt:
+			lines = append(lines, indent+"continue")
+
+		case dcIfStmt:
+			lines = append(lines, indent+"if "+st.cond.String()+" {")
+			lines = d.printStmts(lines, st.then, depth+1)
+			if len(st.els) > 0 {
+				lines = append(lines, indent+"} else {")
+				lines = d.printStmts(lines, st.els, depth+1)
+			}
+			lines = append(lines, indent+"}")
+
+		case dcWhileStmt:
+			lines = append(lines, indent+"while "+st.cond.String()+" {")
+			lines = d.printStmts(lines, st.body, depth+1)
+			lines = append(lines, indent+"}")
+
+		case dcSwitchStmt:
+			lines = append(lines, indent+"switch "+st.x.String()+" {")
+			for i, target := range st.targets {
+				lines = append(lines, fmt.Sprintf("%scase %d:", indent, i))
+				if st.call {
+					lines = append(lines, indent+"\t"+d.name(target)+"()")
+				} else {
+					lines = append(lines, indent+"\tgoto "+d.name(target))
+				}
+			}
+			lines = append(lines, indent+"}")
+		}
+	}
+	return lines
+}
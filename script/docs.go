@@ -0,0 +1,142 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+func (i Instruction) operandDoc() string {
+	if len(i.Operands) == 0 {
+		return "0"
+	}
+
+	ops := []string{}
+	for _, op := range i.Operands {
+		switch op {
+		case OperandCodeAddr:
+			ops = append(ops, "1 Word (code address)")
+		case OperandDataAddr:
+			ops = append(ops, "1 Word (data address)")
+		case OperandAsmAddr:
+			ops = append(ops, "1 Word (6502 code address)")
+		case OperandImm8:
+			ops = append(ops, "1 Byte")
+		case OperandImm16:
+			ops = append(ops, "1 Word")
+		case OperandBank:
+			ops = append(ops, "1 Byte (bank ID)")
+		case OperandString:
+			ops = append(ops, "32 bytes max (NULL terminated)")
+		case OperandCodeTable:
+			ops = append(ops, "1 Byte count, followed by that many code address Words")
+		}
+	}
+	return strings.Join(ops, ", ")
+}
+
+// WriteInstructionDocs writes the markdown documentation for the current
+// instruction table.  This is used to generate docs/instructions.md.
+func WriteInstructionDocs(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "<!-- Generated from script/instructions.json.  DO NOT EDIT. -->")
+	if err != nil {
+		return err
+	}
+
+	for _, instr := range Instructions {
+		title := instr.Title
+		if title == "" && instr.Name != "" {
+			title = instr.Name
+		}
+
+		lines := []string{
+			"",
+			strings.TrimSpace(fmt.Sprintf("## 0x%02X %s", instr.Opcode, title)),
+			"",
+		}
+
+		if instr.Name != "" {
+			lines = append(lines, fmt.Sprintf("Mnemonic: `%s`", instr.Name), "")
+		}
+
+		stack := fmt.Sprintf("Stack Arguments:  %d", instr.ArgCount)
+		if instr.StackNote != "" {
+			stack += " ("+instr.StackNote+")"
+		}
+
+		lines = append(lines,
+			stack,
+			"Inline Arguments: "+instr.operandDoc(),
+			fmt.Sprintf("Returns:          %d", instr.RetCount),
+		)
+
+		enums := []string{}
+		for arg := 0; arg < instr.ArgCount; arg++ {
+			e := instr.ArgEnum(arg)
+			if e == nil {
+				continue
+			}
+
+			enums = append(enums, "", fmt.Sprintf("Arg%c (`%s`):", 'A'+arg, e.Name), "")
+			for _, v := range e.Values {
+				line := fmt.Sprintf("    $%02X %s", v.Value, v.Name)
+				if v.Comment != "" {
+					line += " ; "+v.Comment
+				}
+				enums = append(enums, line)
+			}
+		}
+
+		if len(enums) > 0 {
+			lines = append(lines, "", "Argument values:")
+			lines = append(lines, enums...)
+		}
+
+		if len(instr.Vars) > 0 {
+			lines = append(lines, "", "Vars used:", "")
+			for _, v := range instr.Vars {
+				if v == "" {
+					lines = append(lines, "")
+				} else {
+					lines = append(lines, "    "+v)
+				}
+			}
+		}
+
+		if instr.Description != "" {
+			lines = append(lines, "", instr.Description)
+		}
+
+		_, err = fmt.Fprintln(w, strings.Join(lines, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Summary returns a short plain text description of the instruction, for
+// tooltips and the like.
+func (i Instruction) Summary() string {
+	lines := []string{fmt.Sprintf("0x%02X %s", i.Opcode, i.String())}
+	if i.Title != "" {
+		lines[0] += " - "+i.Title
+	}
+
+	stack := fmt.Sprintf("Stack Arguments:  %d", i.ArgCount)
+	if i.StackNote != "" {
+		stack += " ("+i.StackNote+")"
+	}
+
+	lines = append(lines,
+		stack,
+		"Inline Arguments: "+i.operandDoc(),
+		fmt.Sprintf("Returns:          %d", i.RetCount),
+	)
+
+	if i.Description != "" {
+		lines = append(lines, "", i.Description)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,166 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"bytes"
+	"strconv"
+	"encoding/json"
+
+	_ "embed"
+)
+
+// Symbolic names for stack arguments.  Instructions reference these by name
+// with ArgEnums in instructions.json.
+//go:embed enums.json
+var enumData []byte
+
+var Enums map[string]*Enum
+
+func init() {
+	Enums = make(map[string]*Enum)
+
+	err := LoadEnums(bytes.NewReader(enumData))
+	if err != nil {
+		panic(fmt.Sprintf("built-in enum table is invalid: %s", err))
+	}
+}
+
+type Enum struct {
+	Name string
+	Values []*EnumValue
+}
+
+type EnumValue struct {
+	Value int
+	Name string
+	Comment string
+}
+
+// Symbol returns the name for the given value.
+func (e *Enum) Symbol(value int) (string, bool) {
+	for _, v := range e.Values {
+		if v.Value == value {
+			return v.Name, true
+		}
+	}
+	return "", false
+}
+
+type JsonEnum struct {
+	Name string
+	Values []JsonEnumValue
+}
+
+type JsonEnumValue struct {
+	Value string
+	Name string
+	Comment string `json:",omitempty"`
+}
+
+func (je JsonEnum) Enum() (*Enum, error) {
+	e := &Enum{Name: je.Name, Values: []*EnumValue{}}
+	for _, v := range je.Values {
+		val, err := strconv.ParseInt(v.Value, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s in enum %s: %q", v.Name, je.Name, v.Value)
+		}
+
+		e.Values = append(e.Values, &EnumValue{
+			Value: int(val),
+			Name: v.Name,
+			Comment: v.Comment,
+		})
+	}
+	return e, nil
+}
+
+func LoadEnumsFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return LoadEnums(file)
+}
+
+// LoadEnums reads enum definitions in the same format as the built-in
+// enums.json.  Enums replace existing enums with the same name.
+func LoadEnums(r io.Reader) error {
+	list := []JsonEnum{}
+	dec := json.NewDecoder(r)
+	err := dec.Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	for _, je := range list {
+		e, err := je.Enum()
+		if err != nil {
+			return err
+		}
+		Enums[e.Name] = e
+	}
+
+	return nil
+}
+
+// LookupEnumSymbol finds the value of a symbol in any of the loaded enums.
+func LookupEnumSymbol(name string) (int, bool) {
+	for _, e := range Enums {
+		for _, v := range e.Values {
+			if v.Name == name {
+				return v.Value, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ArgEnum returns the enum for the given stack argument, if any.
+func (i Instruction) ArgEnum(arg int) *Enum {
+	if arg < 0 || arg >= len(i.ArgEnums) {
+		return nil
+	}
+	return Enums[i.ArgEnums[arg]]
+}
+
+// AnnotateEnums sets the Symbol on push_word tokens that push an argument
+// with an enum to the instruction immediately following them.  Arguments are
+// pushed in order, so the push_word directly before an instruction is its
+// last argument.
+func (s *Script) AnnotateEnums() {
+	tokenMap := make(map[int]*Token)
+	for _, t := range s.Tokens {
+		t.Symbol = ""
+		tokenMap[t.Offset] = t
+	}
+
+	for _, t := range s.Tokens {
+		if t.Instruction == nil || t.IsData || len(t.Instruction.ArgEnums) == 0 {
+			continue
+		}
+
+		// Walk backwards through the push_words directly preceding the
+		// instruction.
+		prevAddr := t.Offset
+		for arg := t.Instruction.ArgCount-1; arg >= 0; arg-- {
+			push, ok := tokenMap[prevAddr-3]
+			if !ok || push.Raw != 0xB8 || push.Instruction == nil || push.Size() != 3 {
+				break
+			}
+			prevAddr = push.Offset
+
+			e := t.Instruction.ArgEnum(arg)
+			if e == nil {
+				continue
+			}
+
+			if sym, ok := e.Symbol(push.Inline[0].Int()); ok {
+				push.Symbol = sym
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package script
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+
+	_ "embed"
+)
+
+//go:embed disasm.html
+var htmlTemplateSource string
+
+var htmlTemplate = template.Must(template.New("disasm").Parse(htmlTemplateSource))
+
+type htmlPage struct {
+	Title    string
+	Start    string
+	Stack    string
+	Warnings []string
+	Groups   []*htmlGroup
+	Docs     map[string]string // instruction summaries by opcode
+}
+
+// htmlGroup is a basic block, or a run of tokens that aren't in one.
+type htmlGroup struct {
+	Label      string
+	Summary    string
+	Successors []htmlLink
+	Tokens     []htmlToken
+}
+
+type htmlToken struct {
+	Anchor   string
+	Address  string
+	Bytes    string
+	Class    string // CDL classification: code, data or unkn
+	Label    string
+	Comment  string
+	Xrefs    []htmlLink
+	Op       string // opcode, for the docs
+	Mnemonic string
+	Operands []htmlLink
+	Value    string // data byte
+}
+
+type htmlLink struct {
+	Text string
+	Href string // empty if the address isn't in the script
+}
+
+func htmlAnchor(addr int) string {
+	return fmt.Sprintf("a%04X", addr)
+}
+
+// WriteHtml writes the disassembly as a single HTML page.  Labels and
+// operands link to their targets, labels list their cross references, basic
+// blocks can be collapsed, and the instruction docs are shown when hovering
+// over a mnemonic.  Everything is inline so the file can be viewed offline.
+func (s *Script) WriteHtml(w io.Writer, title string) error {
+	tokens := slices.Clone(s.Tokens)
+	slices.SortStableFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	anchors := make(map[int]bool)
+	for _, t := range tokens {
+		anchors[t.Offset] = true
+	}
+
+	link := func(addr int, text string) htmlLink {
+		l := htmlLink{Text: text}
+		if anchors[addr] {
+			l.Href = "#"+htmlAnchor(addr)
+		}
+		return l
+	}
+
+	name := func(addr int) string {
+		if lbl, ok := s.Labels[addr]; ok && lbl.Name != "" {
+			return lbl.Name
+		}
+		return fmt.Sprintf("$%04X", addr)
+	}
+
+	page := &htmlPage{
+		Title: title,
+		Start: fmt.Sprintf("%04X", s.StartAddress),
+		Stack: fmt.Sprintf("%04X", s.StackAddress),
+		Warnings: s.Warnings,
+		Groups: []*htmlGroup{},
+		Docs: make(map[string]string),
+	}
+
+	blockOf := make(map[*Token]*BasicBlock)
+	for _, bb := range s.BasicBlocks() {
+		for _, t := range bb.Tokens {
+			blockOf[t] = bb
+		}
+	}
+
+	var group *htmlGroup
+	var groupBlock *BasicBlock
+	runStart := 0
+	finishRun := func(end int) {
+		if group != nil && groupBlock == nil {
+			group.Summary = fmt.Sprintf("$%04X-$%04X (%d bytes)", runStart, end, end-runStart+1)
+		}
+	}
+
+	prevEnd := 0
+	for _, t := range tokens {
+		bb := blockOf[t]
+		switch {
+		case bb != nil && bb != groupBlock:
+			finishRun(prevEnd)
+			group = &htmlGroup{
+				Summary: fmt.Sprintf("$%04X-$%04X", bb.Start, bb.End),
+				Successors: []htmlLink{},
+			}
+			if lbl, ok := s.Labels[bb.Start]; ok {
+				group.Label = lbl.Name
+			}
+			for _, addr := range bb.Successors {
+				group.Successors = append(group.Successors, link(addr, "-> "+name(addr)))
+			}
+			page.Groups = append(page.Groups, group)
+			groupBlock = bb
+
+		case bb == nil && (group == nil || groupBlock != nil):
+			group = &htmlGroup{}
+			page.Groups = append(page.Groups, group)
+			groupBlock = nil
+			runStart = t.Offset
+		}
+
+		group.Tokens = append(group.Tokens, s.htmlToken(t, link, name))
+		prevEnd = t.Offset+t.Size()-1
+
+		if t.Instruction != nil && !t.IsData {
+			op := fmt.Sprintf("%02X", t.Raw)
+			if _, ok := page.Docs[op]; !ok {
+				page.Docs[op] = t.Instruction.Summary()
+			}
+		}
+	}
+	finishRun(prevEnd)
+
+	return htmlTemplate.Execute(w, page)
+}
+
+func (s *Script) htmlToken(t *Token, link func(int, string) htmlLink, name func(int) string) htmlToken {
+	ht := htmlToken{
+		Anchor: htmlAnchor(t.Offset),
+		Address: fmt.Sprintf("%04X", t.Offset),
+		Class: "unkn",
+	}
+
+	if s.CDL != nil {
+		ht.Class = strings.ToLower(s.CDL.get(t.Offset).String())
+	}
+
+	if lbl, ok := s.Labels[t.Offset]; ok {
+		ht.Label = lbl.Name
+		ht.Comment = lbl.Comment
+		if ht.Label == "" {
+			ht.Label = fmt.Sprintf("$%04X", t.Offset)
+		}
+	}
+
+	for _, x := range t.Xrefs {
+		ht.Xrefs = append(ht.Xrefs, link(x.Source, x.String()))
+	}
+
+	if t.Native != nil {
+		// No Op, the docs are for the script instructions.
+		bytestr := []string{fmt.Sprintf("%02X", t.Raw)}
+		for _, v := range t.Inline {
+			for _, b := range v.Bytes() {
+				bytestr = append(bytestr, fmt.Sprintf("%02X", b))
+			}
+		}
+		ht.Bytes = strings.Join(bytestr, " ")
+		ht.Mnemonic = t.Native.Name
+
+		text := strings.TrimPrefix(t.nativeText(s.Labels), t.Native.Name)
+		if text = strings.TrimSpace(text); text != "" {
+			op := htmlLink{Text: text}
+			if addr, ok := t.NativeTarget(); ok {
+				op.Href = link(addr, text).Href
+			}
+			ht.Operands = append(ht.Operands, op)
+		}
+		return ht
+	}
+
+	if t.Instruction == nil || t.IsData {
+		ht.Bytes = fmt.Sprintf("%02X", t.Raw)
+		ht.Value = fmt.Sprintf("%d", t.Raw)
+		return ht
+	}
+
+	bytestr := []string{fmt.Sprintf("%02X", t.Raw)}
+	for _, v := range t.Inline {
+		for _, b := range v.Bytes() {
+			bytestr = append(bytestr, fmt.Sprintf("%02X", b))
+		}
+	}
+	ht.Bytes = strings.Join(bytestr, " ")
+	ht.Op = fmt.Sprintf("%02X", t.Raw)
+	ht.Mnemonic = t.Instruction.String()
+
+	if t.Instruction.HasOperand(OperandString) {
+		ht.Operands = []htmlLink{{Text: t.stringText()}}
+		return ht
+	}
+
+	types := t.InlineTypes()
+	for i, v := range t.Inline {
+		switch {
+		case types[i].IsAddress():
+			ht.Operands = append(ht.Operands, link(v.Int(), name(v.Int())))
+		case t.Label != "":
+			// Far jump targets are in another script.
+			if lbl, ok := s.Labels[v.Int()]; ok && lbl.Name == t.Label {
+				ht.Operands = append(ht.Operands, link(v.Int(), t.Label))
+			} else {
+				ht.Operands = append(ht.Operands, htmlLink{Text: t.Label})
+			}
+		case t.Symbol != "":
+			ht.Operands = append(ht.Operands, htmlLink{Text: t.Symbol})
+		default:
+			ht.Operands = append(ht.Operands, htmlLink{Text: v.HexString()})
+		}
+	}
+
+	return ht
+}
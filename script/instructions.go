@@ -2,336 +2,163 @@ package script
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"bytes"
+	"strconv"
+	"strings"
+	"encoding/json"
+
+	_ "embed"
 )
 
+//go:generate go run ../cmd/instr-docs.go ../docs/instructions.md
+
+// The instruction set definition.  This drives both InstrMap and the
+// generated docs/instructions.md.
+//go:embed instructions.json
+var instructionData []byte
+
 var InstrMap map[byte]*Instruction
+var Instructions []*Instruction
 
 func init() {
 	InstrMap = make(map[byte]*Instruction)
-	for _, i := range Instructions {
-		InstrMap[i.Opcode] = i
+	Instructions = []*Instruction{}
+
+	err := LoadInstructions(bytes.NewReader(instructionData))
+	if err != nil {
+		panic(fmt.Sprintf("built-in instruction table is invalid: %s", err))
 	}
 }
 
-var Instructions []*Instruction = []*Instruction{
-	&Instruction{ 0x80, 0, 0, 0, false,  "play_beep"},
-	&Instruction{ 0x81, 0, 0, 0, false,  "halt"},
-	&Instruction{ 0x82, 0, 0, 0, false,  "tape_nmi_shenanigans"},
-	&Instruction{ 0x83, 0, 0, 0, false,  "tape_wait"},
-
-	// Jump to the inline word, in the VM
-	&Instruction{ 0x84, 0, 2, 0, false,  "jump_abs"},
-
-	// Call a routine at the inline word, in the VM
-	&Instruction{ 0x85, 0, 2, 0, false,  "call_abs"},
-
-	// Return from a previous call
-	&Instruction{ 0x86, 0, 0, 0, false,  "return"},
-
-	&Instruction{ 0x87, 0, 0, 0,  false, "loop"},
-	&Instruction{ 0x88, 0, 0, 0,  false, "play_sound"},
-
-	// ArgA: Foreground color index
-	// ArgB: Background color index
-	// ArgC: Ignored??
-	&Instruction{ 0x89, 3, 0, 0,  false, "draw_string"},
-
-	&Instruction{ 0x8A, 0, 2, 0,  false, "pop_string_to_addr"},
-	&Instruction{ 0x8B, 1, 0, 0,  false, ""},
-	&Instruction{ 0x8C, 0, 0, 1,  false, "string_length"},
-	&Instruction{ 0x8D, 0, 0, 1,  false, "string_to_int"},
-	&Instruction{ 0x8E, 0, 0, 16, false, "string_concat"},
-	&Instruction{ 0x8F, 0, 0, 1,  false,  "strings_equal"},
-
-	&Instruction{ 0x90, 0, 0, 1,  false,  "strings_not_equal"},
-	&Instruction{ 0x91, 0, 0, 1,  false,  "string_less_than"},
-	&Instruction{ 0x92, 0, 0, 1,  false,  "string_less_than_equal"},
-	&Instruction{ 0x93, 0, 0, 1,  false,  "string_greater_than_equal"},
-	&Instruction{ 0x94, 0, 0, 1,  false,  "string_greater_than"},
-
-	// Sets some tape NMI stuff if the byte at $0740 is not zero.
-	// Will call 0x82 tape_nmi_shenanigans if $0740 != 0
-	&Instruction{ 0x95, 1, 0, 0,  false,  "tape_nmi_shenigans_set"},
-
-	&Instruction{ 0x96, 0, 2, 0,  true,   "set_word_4E"},
-
-	// Seen loading two screens that are scrolled across
-	// horizontally and vertically.
-	// ArgB seems to control horizontal vs vertical, but only #%0000_0010?
-	&Instruction{ 0x97, 2, 0, 0,  false,  "load_two_screens"},
-
-	&Instruction{ 0x98, 1, 0, 0,  false,  ""},
-	&Instruction{ 0x99, 1, 0, 0,  false,  "enable_audio"},
-	&Instruction{ 0x9A, 0, 0, 0,  false,  "disable_audio"},
-	&Instruction{ 0x9B, 0, 0, 0,  false,  "halt"},
-	&Instruction{ 0x9C, 0, 0, 0,  false,  "toggle_44FE"},
-
-	// Waits for data from the tape then jumps into 0x9E code
-	&Instruction{ 0x9D, 2, 0, 0,  false,  "something_tape"},
-
-	// Calls 0xEB draw_overlay.  Draws the whole screen from data previously
-	// loaded from the tape.
-	&Instruction{ 0x9E, 2, 0, 0,  false,  "draw_and_show_screen"},
-
-	// Source box top left
-	// ArgA: Column
-	// ArgB: Row
-	// Source box bottom Right
-	// ArgC: Column
-	// ArgD: Row
-	// Destination top left
-	// ArgE: Column
-	// ArgF: row
-	&Instruction{ 0x9F, 6, 0, 0,  false,  "copy_tiles"},
-
-	&Instruction{ 0xA0, 2, 0, 1,  false,  ""},
-
-	// Draw a screen from ROM.
-	// ArgA is screen index (ArgA <= 14)
-	// 00 - Window (used as the unit screens in the english tapes)
-	// 01 - bricks??
-	// 02 - Notebook (used for the mid-lesson quizes in the english tapes)
-	// 03 - Blimp (used after english lessons, before Gold Tomahawk)
-	// 04 - Map of USA (used in english tapes before final quiz)
-	// 05 - Green rounded title card (used in math/science)
-	// 06 - Orange rounded title card (used in math/science)
-	// 07 - Blue Triangle title card (used in a math tape)
-	// 08 - Blue Sci-fi title card (used in science tapes)
-	// 09 - Green block border (from here on don't seem to be used)
-	// 0A - Generic brick border
-	// 0B - Generic twist border
-	// 0C - Generic yellow embossed border
-	// 0D - Generic blue diamond border
-	// 0E - Generic brownish border
-	&Instruction{ 0xA1, 1, 0, 0,  false,  "load_rom_screen"},
-	&Instruction{ 0xA2, 1, 0, 0,  false,  "buffer_palette"},
-
-	// Possibly a sprite setup routine.  loads up some CHR data and some palette
-	// data.
-	&Instruction{ 0xA3, 1, 0, 0,  false,  "sprite_setup"},
-	&Instruction{ 0xA4, 3, 0, 0,  false,  ""},
-	&Instruction{ 0xA5, 1, 0, 0,  false,  "set_470A"},
-	&Instruction{ 0xA6, 1, 0, 0,  false,  "set_470B"},
-
-	// jump to the inline address, in assembly, not in the VM
-	// (built-in ACE, lmao)
-	// Will not jump to anything at or above $8000 or below $5000.
-	// Addresses in $5000-$5FFF use $470A as the bank ID
-	// Addresses in $6000-$7FFF use $470B as the bank ID
-	&Instruction{ 0xA7, 0, 0, 0,  false,   "call_asm"},
-
-	// ArgA: Envelope Loop
-	// ArgB: Constant Volume
-	// ArgC: Volume/Envelope
-	// ArgD: Noise Period
-	// ArgE: Length Counter
-	&Instruction{ 0xA8, 5, 0, 0,  false,  "play_noise"},
-
-	// Used when redrawing a portion of the screen after drawing a box or
-	// some other image on top of the background.
-	&Instruction{ 0xA9, 1, 0, 0,  false,  "restore_tiles"},
-	&Instruction{ 0xAA, 1, 0, 0,  false,  "long_jump"},
-	&Instruction{ 0xAB, 1, 0, 0,  false,  "long_call"},
-	&Instruction{ 0xAC, 0, 0, 0,  false,  "long_return"},
-	&Instruction{ 0xAD, 1, 0, 1,  false,  "absolute"},
-	&Instruction{ 0xAE, 1, 0, 1,  false,  "compare"},
-	&Instruction{ 0xAF, 0, 0, 1,  false,  "string_to_arg_a"},
-
-	&Instruction{ 0xB0, 1, 0, 16, false, "arg_a_to_string"},
-	&Instruction{ 0xB1, 1, 0, 16, false, "to_hex_string"},
-
-	// Reads the mic bit on $4016 and puts it on the stack
-	&Instruction{ 0xB2, 0, 0, 1,  false,  "read_mic"},
-
-	&Instruction{ 0xB3, 7, 0, 0,  false,  ""}, // possible 16-bit inline?
-
-	// If ($471A) is > #$60, copy to ($4E).  Setup for some other bullshit?
-	&Instruction{ 0xB4, 0, 0, 0,  false,  "indirect_copy_471A_4E"},
-
-	// Uses value at $471A as the source pointer (after copied into ArgumentA)
-	// and $4E as the destination pointer to copy a null-terminated string.
-	// Will break if the string is more than 256 bytes long (incl NULL byte).
-	// The value at $471A will be incremented by the number of bytes copied.
-	&Instruction{ 0xB5, 0, 0, 0,  false,  "string_copy"},
-
-	// find a better name for this one.
-	&Instruction{ 0xB6, 0, 0, 0,  false,  "word4E_to_word471A"},
-
-	// Uses the inline word as a pointer, and pushes the byte value at that
-	// address to the stack.
-	&Instruction{ 0xB7, 0, 2, 0,  false,  "push_var"},
-
-	// Pushes the inline word to the stack
-	&Instruction{ 0xB8, 0, 2, 0,  true,  "push_word"},
-
-	// Pushes value at (inline address + word offset in stack)
-	&Instruction{ 0xB9, 0, 2, 0,  false, "push_var_indexed"},
-
-	// Pushes data using inline value as pointer.  Always reads 32 bytes at the
-	// address given.
-	&Instruction{ 0xBA, 0, 2, 0,  false, "push_data_indirect"},
-
-	// Pushes inline null terminated data to the stack.  Max of 32 bytes.
-	// Increments the stack pointer by 32 *always*, regardless of data size.
-	&Instruction{ 0xBB, 0, -1, 0, false, "push_data"},
-
-	&Instruction{ 0xBC, 0, 2, 0,  false, "push_string_from_table"},
-
-	// Pops a byte off the stack and stores it at the inline address.
-	&Instruction{ 0xBD, 0, 2, 0,  false,  "pop_into"},
-
-	&Instruction{ 0xBE, 0, 2, 0,  false,  "write_to_table"},
-	&Instruction{ 0xBF, 0, 2, 0,  false,  "jump_not_zero"},
-
-	// One byte off stack; jumps to inline if byte is zero
-	&Instruction{ 0xC0, 1, 2, 0,  false,  "jump_zero"},
-	&Instruction{ 0xC1, 1, -2, 0, false,  "jump_switch"},
-	&Instruction{ 0xC2, 1, 0, 1,  false,  "equals_zero"},
-	&Instruction{ 0xC3, 2, 0, 1,  false,  "and_a_b"},
-	&Instruction{ 0xC4, 2, 0, 1,  false,  "or_a_b"},
-	&Instruction{ 0xC5, 2, 0, 1,  false,  "equal"},
-
-	// Two bytes off stack; result pushed back; 1 if A == B, 0 if A != B
-	&Instruction{ 0xC6, 2, 0, 1,  false,  "not_equal"},
-
-	&Instruction{ 0xC7, 2, 0, 1,  false,  "less_than"},
-	&Instruction{ 0xC8, 2, 0, 1,  false,  "less_than_equal"},
-	&Instruction{ 0xC9, 2, 0, 1,  false,  "greater_than"},
-	&Instruction{ 0xCA, 2, 0, 1,  false,  "greater_than_equal"},
-	&Instruction{ 0xCB, 2, 0, 1,  false,  "sum"},
-	&Instruction{ 0xCC, 2, 0, 1,  false,  "subtract"},
-	&Instruction{ 0xCD, 2, 0, 1,  false,  "multiply"},
-	&Instruction{ 0xCE, 2, 0, 1,  false,  "signed_divide"},
-	&Instruction{ 0xCF, 1, 0, 1,  false,  "negate"},
-
-	&Instruction{ 0xD0, 1, 0, 1,  false,  "modulus"},
-	&Instruction{ 0xD1, 2, 0, 1,  false,  "expansion_controller"},
-	&Instruction{ 0xD2, 2, 0, 1,  false,  ""},
-	&Instruction{ 0xD3, 2, 0, 16, false,  ""},
-	&Instruction{ 0xD4, 3, 0, 0,  false,  "set_cursor_location"},
-
-	// Wait for ArgA itterations.  "itterations" is undefined as of now. (data from tape?)
-	&Instruction{ 0xD5, 1, 0, 0,  false,  "wait_for_tape"},
-
-	&Instruction{ 0xD6, 1, 0, 16, false,  "truncate_string"},
-	&Instruction{ 0xD7, 1, 0, 16, false,  "trim_string"},
-
-	// ArgA is number of bytes to trim.
-	// ArgB is length of string.  0xD8 sets this to 32.
-	&Instruction{ 0xD8, 1, 0, 16, false,  "trim_string_start_32"},
-	&Instruction{ 0xD9, 2, 0, 16, false,  "trim_string_start"},
-
-	&Instruction{ 0xDA, 1, 0, 16, false,  "to_int_string"},
-	&Instruction{ 0xDB, 3, 0, 0,  false,  ""},
-	&Instruction{ 0xDC, 5, 0, 0,  false,  ""}, // fucks with attribute data
-
-	// ArgA, ArgB: X,Y of corner A
-	// ArgC, ArgD: X,Y of corner B
-	// ArgE: fill value.  This is an index into
-	//       the table at $B451.
-	// Fills a box with a tile
-	&Instruction{ 0xDD, 5, 0, 0,  false,  "fill_box"},
+type Instruction struct {
+	Opcode    byte
+	ArgCount  int  // stack arguments
+	StrCount  int  // strings on the stack after the arguments, copied by the handler
+	ArgEnums  []string // enum name for each stack argument
+	Operands  []OperandType // inline operands
+	RetCount  int  // return count
+	Name      string
 
-	&Instruction{ 0xDE, 3, 0, 0,  false,  ""},
+	Title       string // human readable name used in the docs
+	StackNote   string // extra info about the stack arguments
+	Description string
+	Vars        []string // engine variables used by the handler
+}
 
-	// ArgA: ??
-	// ArgB: X (tile coords)
-	// ArgC: Y (tile coords)
-	// Draws an image on top of the background using data already
-	// loaded from *somewhere*. (seen using data from tape)
-	&Instruction{ 0xDF, 3, 0, 0,  false,  "draw_image"},
+func (i Instruction) String() string {
+	if i.Name != "" {
+		//return fmt.Sprintf("$%02X_%s", i.Opcode, i.Name)
+		return i.Name
+	}
 
-	// Divide and return remainder
-	&Instruction{ 0xE0, 2, 0, 1,  false,  "modulo"},
+	return fmt.Sprintf("unknown_0x%02X", i.Opcode)
+	//return "unknown"
+}
 
-	&Instruction{ 0xE1, 4, 0, 0,  false,  ""},
+type JsonInstruction struct {
+	Opcode      string // hex string, eg "0x80"
+	Name        string
+	Title       string   `json:",omitempty"`
+	StackArgs   int
+	StackStrings int     `json:",omitempty"`
+	ArgEnums    []string `json:",omitempty"`
+	StackNote   string   `json:",omitempty"`
+	Operands    []string
+	Returns     int
+	Vars        []string `json:",omitempty"`
+	Description []string `json:",omitempty"`
+}
 
-	// ArgA: Palette ID
-	// ArgB: FG palette index
-	// ArgC: BG palette index
-	// ArgD: Priority (something else too?)
-	// ArgE: X coord
-	// ArgF: Y coord
-	// ArgG: ??
-	&Instruction{ 0xE2, 7, 0, 0,  false,  "setup_sprite"},
+func (ji JsonInstruction) Instruction() (*Instruction, error) {
+	op, err := strconv.ParseUint(ji.Opcode, 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid opcode: %q", ji.Opcode)
+	}
 
-	// Pops a word off the stack, uses it as a pointer, and pushes the byte
-	// value at that address to the stack.
-	&Instruction{ 0xE3, 1, 0, 1,  false,  "deref_ptr_stack"},
-	&Instruction{ 0xE4, 2, 0, 0,  false,  "swap_ram_bank"},
-	&Instruction{ 0xE5, 1, 0, 0,  false,  "disable_sprite"},
+	if op < 0x80 {
+		return nil, fmt.Errorf("Opcode out of range: %q", ji.Opcode)
+	}
 
-	// Will call 0x82 tape_nmi_shenanigans if $0740 != 0
-	&Instruction{ 0xE6, 1, 0, 0,  false,  "tape_nmi_setup"},
+	operands := []OperandType{}
+	for _, o := range ji.Operands {
+		ot, err := ParseOperandType(o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ji.Opcode, err)
+		}
+		operands = append(operands, ot)
+	}
 
-	&Instruction{ 0xE7, 7, 0, 0,  false,  "draw_metasprite"},
-	&Instruction{ 0xE8, 1, 0, 0,  false,  "setup_tape_nmi"},
-	&Instruction{ 0xE9, 0, 1, 0,  false,  "setup_loop"},
-	&Instruction{ 0xEA, 0, 2, 0,  false,  "string_write_to_table"},
+	return &Instruction{
+		Opcode: byte(op),
+		ArgCount: ji.StackArgs,
+		StrCount: ji.StackStrings,
+		ArgEnums: ji.ArgEnums,
+		Operands: operands,
+		RetCount: ji.Returns,
+		Name: ji.Name,
+		Title: ji.Title,
+		StackNote: ji.StackNote,
+		Description: strings.Join(ji.Description, "\n"),
+		Vars: ji.Vars,
+	}, nil
+}
 
-	// Reads and saves tiles from the PPU, then draws over them.
-	// This is used to draw dialog boxes, so saving what it overwrites
-	// so it can re-draw them later makes sense.
-	// Not sure what the arguments actually mean.
-	// ArgB and ArgC are probably coordinates.
-	&Instruction{ 0xEB, 4, 0, 0,  false,  "draw_overlay"},
+// LoadInstructionsFile reads an instruction table from a file and merges it
+// into the current one.  See LoadInstructions.
+func LoadInstructionsFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	&Instruction{ 0xEC, 2, 0, 0,  false,  "scroll"},
-	&Instruction{ 0xED, 1, 0, 0,  false,  "disable_sprites"},
+	return LoadInstructions(file)
+}
 
-	&Instruction{ 0xEE, 1, -3, 0, false,  "call_switch"},
+// LoadInstructions reads an instruction table in the same format as the
+// built-in instructions.json.  Entries replace existing instructions with the
+// same opcode, so a local file only needs to contain the instructions that
+// differ from the built-in table.
+func LoadInstructions(r io.Reader) error {
+	list := []JsonInstruction{}
+	dec := json.NewDecoder(r)
+	err := dec.Decode(&list)
+	if err != nil {
+		return err
+	}
 
-	// Draw string as sprites
-	// ArgA: Palette ID
-	// ArgB: FG palette index
-	// ArgC: BG palette index
-	// ArgD: Priority (something else too?)
-	// ArgE: X coord
-	// ArgF: Y coord
-	// THIS WORD WRAPS APPARENTLY?????
-	// Duplicate tiles are ignored and not displayed.  However, space is left
-	// for them as if they were.  Word wrapping adds 17 to the Y offset.
-	&Instruction{ 0xEF, 6, 0, 0,  false,  "draw_debug_sprites"},
+	loaded := []*Instruction{}
+	for _, ji := range list {
+		instr, err := ji.Instruction()
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, instr)
+	}
 
-	&Instruction{ 0xF0, 0, 0, 0,  false,  "disable_sprites"},
-	&Instruction{ 0xF1, 4, 0, 0,  false,  ""},
-	&Instruction{ 0xF2, 0, 0, 0,  false,  "halt"},
-	&Instruction{ 0xF3, 0, 0, 0,  false,  "halt"},
-	&Instruction{ 0xF4, 0, 0, 16, false,  "halt"},
-	&Instruction{ 0xF5, 1, 0, 1,  false,  "halt"},
-	&Instruction{ 0xF6, 1, 0, 0,  false,  "halt"},
-	&Instruction{ 0xF7, 0, 0, 0,  false,  "halt"},
-	&Instruction{ 0xF8, 2, 0, 0,  false,  "halt"},
-	&Instruction{ 0xF9, 0, 0, 1,  false,  ""},
-	&Instruction{ 0xFA, 0, 0, 1,  false,  ""},
-	&Instruction{ 0xFB, 1, 0, 0,  false,  "jump_arg_a"},
-	&Instruction{ 0xFC, 2, 0, 1,  false,  ""},
-	&Instruction{ 0xFD, 0, 0, 16, false,  "halt"},
-	&Instruction{ 0xFE, 4, 2, 0,  false,  "draw_rom_char"},
+	for _, instr := range loaded {
+		InstrMap[instr.Opcode] = instr
+	}
 
-	// code handler is $FFFF
-	&Instruction{ 0xFF, 0, 0, 0,  false,  "break_engine"},
-}
+	Instructions = []*Instruction{}
+	for op := 0x80; op <= 0xFF; op++ {
+		if instr, ok := InstrMap[byte(op)]; ok {
+			Instructions = append(Instructions, instr)
+		}
+	}
 
-type Instruction struct {
-	Opcode    byte
-	ArgCount  int  // stack arguments
-	OpCount   int  // inline operands.  length in bytes.
-				   // -1: nul-terminated
-				   // -2: first byte is count, followed by that number of words
-				   // -3: like -2, but with no default.  code continues after list on OOB
-	RetCount  int  // return count
-	InlineImmediate bool // don't turn the inline value into a variable
-	Name      string
+	return nil
 }
 
-func (i Instruction) String() string {
-	if i.Name != "" {
-		//return fmt.Sprintf("$%02X_%s", i.Opcode, i.Name)
-		return i.Name
+// InstructionByName returns the instruction with the given mnemonic.
+// Unnamed instructions can be found with their "unknown_0x??" name.
+func InstructionByName(name string) (*Instruction, bool) {
+	for _, instr := range Instructions {
+		if instr.String() == name {
+			return instr, true
+		}
 	}
-
-	return fmt.Sprintf("unknown_0x%02X", i.Opcode)
-	//return "unknown"
+	return nil, false
 }
-
@@ -0,0 +1,228 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+// JsonScript is the JSON form of a parsed script, for tools that would
+// otherwise scrape the text disassembly.  Addresses are hex strings like the
+// label and CDL files.  Tokens and blocks are sorted by address.
+type JsonScript struct {
+	StartAddress string
+	StackAddress string
+	Bank         *int `json:",omitempty"` // WRAM bank, if known
+
+	Warnings []string
+	Labels   []JsonLabel
+	Tokens   []JsonToken
+	Blocks   []JsonBlock
+}
+
+// JsonToken is an instruction, or a single byte of data.  Native is set for
+// 6502 instructions, whose operand type is the addressing mode.
+type JsonToken struct {
+	Address  string
+	Bytes    string // every byte of the token in hex
+	Opcode   string        `json:",omitempty"`
+	Mnemonic string        `json:",omitempty"`
+	Native   bool          `json:",omitempty"`
+	Operands []JsonOperand `json:",omitempty"`
+	Label    string        `json:",omitempty"`
+	Data     bool          `json:",omitempty"`
+
+	CDL      string   // CODE, DATA or UNKN
+	CDLFlags []string `json:",omitempty"`
+
+	Xrefs []JsonXref `json:",omitempty"`
+}
+
+// JsonOperand is one inline operand.  Type is the operand type from the
+// instruction table.  A string operand has its bytes in Data, without the
+// null, and Text if it can be read with the character table.
+type JsonOperand struct {
+	Type   string
+	Value  int
+	Label  string `json:",omitempty"`
+	Symbol string `json:",omitempty"`
+	Text   string `json:",omitempty"`
+	Data   string `json:",omitempty"`
+}
+
+type JsonBlock struct {
+	Start      string
+	End        string
+	Label      string `json:",omitempty"`
+	Successors []string
+}
+
+func jsonAddr(addr int) string {
+	return fmt.Sprintf("0x%X", addr)
+}
+
+// Json returns the JSON form of the script.
+func (s *Script) Json() JsonScript {
+	js := JsonScript{
+		StartAddress: jsonAddr(s.StartAddress),
+		StackAddress: jsonAddr(s.StackAddress),
+		Warnings: slices.Clone(s.Warnings),
+		Labels: []JsonLabel{},
+		Tokens: []JsonToken{},
+		Blocks: []JsonBlock{},
+	}
+
+	if s.CDL != nil && s.CDL.Bank != nil {
+		bank := *s.CDL.Bank
+		js.Bank = &bank
+	}
+
+	if js.Warnings == nil {
+		js.Warnings = []string{}
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(s.Labels)) {
+		js.Labels = append(js.Labels, s.Labels[addr].JsonLabel())
+	}
+
+	tokens := slices.Clone(s.Tokens)
+	slices.SortStableFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	for _, t := range tokens {
+		js.Tokens = append(js.Tokens, s.jsonToken(t))
+	}
+
+	for _, bb := range s.BasicBlocks() {
+		jb := JsonBlock{
+			Start: jsonAddr(bb.Start),
+			End: jsonAddr(bb.End),
+			Successors: []string{},
+		}
+		if lbl, ok := s.Labels[bb.Start]; ok {
+			jb.Label = lbl.Name
+		}
+		for _, addr := range bb.Successors {
+			jb.Successors = append(jb.Successors, jsonAddr(addr))
+		}
+		js.Blocks = append(js.Blocks, jb)
+	}
+
+	return js
+}
+
+func (s *Script) jsonToken(t *Token) JsonToken {
+	jt := JsonToken{
+		Address: jsonAddr(t.Offset),
+		Data: t.IsData,
+		CDL: cdlUnknown.String(),
+	}
+
+	raw := []byte{t.Raw}
+	if (t.Instruction != nil && !t.IsData) || t.Native != nil {
+		for _, v := range t.Inline {
+			raw = append(raw, v.Bytes()...)
+		}
+	}
+	jt.Bytes = fmt.Sprintf("%X", raw)
+
+	if lbl, ok := s.Labels[t.Offset]; ok {
+		jt.Label = lbl.Name
+	}
+
+	if s.CDL != nil {
+		bit := s.CDL.get(t.Offset)
+		jt.CDL = bit.String()
+		jt.CDLFlags = bit.flags()
+	}
+
+	for _, x := range t.Xrefs {
+		jt.Xrefs = append(jt.Xrefs, JsonXref{
+			Source: jsonAddr(x.Source),
+			Type: x.Type.String(),
+			Instruction: x.mnemonic(),
+		})
+	}
+
+	if t.Native != nil {
+		jt.Opcode = fmt.Sprintf("0x%02X", t.Raw)
+		jt.Mnemonic = t.Native.Name
+		jt.Native = true
+
+		if len(t.Inline) > 0 {
+			op := JsonOperand{
+				Type: t.Native.Mode.String(),
+				Value: t.Inline[0].Int(),
+			}
+			if addr, ok := t.NativeTarget(); ok {
+				op.Value = addr
+				if lbl, ok := s.Labels[addr]; ok {
+					op.Label = lbl.Name
+				}
+			}
+			jt.Operands = append(jt.Operands, op)
+		}
+		return jt
+	}
+
+	if t.Instruction == nil || t.IsData {
+		return jt
+	}
+
+	jt.Opcode = fmt.Sprintf("0x%02X", t.Raw)
+	jt.Mnemonic = t.Instruction.String()
+
+	types := t.InlineTypes()
+	str := []byte{}
+	for i, v := range t.Inline {
+		if types[i] == OperandString {
+			str = append(str, v.Bytes()...)
+			continue
+		}
+
+		op := JsonOperand{
+			Type: types[i].String(),
+			Value: v.Int(),
+		}
+
+		if lbl, ok := s.Labels[v.Int()]; ok && types[i].IsAddress() {
+			op.Label = lbl.Name
+		} else if t.Label != "" && !types[i].IsAddress() {
+			op.Label = t.Label
+		} else if t.Symbol != "" && !types[i].IsAddress() {
+			op.Symbol = t.Symbol
+		}
+		jt.Operands = append(jt.Operands, op)
+	}
+
+	if t.Instruction.HasOperand(OperandString) {
+		if len(str) > 0 && str[len(str)-1] == 0x00 {
+			str = str[:len(str)-1]
+		}
+
+		op := JsonOperand{
+			Type: OperandString.String(),
+			Data: fmt.Sprintf("%X", str),
+		}
+		if text, ok := CharTable.StringText(str); ok {
+			op.Text = text
+		}
+		jt.Operands = append(jt.Operands, op)
+	}
+
+	return jt
+}
+
+// WriteJson writes the script as JSON.  See JsonScript.
+func (s *Script) WriteJson(w io.Writer) error {
+	raw, err := json.MarshalIndent(s.Json(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
@@ -0,0 +1,362 @@
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// Label file formats from emulators and assemblers.
+const (
+	LabelsJson  = "json" // this project's own format
+	LabelsMesen = "mlb"  // Mesen
+	LabelsFceux = "nl"   // FCEUX RAM labels (<rom>.ram.nl)
+	LabelsCa65  = "dbg"  // ca65/ld65 debug info
+	LabelsVice  = "sym"  // ld65 -Ln (VICE) label file
+)
+
+// LabelFormatFromFilename picks a label format based on the file extension.
+func LabelFormatFromFilename(filename string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	switch ext {
+	case LabelsJson, LabelsMesen, LabelsFceux, LabelsCa65, LabelsVice:
+		return ext, nil
+	}
+	return "", fmt.Errorf("unknown label file format: %q", filepath.Ext(filename))
+}
+
+// Work RAM is banked in $6000-$7FFF.  Emulators address it as an offset into
+// all of work RAM.
+func wramOffset(bank, addr int) (int, bool) {
+	if addr < 0x6000 || addr > 0x7FFF {
+		return 0, false
+	}
+	return bank*0x2000 + (addr-0x6000), true
+}
+
+func wramAddress(offset int) (bank, addr int) {
+	return offset / 0x2000, 0x6000 + offset%0x2000
+}
+
+func (s *Script) ImportLabelsFile(filename string) error {
+	format, err := LabelFormatFromFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.ImportLabels(file, format)
+}
+
+// ImportLabels reads labels in the given format and adds them to the script.
+// Labels for other work RAM banks are ignored.  Labels with a bank qualified
+// (far) address in the ca65 formats get FarLabel set.
+func (s *Script) ImportLabels(r io.Reader, format string) error {
+	var labels []*Label
+	var err error
+
+	switch format {
+	case LabelsJson:
+		return s.LabelsFromJson(r)
+	case LabelsMesen:
+		labels, err = s.readMesenLabels(r)
+	case LabelsFceux:
+		labels, err = readFceuxLabels(r)
+	case LabelsCa65:
+		labels, err = s.readCa65Labels(r)
+	case LabelsVice:
+		labels, err = s.readViceLabels(r)
+	default:
+		return fmt.Errorf("unknown label file format: %q", format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if s.Labels == nil {
+		s.Labels = make(map[int]*Label)
+	}
+
+	for _, l := range labels {
+		s.Labels[l.Address] = l
+	}
+	return nil
+}
+
+func (s *Script) ExportLabelsFile(filename string) error {
+	format, err := LabelFormatFromFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.ExportLabels(file, format)
+}
+
+// ExportLabels writes the script's labels in the given format.  Work RAM
+// addresses are written with the script's bank.
+func (s *Script) ExportLabels(w io.Writer, format string) error {
+	if format == LabelsJson {
+		return s.WriteLabels(w)
+	}
+
+	lines := []string{}
+	if format == LabelsCa65 {
+		lines = append(lines, "version\tmajor=2,minor=0")
+	}
+
+	for i, addr := range slices.Sorted(maps.Keys(s.Labels)) {
+		lbl := s.Labels[addr]
+		comment := strings.ReplaceAll(lbl.Comment, "\n", " ")
+
+		switch format {
+		case LabelsMesen:
+			line := ""
+			if off, ok := wramOffset(s.Bank, addr); ok {
+				line = fmt.Sprintf("W:%04X:%s", off, lbl.Name)
+			} else if addr < 0x2000 {
+				line = fmt.Sprintf("R:%04X:%s", addr & 0x7FF, lbl.Name)
+			} else {
+				line = fmt.Sprintf("G:%04X:%s", addr, lbl.Name)
+			}
+
+			if lbl.Comment != "" {
+				line += ":"+strings.ReplaceAll(lbl.Comment, "\n", "\\n")
+			}
+			lines = append(lines, line)
+
+		case LabelsFceux:
+			lines = append(lines, fmt.Sprintf("$%04X#%s#%s", addr, lbl.Name, comment))
+
+		case LabelsCa65:
+			// Comments without a label can't be symbols.
+			if lbl.Name == "" {
+				continue
+			}
+
+			size := "absolute"
+			val := addr
+			if lbl.FarLabel {
+				size = "far"
+				val = (s.Bank << 16) | addr
+			}
+			lines = append(lines, fmt.Sprintf("sym\tid=%d,name=%q,addrsize=%s,val=0x%X,type=lab",
+				i, lbl.Name, size, val))
+
+		case LabelsVice:
+			if lbl.Name == "" {
+				continue
+			}
+
+			val := addr
+			if lbl.FarLabel {
+				val = (s.Bank << 16) | addr
+			}
+			lines = append(lines, fmt.Sprintf("al %06X .%s", val, lbl.Name))
+
+		default:
+			return fmt.Errorf("unknown label file format: %q", format)
+		}
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// Mesen: TYPE:ADDRESS[-END]:NAME[:COMMENT]
+func (s *Script) readMesenLabels(r io.Reader) ([]*Label, error) {
+	labels := []*Label{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 4)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("line %d: invalid mlb line: %q", num, line)
+		}
+
+		addrStr, _, _ := strings.Cut(parts[1], "-")
+		val, err := strconv.ParseInt(addrStr, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address: %q", num, parts[1])
+		}
+
+		addr := int(val)
+		switch parts[0] {
+		case "R", "G":
+			// CPU addresses
+		case "W", "S":
+			bank, a := wramAddress(addr)
+			if bank != s.Bank {
+				continue
+			}
+			addr = a
+		default:
+			// ROM labels don't mean anything in a script
+			continue
+		}
+
+		// Mesen allows comments without a name
+		if parts[2] == "" && len(parts) < 4 {
+			continue
+		}
+
+		lbl := NewLabel(addr, parts[2])
+		if len(parts) == 4 {
+			lbl.Comment = strings.ReplaceAll(parts[3], "\\n", "\n")
+		}
+		labels = append(labels, lbl)
+	}
+
+	return labels, scanner.Err()
+}
+
+// FCEUX: $ADDR#NAME#COMMENT
+func readFceuxLabels(r io.Reader) ([]*Label, error) {
+	labels := []*Label{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "#", 3)
+		if len(parts) < 2 || !strings.HasPrefix(parts[0], "$") {
+			return nil, fmt.Errorf("line %d: invalid nl line: %q", num, line)
+		}
+
+		// Arrays are given as "$ADDR/SIZE"
+		addrStr, _, _ := strings.Cut(parts[0][1:], "/")
+		val, err := strconv.ParseInt(addrStr, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address: %q", num, parts[0])
+		}
+
+		lbl := NewLabel(int(val), parts[1])
+		if len(parts) == 3 {
+			lbl.Comment = parts[2]
+		}
+		labels = append(labels, lbl)
+	}
+
+	return labels, scanner.Err()
+}
+
+// bankedLabel makes a label from a ca65 value that may have a bank in the
+// upper byte.  Returns nil if the label is for another bank.
+func (s *Script) bankedLabel(val int, name string, far bool) *Label {
+	addr := val & 0xFFFF
+	bank := val >> 16
+	if (far || bank != 0) && bank != s.Bank {
+		return nil
+	}
+
+	lbl := NewLabel(addr, name)
+	lbl.FarLabel = far || bank != 0
+	return lbl
+}
+
+// ca65 debug info: only the sym lines are used.
+func (s *Script) readCa65Labels(r io.Reader) ([]*Label, error) {
+	labels := []*Label{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		kind, rest, ok := strings.Cut(line, "\t")
+		if !ok || kind != "sym" {
+			continue
+		}
+
+		fields := make(map[string]string)
+		for _, kv := range strings.Split(rest, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			fields[k] = v
+		}
+
+		if fields["type"] != "lab" || fields["val"] == "" {
+			continue
+		}
+
+		name, err := strconv.Unquote(fields["name"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid name: %s", num, fields["name"])
+		}
+
+		val, err := strconv.ParseInt(fields["val"], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value: %s", num, fields["val"])
+		}
+
+		if lbl := s.bankedLabel(int(val), name, fields["addrsize"] == "far"); lbl != nil {
+			labels = append(labels, lbl)
+		}
+	}
+
+	return labels, scanner.Err()
+}
+
+// VICE label file from ld65 -Ln: al ADDRESS .NAME
+func (s *Script) readViceLabels(r io.Reader) ([]*Label, error) {
+	labels := []*Label{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	for scanner.Scan() {
+		num++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 || fields[0] != "al" {
+			return nil, fmt.Errorf("line %d: invalid sym line: %q", num, scanner.Text())
+		}
+
+		val, err := strconv.ParseInt(fields[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address: %q", num, fields[1])
+		}
+
+		// Local labels from ld65 start with "@" and aren't unique
+		name := strings.TrimPrefix(fields[2], ".")
+		if strings.HasPrefix(name, "@") || strings.HasPrefix(name, "__") {
+			continue
+		}
+
+		if lbl := s.bankedLabel(int(val), name, false); lbl != nil {
+			labels = append(labels, lbl)
+		}
+	}
+
+	return labels, scanner.Err()
+}
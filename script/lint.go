@@ -0,0 +1,216 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Lint checks
+const (
+	LintUnreachable    = "unreachable"     // bytes between code that nothing reaches
+	LintMidInstruction = "mid-instruction" // jump into the operands of an instruction
+	LintOutsideSegment = "outside-segment" // jump or call outside of the script
+	LintInvalidOpcode  = "invalid-opcode"  // unknown or invalid opcode in code
+	LintHalt           = "halt"            // halt instruction in reachable code
+	LintEmptySwitch    = "empty-switch"    // switch table without any entries
+)
+
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+type LintIssue struct {
+	Address  int
+	Severity string
+	Check    string
+	Message  string
+}
+
+func (li LintIssue) String() string {
+	return fmt.Sprintf("$%04X: %s: %s: %s", li.Address, li.Severity, li.Check, li.Message)
+}
+
+type JsonLintIssue struct {
+	Address  string
+	Severity string
+	Check    string
+	Message  string
+}
+
+// Lint looks for suspicious things in a decoded script.  The halt and
+// unreachable checks need to know what code is reachable, so they are only
+// done for scripts from SmartParse.
+func (s *Script) Lint() []*LintIssue {
+	issues := []*LintIssue{}
+	add := func(addr int, severity, check, format string, args ...any) {
+		issues = append(issues, &LintIssue{
+			Address: addr,
+			Severity: severity,
+			Check: check,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	tokens := slices.Clone(s.Tokens)
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	tokenMap := make(map[int]*Token)
+	for _, t := range tokens {
+		tokenMap[t.Offset] = t
+	}
+
+	start := s.StartAddress+2
+	end := s.StartAddress+s.origSize
+
+	var prev *Token
+	for _, t := range tokens {
+		if t.IsData {
+			continue
+		}
+
+		// SmartParse decodes both sides of a jump into an instruction.  Only
+		// report the branch target, not everything decoded after it.
+		_, isTarget := s.Labels[t.Offset]
+		if prev != nil && isTarget && t.Offset < prev.Offset+prev.Size() {
+			add(t.Offset, LintError, LintMidInstruction,
+				"code at $%04X overlaps the instruction at $%04X", t.Offset, prev.Offset)
+		}
+		if prev == nil || t.Offset+t.Size() > prev.Offset+prev.Size() {
+			prev = t
+		}
+
+		if t.Native != nil {
+			continue
+		}
+
+		if t.Instruction == nil {
+			// Bytes below 0x80 are only flagged when they're known to be
+			// code, ie from SmartParse.
+			if s.CDL != nil && s.CDL.IsCode(t.Offset) {
+				add(t.Offset, LintError, LintInvalidOpcode, "$%02X is not an instruction", t.Raw)
+			}
+			continue
+		}
+
+		if t.Instruction.Name == "" {
+			add(t.Offset, LintError, LintInvalidOpcode, "unknown instruction %s", t.Instruction)
+		}
+
+		if s.smart && (t.Instruction.Name == "halt" || strings.HasPrefix(t.Instruction.Name, "halt_")) {
+			add(t.Offset, LintWarning, LintHalt, "%s in reachable code", t.Instruction.Name)
+		}
+
+		if t.Instruction.HasOperand(OperandCodeTable) && (len(t.Inline) == 0 || t.Inline[0].Int() == 0) {
+			add(t.Offset, LintError, LintEmptySwitch, "%s has no entries", t.Instruction.Name)
+		}
+
+		types := t.InlineTypes()
+		for i, v := range t.Inline {
+			if types[i] != OperandCodeAddr {
+				continue
+			}
+
+			target := v.Int()
+			if target < start || target >= end {
+				add(t.Offset, LintWarning, LintOutsideSegment,
+					"%s target $%04X is outside of the script ($%04X-$%04X)",
+					t.Instruction.Name, target, start, end-1)
+				continue
+			}
+
+			if _, ok := tokenMap[target]; !ok {
+				add(t.Offset, LintError, LintMidInstruction,
+					"%s target $%04X is inside an instruction", t.Instruction.Name, target)
+			}
+		}
+	}
+
+	// Runs of bytes that are neither code nor data, with code after them.
+	// Anything after the last code is left alone, it's usually variables and
+	// padding.
+	if s.smart && s.CDL != nil {
+		lastCode := -1
+		for _, t := range tokens {
+			if !t.IsData {
+				lastCode = t.Offset
+			}
+		}
+
+		runStart := -1
+		for _, t := range tokens {
+			unknown := t.IsData && t.Instruction == nil &&
+				!s.CDL.IsCode(t.Offset) && !s.CDL.IsData(t.Offset)
+
+			if unknown && runStart == -1 {
+				runStart = t.Offset
+			}
+
+			if !unknown && runStart != -1 {
+				if t.Offset < lastCode {
+					add(runStart, LintWarning, LintUnreachable,
+						"%d unreachable bytes at $%04X-$%04X", t.Offset-runStart, runStart, t.Offset-1)
+				}
+				runStart = -1
+			}
+		}
+	}
+
+	slices.SortStableFunc(issues, func(a, b *LintIssue) int {
+		return a.Address - b.Address
+	})
+	return issues
+}
+
+func WriteLintFile(filename string, issues []*LintIssue) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		return WriteLintJson(file, issues)
+	}
+	return WriteLint(file, issues)
+}
+
+// WriteLint writes one issue per line:
+//
+//	$6012: warning: halt: halt_F2 in reachable code
+func WriteLint(w io.Writer, issues []*LintIssue) error {
+	for _, li := range issues {
+		_, err := fmt.Fprintln(w, li)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteLintJson(w io.Writer, issues []*LintIssue) error {
+	out := []JsonLintIssue{}
+	for _, li := range issues {
+		out = append(out, JsonLintIssue{
+			Address: jsonAddr(li.Address),
+			Severity: li.Severity,
+			Check: li.Check,
+			Message: li.Message,
+		})
+	}
+
+	raw, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
@@ -0,0 +1,99 @@
+package script
+
+import (
+	"fmt"
+	"slices"
+)
+
+// OperandType describes what an inline operand of an instruction means.
+type OperandType int
+
+const (
+	OperandCodeAddr  OperandType = iota // word address of script code (jump/call target)
+	OperandDataAddr                     // word address of a variable or data
+	OperandImm8                         // byte constant
+	OperandImm16                        // word constant
+	OperandBank                         // byte RAM bank ID
+	OperandString                       // null terminated data
+	OperandCodeTable                    // count byte followed by that many code addresses
+	OperandAsmAddr                      // word address of 6502 code (call_asm target)
+)
+
+var operandTypeNames = map[OperandType]string{
+	OperandCodeAddr:  "code",
+	OperandDataAddr:  "data",
+	OperandImm8:      "imm8",
+	OperandImm16:     "imm16",
+	OperandBank:      "bank",
+	OperandString:    "string",
+	OperandCodeTable: "code_table",
+	OperandAsmAddr:   "asm",
+}
+
+func (ot OperandType) String() string {
+	if name, ok := operandTypeNames[ot]; ok {
+		return name
+	}
+	return fmt.Sprintf("OperandType(%d)", int(ot))
+}
+
+func ParseOperandType(s string) (OperandType, error) {
+	for ot, name := range operandTypeNames {
+		if name == s {
+			return ot, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid operand type: %q", s)
+}
+
+// Size returns the size of the operand in bytes, or -1 if the size is
+// variable.
+func (ot OperandType) Size() int {
+	switch ot {
+	case OperandImm8, OperandBank:
+		return 1
+	case OperandCodeAddr, OperandDataAddr, OperandImm16, OperandAsmAddr:
+		return 2
+	}
+	return -1
+}
+
+// IsAddress returns true if the operand should be resolved to a label.
+func (ot OperandType) IsAddress() bool {
+	return ot == OperandCodeAddr || ot == OperandDataAddr || ot == OperandAsmAddr
+}
+
+// InlineTypes returns the operand type of each value in Inline.  The count
+// byte of a code table is returned as OperandImm8.
+func (t Token) InlineTypes() []OperandType {
+	types := []OperandType{}
+	if t.Instruction == nil {
+		return types
+	}
+
+	for _, op := range t.Instruction.Operands {
+		switch op {
+		case OperandString:
+			for len(types) < len(t.Inline) {
+				types = append(types, OperandString)
+			}
+
+		case OperandCodeTable:
+			types = append(types, OperandImm8)
+			for len(types) < len(t.Inline) {
+				types = append(types, OperandCodeAddr)
+			}
+
+		default:
+			types = append(types, op)
+		}
+	}
+
+	return types[:min(len(types), len(t.Inline))]
+}
+
+// HasOperand returns true if the instruction has an inline operand of the
+// given type.
+func (i Instruction) HasOperand(ot OperandType) bool {
+	return slices.Contains(i.Operands, ot)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"errors"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/rom"
 )
 
 var (
@@ -39,7 +41,53 @@ func SmartParseFile(filename string, startAddr int, cdl *CodeDataLog) (*Script,
 	return SmartParse(rawfile, startAddr, cdl)
 }
 
+// ParseSegment parses a script segment taken from a ROM.  The start address
+// and bank come from the segment.
+func ParseSegment(seg *rom.DataSegment, cdl *CodeDataLog) (*Script, error) {
+	if seg.Type != "script" {
+		return nil, fmt.Errorf("segment is not a script: %s", seg.Type)
+	}
+
+	scr, err := Parse(seg.Data, seg.Address, cdl)
+	if scr != nil {
+		scr.Bank = seg.Bank
+		scr.CDL.SetBank(seg.Bank)
+	}
+	return scr, err
+}
+
+func SmartParseSegment(seg *rom.DataSegment, cdl *CodeDataLog) (*Script, error) {
+	if seg.Type != "script" {
+		return nil, fmt.Errorf("segment is not a script: %s", seg.Type)
+	}
+
+	scr, err := SmartParse(seg.Data, seg.Address, cdl)
+	if scr != nil {
+		scr.Bank = seg.Bank
+		scr.CDL.SetBank(seg.Bank)
+	}
+	return scr, err
+}
+
+// SmartParse follows the control flow of the script from its start and the
+// CDL's entry points.  Targets of jump_arg_a that are found by constant
+// propagation are added to the CDL as entry points and the script is parsed
+// again until nothing new turns up.
 func SmartParse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
+	for {
+		scr, err := smartParse(rawinput, startAddr, cdl)
+		if err != nil {
+			return scr, err
+		}
+
+		if !scr.propagateConstants() {
+			return scr, nil
+		}
+		cdl = scr.CDL
+	}
+}
+
+func smartParse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
 	if len(rawinput) < 3 {
 		return nil, fmt.Errorf("not enough bytes for script")
 	}
@@ -55,6 +103,7 @@ func SmartParse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, erro
 
 			CDL: cdl,
 			origSize: len(rawinput),
+			smart: true,
 		},
 
 		rawinput: rawinput,
@@ -79,6 +128,14 @@ func SmartParse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, erro
 
 	visited := make([]bool, len(p.rawinput))
 
+	// 6502 code from call_asm, and any that's already in the CDL
+	native := []int{}
+	for addr := startAddr+2; addr < startAddr+len(rawinput); addr++ {
+		if p.script.CDL.IsNative(addr) && p.script.CDL.IsOpCode(addr) {
+			native = append(native, addr)
+		}
+	}
+
 	for len(branches) > 0 {
 		st := branches[0]+startAddr
 		//fmt.Printf("start @ $%04X\n", st)
@@ -123,64 +180,49 @@ INNER:
 
 			//fmt.Println(token.String(map[int]*Label{}))
 
-			switch raw {
-			case 0x86, 0xAC, 0xAA, 0xFF, 0x81, 0x9B, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7, 0xF8, 0xFD: // return, long_return, long_jump, break_engine & halts
-				//fmt.Printf("[$%04X] %s\n",
-				//	token.Offset, token.Instruction.Name)
-				break INNER
-
-			case 0x84, 0xBF, 0xC0, 0x85: // jump_abs, jump_not_zero, jump_zero, call_abs
-				if len(token.Inline) < 1 {
-					return p.script, errors.Join(ErrNavigation,
-						fmt.Errorf("jump missing target"))
-				}
-
-				if len(token.Inline) > 1 {
-					return p.script, errors.Join(ErrNavigation,
-						fmt.Errorf("jump has too many targets"))
-				}
-
-				val := token.Inline[0].Int()
-				//fmt.Printf("[$%04X] %s $%04X\n",
-				//	token.Offset, token.Instruction.Name, val)
-				branches = append(branches, val-startAddr)
-				p.script.Labels[val] = AutoLabel(val)
-
-				if raw == 0x84 { // not jump_abs
-					break INNER
-				}
-
-			case 0xC1, 0xEE: // jump_switch, call_switch
-				if len(token.Inline) < 2 {
-					return p.script, errors.Join(ErrNavigation,
-						fmt.Errorf("switch missing targets"))
-				}
+			if token.Instruction.HasOperand(OperandCodeTable) && len(token.Inline) < 2 {
+				return p.script, errors.Join(ErrNavigation,
+					fmt.Errorf("switch missing targets"))
+			}
 
-				count := token.Inline[0].Int()
-				if len(token.Inline) != count+1 {
-					return p.script, errors.Join(ErrNavigation,
-						fmt.Errorf("switch target missmatch (expected %d, got %d)", count, len(token.Inline)-1))
+			if token.Instruction.HasOperand(OperandCodeTable) {
+				if err := checkSwitch(token, startAddr+2, startAddr+len(rawinput)); err != nil {
+					p.script.Warnings = append(p.script.Warnings,
+						fmt.Sprintf("Warning: %s ($%04X)", err, token.Offset))
 				}
+			}
 
-				for _, val := range token.Inline[1:] {
+			types := token.InlineTypes()
+			for i, val := range token.Inline {
+				addr := val.Int()
+				switch types[i] {
+				case OperandCodeAddr:
 					//fmt.Printf("[$%04X] %s $%04X\n",
-					//	token.Offset, token.Instruction.Name, val.Int())
-					branches = append(branches, val.Int()-startAddr)
-					p.script.Labels[val.Int()] = AutoLabel(val.Int())
-				}
-
-				if raw == 0xC1 { // jump_switch
-					break INNER
+					//	token.Offset, token.Instruction.Name, addr)
+					branches = append(branches, addr-startAddr)
+					p.script.Labels[addr] = AutoLabel(addr)
+					p.script.CDL.set(addr, cdlJumpTarget)
+
+				case OperandAsmAddr:
+					native = append(native, addr)
+					p.script.Labels[addr] = AutoLabel(addr)
+					p.script.CDL.set(addr, cdlJumpTarget)
+
+				case OperandDataAddr:
+					if _, ok := p.script.Labels[addr]; !ok {//&& addr >= startAddr {
+						p.script.Labels[addr] = AutoLabelVar(addr)
+					}
+					if !p.markTable(token, addr) {
+						p.script.CDL.set(addr, cdlData | cdlWord)
+						p.script.CDL.set(addr+1, cdlData | cdlWord)
+					}
 				}
 			}
 
-			if token.Instruction.OpCount == 2 && !token.Instruction.InlineImmediate {
-				val := token.Inline[0].Int()
-				if _, ok := p.script.Labels[val]; !ok {//&& val >= startAddr {
-					p.script.Labels[val] = AutoLabelVar(val)
-				}
-				p.script.CDL.setData(val)
-				p.script.CDL.setData(val+1)
+			if endsFlow(raw) {
+				//fmt.Printf("[$%04X] %s\n",
+				//	token.Offset, token.Instruction.Name)
+				break INNER
 			}
 		}
 
@@ -190,9 +232,11 @@ INNER:
 		branches = branches[1:]
 	}
 
+	p.parseNative(native, visited)
+
 	// Add data tokens
-	for addr := 0x6002; addr < len(rawinput)+0x6000; addr++ {
-		bit := p.script.CDL.cache[addr]
+	for addr := startAddr+2; addr < len(rawinput)+startAddr; addr++ {
+		bit := p.script.CDL.get(addr)
 
 		// ignore code bytes
 		if bit & cdlCode == cdlCode {
@@ -202,7 +246,8 @@ INNER:
 		if _, ok := p.script.Labels[addr]; ok {
 			p.script.Tokens = append(p.script.Tokens, &Token{
 				Offset: addr,
-				//Inline: []InlineVal{NewWordVal([]byte{rawinput[addr-0x6000], rawinput[addr+1-0x6000]})},
+				Raw: rawinput[addr-startAddr],
+				//Inline: []InlineVal{NewWordVal([]byte{rawinput[addr-startAddr], rawinput[addr+1-startAddr]})},
 				//IsVariable: true,
 				IsData: true,
 				cdl: bit.String(),
@@ -210,16 +255,31 @@ INNER:
 		} else {
 			p.script.Tokens = append(p.script.Tokens, &Token{
 				Offset: addr,
-				Raw: rawinput[addr-0x6000],
+				Raw: rawinput[addr-startAddr],
 				IsData: true,
 				cdl: bit.String(),
 			})
 		}
 	}
 
+	p.script.BuildXrefs()
+	p.script.AnnotateEnums()
 	return p.script, nil
 }
 
+// endsFlow returns true for instructions that never continue on to the next
+// instruction.
+func endsFlow(op byte) bool {
+	switch op {
+	case 0x86, 0xAC, 0xAA, 0xFF, 0x81, 0x9B, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7, 0xF8, 0xFD: // return, long_return, long_jump, break_engine & halts
+		return true
+
+	case 0x84, 0xC1, 0xFB: // jump_abs, jump_switch, jump_arg_a
+		return true
+	}
+	return false
+}
+
 func Parse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
 	if len(rawinput) < 3 {
 		return nil, fmt.Errorf("not enough bytes for script")
@@ -255,6 +315,16 @@ func Parse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
 
 		raw := p.rawinput[p.current]
 
+		// 6502 code marked in the CDL
+		if p.script.CDL.IsNative(p.current+startAddr) && p.script.CDL.IsOpCode(p.current+startAddr) {
+			if token, err := p.nativeToken(p.current); err == nil {
+				p.script.Tokens = append(p.script.Tokens, token)
+				tokenMap[token.Offset] = token
+				p.current += token.Size()-1
+				continue
+			}
+		}
+
 		token := &Token{
 			Offset: startAddr+p.current,
 			Raw: raw,
@@ -280,70 +350,56 @@ func Parse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
 
 	// Find and mark labels for a few instructions
 	for _, t := range p.script.Tokens {
+		if target, ok := t.NativeTarget(); ok && t.Native.Mode != ModeIndirect {
+			if _, ok := tokenMap[target]; ok {
+				if t.Native.IsBranch() {
+					p.script.Labels[target] = AutoLabel(target)
+				} else if _, ok := p.script.Labels[target]; !ok {
+					p.script.Labels[target] = AutoLabelVar(target)
+				}
+			}
+		}
+
 		if t.Instruction == nil {
 			continue
 		}
 
-		switch t.Raw {
-		case 0x84, 0x85, 0xBF, 0xC0: // jmp/call
-			if len(t.Inline) == 0 {
-				//return nil, fmt.Errorf("jump/call missing address ($%04X)", t.Offset)
+		isSwitch := t.Instruction.HasOperand(OperandCodeTable)
+		if isSwitch && len(t.Inline) < 2 {
+			//return nil, fmt.Errorf("jump/call switch missing addresses")
+			p.script.Warnings = append(p.script.Warnings,
+				fmt.Sprintf("jump/call switch missing addresses ($%04X)", t.Offset))
+			continue
+		}
+
+		if isSwitch {
+			if err := checkSwitch(t, p.startAddr+2, p.startAddr+len(p.rawinput)); err != nil {
 				p.script.Warnings = append(p.script.Warnings,
-					fmt.Sprintf("jump/call missing addresses ($%04X)", t.Offset))
-				continue
+					fmt.Sprintf("Warning: %s ($%04X)", err, t.Offset))
 			}
+		}
 
-			addr := t.Inline[0].Int()
-			found := false
-			for _, tok := range p.script.Tokens {
-				if tok.Offset == addr {
+		types := t.InlineTypes()
+		for i, v := range t.Inline {
+			addr := v.Int()
+			switch types[i] {
+			case OperandCodeAddr:
+				if tok, ok := tokenMap[addr]; ok {
 					tok.IsTarget = true
-					found = true
 					p.script.Labels[addr] = AutoLabel(addr) //fmt.Sprintf("L%04X", addr)
-					break
-				}
-			}
-
-			if !found {
-				p.script.Warnings = append(p.script.Warnings, fmt.Sprintf("Warning: no target found for jump/call at offset $%04X; value $%04X", t.Offset, addr))
-			}
-
-		case 0xC1, 0xEE: // switches
-			if len(t.Inline) < 2 {
-				//return nil, fmt.Errorf("jump/call switch missing addresses")
-				p.script.Warnings = append(p.script.Warnings,
-					fmt.Sprintf("jump/call switch missing addresses ($%04X)", t.Offset))
-				continue
-			}
-
-			for _, v := range t.Inline[1:] {
-				addr := v.Int()
-				found := false
-				for _, tok := range p.script.Tokens {
-					if tok.Offset == addr {
-						tok.IsTarget = true
-						found = true
-						p.script.Labels[addr] = AutoLabel(addr) //fmt.Sprintf("L%04X", addr)
-						break
-					}
-				}
-
-				if !found {
+				} else if isSwitch {
 					p.script.Warnings = append(p.script.Warnings, fmt.Sprintf("Warning: no target found for jump/call switch at offset $%04X; value: $%04X", t.Offset, addr))
+				} else {
+					p.script.Warnings = append(p.script.Warnings, fmt.Sprintf("Warning: no target found for jump/call at offset $%04X; value $%04X", t.Offset, addr))
 				}
-			}
 
-		default:
-			// if word arg, see if it's something in this script
-			if t.Instruction == nil {
-				//if t.IsData {
-				//	fmt.Print(",")
-				//}
-				continue
-			}
+			case OperandAsmAddr:
+				if _, ok := tokenMap[addr]; ok {
+					p.script.Labels[addr] = AutoLabel(addr)
+				}
 
-			if t.Instruction.OpCount == 2 && !t.Instruction.InlineImmediate {
-				addr := t.Inline[0].Int()
+			case OperandDataAddr:
+				// if it's something in this script
 				if _, ok := tokenMap[addr]; ok {
 					//tok.IsVariable = true
 					p.script.Labels[addr] = AutoLabelVar(addr) //fmt.Sprintf("Var_%04X", addr)
@@ -352,9 +408,24 @@ func Parse(rawinput []byte, startAddr int, cdl *CodeDataLog) (*Script, error) {
 		}
 	}
 
+	p.script.BuildXrefs()
+	p.script.AnnotateEnums()
 	return p.script, nil
 }
 
+// checkSwitch looks for a switch target outside of the script (start up to
+// end), which usually means the count at the start of the table is wrong.
+// Switches without targets are caught before this.
+func checkSwitch(t *Token, start, end int) error {
+	for _, val := range t.Inline[1:] {
+		addr := val.Int()
+		if addr < start || addr >= end {
+			return fmt.Errorf("switch target $%04X is outside of the script; is the count right?", addr)
+		}
+	}
+	return nil
+}
+
 func (p *Parser) parseToken(token *Token, raw byte) error {
 	op, ok := InstrMap[raw]
 	if !ok {
@@ -362,78 +433,66 @@ func (p *Parser) parseToken(token *Token, raw byte) error {
 			fmt.Errorf("OP 0x%02X not in instruction map", raw))
 	}
 	token.Instruction = op
+	p.script.CDL.set(p.current+p.startAddr, cdlCode | cdlOpCode)
 
 	args := []InlineVal{}
-	switch op.OpCount {
-	case -1: // null terminated
-		for ; p.current < len(p.rawinput); p.current++ {
-			p.script.CDL.setCode(p.current+p.startAddr)
-			val := ByteVal(p.rawinput[p.current])
-			args = append(args, val)
-			if p.rawinput[p.current] == 0x00 {
-				break
+	for _, ot := range op.Operands {
+		switch ot {
+		case OperandString: // null terminated
+			for p.current+1 < len(p.rawinput) {
+				p.current++
+				p.script.CDL.set(p.current+p.startAddr, cdlCode | cdlOperand | cdlString)
+				args = append(args, ByteVal(p.rawinput[p.current]))
+				if p.rawinput[p.current] == 0x00 {
+					break
+				}
 			}
-		}
 
-	case -2: // count then count words
-		// FIXME: wtf makes this different from -3??
-		p.current++
-
-		l :=  int(p.rawinput[p.current])
-		p.script.CDL.setCode(p.current+p.startAddr)
-		args = append(args, ByteVal(l))
-		p.current++
-
-		for c := 0; c < l; c++ {
+		case OperandCodeTable: // count then count words
 			if len(p.rawinput) <= p.current+1 {
 				return errors.Join(ErrEarlyEOF,
-					fmt.Errorf("OP early end at offset 0x%X (%d) {%d} %#v", p.current, p.current, l, op))
+					fmt.Errorf("OP early end at offset 0x%X (%d) %#v", p.current, p.current, op))
 			}
+			p.current++
 
-			args = append(args, WordVal([2]byte{p.rawinput[p.current], p.rawinput[p.current+1]}))
-			p.script.CDL.setCode(p.current+p.startAddr)
-			p.script.CDL.setCode(p.current+p.startAddr+1)
-			p.current+=2
-		}
-		p.current--
+			l :=  int(p.rawinput[p.current])
+			args = append(args, ByteVal(l))
+			p.script.CDL.set(p.current+p.startAddr, cdlCode | cdlOperand | cdlPointerTable)
 
-	case -3: // count then count words.  "default" is no call (skip Code_Pointer to after args)
-		p.current++
+			for c := 0; c < l; c++ {
+				if len(p.rawinput) <= p.current+2 {
+					return errors.Join(ErrEarlyEOF,
+						fmt.Errorf("OP early end at offset 0x%X (%d) {%d} %#v", p.current, p.current, l, op))
+				}
 
-		l :=  int(p.rawinput[p.current])
-		args = append(args, ByteVal(l))
-		p.script.CDL.setCode(p.current+p.startAddr)
-		p.current++
+				args = append(args, WordVal([2]byte{p.rawinput[p.current+1], p.rawinput[p.current+2]}))
+				p.script.CDL.set(p.current+p.startAddr+1, cdlCode | cdlOperand | cdlPointerTable | cdlWord)
+				p.script.CDL.set(p.current+p.startAddr+2, cdlCode | cdlOperand | cdlPointerTable | cdlWord)
+				p.current+=2
+			}
 
-		for c := 0; c < l; c++ {
-			if len(p.rawinput) <= p.current+1 {
+		default:
+			if len(p.rawinput) <= p.current+ot.Size() {
 				return errors.Join(ErrEarlyEOF,
-					fmt.Errorf("OP early end at offset 0x%X (%d) {%d} %#v", p.current, p.current, l, op))
+					fmt.Errorf("OP early end at offset 0x%X (%d) %#v", p.current, p.current, op))
 			}
 
-			args = append(args, WordVal([2]byte{p.rawinput[p.current], p.rawinput[p.current+1]}))
-			p.script.CDL.setCode(p.current+p.startAddr)
-			p.script.CDL.setCode(p.current+p.startAddr+1)
-			p.current+=2
-		}
-		p.current--
-
-	case 2:
-		args = append(args, WordVal([2]byte{p.rawinput[p.current+1], p.rawinput[p.current+2]}))
-		p.script.CDL.setCode(p.current+p.startAddr+1)
-		p.script.CDL.setCode(p.current+p.startAddr+2)
-		p.current+=2
-
-		//fmt.Printf("var at $%04X\n", val.Int())
-		//if val.Int() > p.startAddr && val.Int() < p.startAddr+len(p.rawinput) && p.earliestVar > val.Int() {
-		//	fmt.Printf("new earliest: $%04X\n", val.Int())
-		//	p.earliestVar = val.Int()
-		//}
+			if ot.Size() == 1 {
+				args = append(args, ByteVal(p.rawinput[p.current+1]))
+			} else {
+				args = append(args, WordVal([2]byte{p.rawinput[p.current+1], p.rawinput[p.current+2]}))
+			}
+
+			bit := cdlCode | cdlOperand
+			if ot.Size() == 2 {
+				bit |= cdlWord
+			}
 
-	case 1:
-		p.current++
-		p.script.CDL.setCode(p.current+p.startAddr)
-		args = append(args, ByteVal(p.rawinput[p.current]))
+			for i := 1; i <= ot.Size(); i++ {
+				p.script.CDL.set(p.current+p.startAddr+i, bit)
+			}
+			p.current += ot.Size()
+		}
 	}
 
 	token.Inline = args
@@ -0,0 +1,424 @@
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Patch modes
+const (
+	PatchInsert  = "insert"
+	PatchDelete  = "delete"
+	PatchReplace = "replace"
+)
+
+// Patch is one change to a script, read from a patch file.
+type Patch struct {
+	Mode   string
+	Label  string // label name or address
+	Count  int    // tokens to remove for delete and replace
+	Source string // assembly fragment for insert and replace
+
+	line int // line of the .patch directive
+}
+
+func (p *Patch) String() string {
+	if p.Mode == PatchInsert {
+		return fmt.Sprintf("%s %s", p.Mode, p.Label)
+	}
+	return fmt.Sprintf("%s %s %d", p.Mode, p.Label, p.Count)
+}
+
+func ReadPatchFile(filename string) ([]*Patch, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadPatches(file)
+}
+
+// ReadPatches reads a patch file.  Each patch starts with a .patch directive
+// and is followed by the assembly to insert:
+//
+//	.patch insert L6012
+//	    push_word 1
+//	    call_abs NewCode
+//	.patch replace L6020 2
+//	    jump_abs L6002
+//	.patch delete Var_6040 1
+//
+// Replace and delete remove the given number of tokens starting at the label.
+// Everything before the first .patch is ignored.  Patches are applied in
+// order.  Labels keep their names when they move, but an address refers to
+// the script as it is after the earlier patches.
+func ReadPatches(r io.Reader) ([]*Patch, error) {
+	patches := []*Patch{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	var current *Patch
+	lines := []string{}
+	finish := func() {
+		if current != nil {
+			// Pad the start so assembler errors have the line number in
+			// the patch file.
+			current.Source = strings.Repeat("\n", current.line) + strings.Join(lines, "\n")
+			patches = append(patches, current)
+		}
+		lines = []string{}
+	}
+
+	for scanner.Scan() {
+		num++
+		line := scanner.Text()
+		fields := strings.Fields(stripComment(line))
+
+		if len(fields) == 0 || fields[0] != ".patch" {
+			lines = append(lines, line)
+			continue
+		}
+
+		finish()
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: %w: .patch needs a mode and a label", num, ErrSyntax)
+		}
+
+		current = &Patch{Mode: fields[1], Label: fields[2], line: num}
+		switch current.Mode {
+		case PatchInsert:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("line %d: %w: too many arguments for insert", num, ErrSyntax)
+			}
+
+		case PatchDelete, PatchReplace:
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: %w: %s needs a count", num, ErrSyntax, current.Mode)
+			}
+
+			count, err := strconv.Atoi(fields[3])
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("line %d: %w: invalid count %q", num, ErrSyntax, fields[3])
+			}
+			current.Count = count
+
+		default:
+			return nil, fmt.Errorf("line %d: %w: unknown patch mode %q", num, ErrSyntax, current.Mode)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	finish()
+	return patches, nil
+}
+
+// ApplyPatch applies a patch read from a patch file.  See Patch().
+func (s *Script) ApplyPatch(p *Patch) ([]string, error) {
+	var warnings []string
+	var err error
+
+	switch p.Mode {
+	case PatchInsert:
+		warnings, err = s.Insert(p.Label, p.Source)
+	case PatchDelete:
+		if strings.TrimSpace(stripComments(p.Source)) != "" {
+			return nil, fmt.Errorf("line %d: delete patch has code", p.line)
+		}
+		warnings, err = s.Delete(p.Label, p.Count)
+	case PatchReplace:
+		warnings, err = s.Replace(p.Label, p.Count, p.Source)
+	default:
+		return nil, fmt.Errorf("unknown patch mode %q", p.Mode)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("patch on line %d (%s): %w", p.line, p, err)
+	}
+	return warnings, nil
+}
+
+func stripComments(source string) string {
+	lines := []string{}
+	for _, line := range strings.Split(source, "\n") {
+		lines = append(lines, stripComment(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Insert assembles source and inserts it before the token at label.
+// References to the label run the new code.
+func (s *Script) Insert(label, source string) ([]string, error) {
+	return s.Patch(label, 0, source)
+}
+
+// Delete removes count tokens starting at label.
+func (s *Script) Delete(label string, count int) ([]string, error) {
+	return s.Patch(label, count, "")
+}
+
+// Replace removes count tokens starting at label and inserts source in their
+// place.
+func (s *Script) Replace(label string, count int, source string) ([]string, error) {
+	return s.Patch(label, count, source)
+}
+
+// Patch removes count tokens starting at label and inserts the assembled
+// source in their place.  Bytes after the removed tokens are moved and every
+// code and data address operand, label, cross reference and CDL flag that
+// points after the patch is fixed up.  Source can use any of the script's
+// labels.
+//
+// References into the removed tokens, other than to label itself, are an
+// error.  Returned warnings list push_word values that may be addresses and
+// were not moved.  A push_word found to be a jump_arg_a target is moved.  The script should come from SmartParse so that data isn't
+// decoded as instructions.
+func (s *Script) Patch(label string, count int, source string) ([]string, error) {
+	addr, err := s.labelAddress(label)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := slices.Clone(s.Tokens)
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	idx := slices.IndexFunc(tokens, func(t *Token) bool { return t.Offset == addr })
+	if idx == -1 {
+		return nil, fmt.Errorf("%s ($%04X) is not the start of a token", label, addr)
+	}
+
+	if idx+count > len(tokens) {
+		return nil, fmt.Errorf("cannot remove %d tokens at %s: only %d left", count, label, len(tokens)-idx)
+	}
+
+	removed := 0
+	for _, t := range tokens[idx:idx+count] {
+		removed += t.Size()
+	}
+	end := addr+removed
+	scriptEnd := s.StartAddress+s.origSize
+
+	// Size of the new code doesn't depend on label values.
+	frag := []byte{}
+	if strings.TrimSpace(source) != "" {
+		frag, _, _, err = s.assembleFragment(source, addr, scriptEnd, func(a int) int { return a })
+		if err != nil {
+			return nil, err
+		}
+	}
+	delta := len(frag)-removed
+
+	bankEnd := (s.StartAddress &^ 0x1FFF) + 0x2000
+	if scriptEnd+delta > bankEnd {
+		return nil, fmt.Errorf("script overflows the bank by %d bytes", scriptEnd+delta-bankEnd)
+	}
+
+	// shift returns the new address for an address in the script
+	inScript := func(a int) bool {
+		return a >= s.StartAddress && a < scriptEnd
+	}
+	shift := func(a int) int {
+		if !inScript(a) || a <= addr {
+			return a
+		}
+		if a < end {
+			return -1
+		}
+		return a+delta
+	}
+
+	var defined map[int]*Label
+	var fragCDL *CodeDataLog
+	if len(frag) > 0 {
+		frag, defined, fragCDL, err = s.assembleFragment(source, addr, max(scriptEnd, scriptEnd+delta), shift)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Find the new operand values before changing anything, so the script is
+	// left alone on error.
+	type fixup struct {
+		token *Token
+		idx   int
+		val   InlineVal
+	}
+	fixups := []fixup{}
+
+	kept := append(slices.Clone(tokens[:idx]), tokens[idx+count:]...)
+	for _, t := range kept {
+		if target, ok := t.NativeTarget(); ok {
+			na := shift(target)
+			if na == -1 {
+				return nil, fmt.Errorf("%s at $%04X references removed code at $%04X",
+					t.Native.Name, t.Offset, target)
+			}
+
+			if t.Native.Mode != ModeRelative {
+				if na != target {
+					fixups = append(fixups, fixup{t, 0, WordVal{byte(na & 0xFF), byte(na >> 8)}})
+				}
+				continue
+			}
+
+			from := t.Offset
+			if from >= addr {
+				from += delta
+			}
+			rel := na-(from+2)
+			if rel < -128 || rel > 127 {
+				return nil, fmt.Errorf("%s at $%04X can't reach $%04X after the patch", t.Native.Name, t.Offset, target)
+			}
+			if rel != int(int8(t.Inline[0].Int())) {
+				fixups = append(fixups, fixup{t, 0, ByteVal(byte(rel))})
+			}
+			continue
+		}
+
+		if t.Instruction == nil || t.IsData {
+			continue
+		}
+
+		types := t.InlineTypes()
+		for i, v := range t.Inline {
+			if !types[i].IsAddress() && !t.codePush {
+				continue
+			}
+
+			na := shift(v.Int())
+			if na == -1 {
+				return nil, fmt.Errorf("%s at $%04X references removed code at $%04X",
+					t.Instruction.Name, t.Offset, v.Int())
+			}
+			if na != v.Int() {
+				fixups = append(fixups, fixup{t, i, WordVal{byte(na & 0xFF), byte(na >> 8)}})
+			}
+		}
+	}
+
+	// Decode the new code.  Parse needs the two byte header.
+	var fragScript *Script
+	if len(frag) > 0 {
+		fragScript, err = Parse(append([]byte{0, 0}, frag...), addr-2, fragCDL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode new code: %w", err)
+		}
+	}
+
+	for _, f := range fixups {
+		f.token.Inline[f.idx] = f.val
+	}
+
+	warnings := s.unrelocatedWords(addr)
+
+	// Rebuild the token list
+	newTokens := slices.Clone(tokens[:idx])
+	if fragScript != nil {
+		newTokens = append(newTokens, fragScript.Tokens...)
+	}
+	for _, t := range tokens[idx+count:] {
+		t.Offset += delta
+		newTokens = append(newTokens, t)
+	}
+	s.Tokens = newTokens
+
+	labels := make(map[int]*Label)
+	for a, lbl := range s.Labels {
+		na := shift(a)
+		switch {
+		case na == -1:
+			warnings = append(warnings, fmt.Sprintf("label %s at $%04X was removed", lbl.Name, a))
+		case na != a:
+			// Keep the name so later patches can use it.
+			lbl.Address = na
+			labels[na] = lbl
+		default:
+			labels[a] = lbl
+		}
+	}
+	for a, lbl := range defined {
+		if _, ok := labels[a]; !ok {
+			labels[a] = lbl
+		}
+	}
+	s.Labels = labels
+
+	if s.CDL != nil {
+		s.CDL.patch(addr, end, scriptEnd, delta)
+		if fragScript != nil {
+			for a := addr; a < addr+len(frag); a++ {
+				s.CDL.set(a, fragScript.CDL.get(a))
+			}
+		}
+	}
+
+	s.origSize += delta
+	s.BuildXrefs()
+	s.AnnotateEnums()
+	return warnings, nil
+}
+
+// labelAddress finds a label by name, or parses an address.
+func (s *Script) labelAddress(label string) (int, error) {
+	for addr, lbl := range s.Labels {
+		if lbl.Name == label {
+			return addr, nil
+		}
+	}
+
+	addr, err := parseNumber(label)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrUndefinedLabel, label)
+	}
+	return addr, nil
+}
+
+// assembleFragment assembles source at addr with the script's labels moved
+// by shift.  Labels in removed code can't be used.  end is the end of the
+// script after the patch.  Returns the code, the labels defined by the
+// source, and a CDL with its 6502 code marked.
+func (s *Script) assembleFragment(source string, addr, end int, shift func(int) int) ([]byte, map[int]*Label, *CodeDataLog, error) {
+	asm := NewAssembler()
+	asm.ScriptStart = s.StartAddress
+	asm.ScriptEnd = end
+	for a, lbl := range s.Labels {
+		if lbl.Name == "" {
+			continue
+		}
+		if na := shift(a); na != -1 {
+			asm.Labels[lbl.Name] = na
+		}
+	}
+	existing := len(asm.Labels)
+
+	raw, err := asm.Assemble(strings.NewReader(source), addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	defined := make(map[int]*Label)
+	cdl := NewCDL()
+	for _, ln := range asm.lines {
+		if ln.label != "" && len(asm.Labels) > existing {
+			defined[ln.address] = NewLabel(ln.address, ln.label)
+		}
+
+		if ln.native != nil {
+			cdl.set(ln.address, cdlCode | cdlNative | cdlOpCode)
+			for a := ln.address+1; a < ln.address+ln.size; a++ {
+				cdl.set(a, cdlCode | cdlNative | cdlOperand)
+			}
+		}
+	}
+	return raw, defined, cdl, nil
+}
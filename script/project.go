@@ -0,0 +1,254 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"cmp"
+
+	"git.zorchenhimer.com/Zorchenhimer/go-studybox/rom"
+)
+
+// Project holds every script segment of a tape, each loaded into its bank and
+// address slot, so far jumps and calls can be followed between them.
+type Project struct {
+	Segments []*ProjectSegment
+	Warnings []string
+}
+
+type ProjectSegment struct {
+	Page  int // page index in the tape
+	Index int // script index in the page
+	Segment *rom.DataSegment
+
+	Script *Script
+	CDL    *CodeDataLog
+}
+
+func (ps *ProjectSegment) Bank() int {
+	return ps.Segment.Bank
+}
+
+// Contains returns true if the address is inside the script code (past the
+// stack address header).
+func (ps *ProjectSegment) Contains(addr int) bool {
+	return addr >= ps.Segment.Address+2 && addr < ps.Segment.Address+len(ps.Segment.Data)
+}
+
+func (ps *ProjectSegment) String() string {
+	return fmt.Sprintf("page %d script %d (bank $%02X @ $%04X)",
+		ps.Page, ps.Index, ps.Bank(), ps.Segment.Address)
+}
+
+// NewProject collects all the script segments in a tape.  Call Analyze() to
+// parse them.
+func NewProject(sb *rom.StudyBox) *Project {
+	p := &Project{
+		Segments: []*ProjectSegment{},
+		Warnings: []string{},
+	}
+
+	for pidx, page := range sb.Data.Pages {
+		for sidx, seg := range page.Scripts() {
+			p.Segments = append(p.Segments, &ProjectSegment{
+				Page: pidx,
+				Index: sidx,
+				Segment: seg,
+				CDL: NewCDL(),
+			})
+		}
+	}
+
+	return p
+}
+
+// Analyze smart parses every segment.  Far jumps and calls (long_jump and
+// long_call) with a target pushed by a push_word directly before them are
+// resolved to a segment in another bank that contains the target address.
+// The target is added as an entry point to that segment, and everything is
+// parsed again until no new entry points are found.
+func (p *Project) Analyze() error {
+	p.Warnings = []string{}
+	warned := make(map[string]bool)
+
+	for {
+		found := false
+
+		for _, ps := range p.Segments {
+			scr, err := SmartParseSegment(ps.Segment, ps.CDL)
+			if scr == nil {
+				return fmt.Errorf("%s: %w", ps, err)
+			}
+			ps.Script = scr
+
+			if err != nil {
+				w := fmt.Sprintf("%s: %s", ps, err)
+				if !warned[w] {
+					p.Warnings = append(p.Warnings, w)
+					warned[w] = true
+				}
+			}
+		}
+
+		for _, ps := range p.Segments {
+			for _, fc := range ps.Script.farCalls() {
+				targets := p.resolveFar(ps, fc.target)
+				banks := farBanks(targets)
+				if len(banks) != 1 {
+					w := fmt.Sprintf("%s: unable to resolve far target $%04X at $%04X (%d candidate banks)",
+						ps, fc.target, fc.source.Offset, len(banks))
+					if !warned[w] {
+						p.Warnings = append(p.Warnings, w)
+						warned[w] = true
+					}
+					continue
+				}
+
+				for _, t := range targets {
+					if t.CDL.AddEntry(fc.target) {
+						found = true
+					}
+				}
+			}
+		}
+
+		if !found {
+			break
+		}
+	}
+
+	// Label the far targets and their callers.  Ambiguous targets were
+	// warned about above and are left alone.
+	for _, ps := range p.Segments {
+		for _, fc := range ps.Script.farCalls() {
+			targets := p.resolveFar(ps, fc.target)
+			if len(farBanks(targets)) != 1 {
+				continue
+			}
+
+			for _, t := range targets {
+				lbl, ok := t.Script.Labels[fc.target]
+				if !ok || lbl.Name == AutoLabel(fc.target).Name {
+					t.Script.Labels[fc.target] = AutoLabelFar(fc.target)
+				} else {
+					lbl.FarLabel = true
+				}
+			}
+
+			lbl := targets[0].Script.Labels[fc.target]
+			fc.push.Label = lbl.Name
+		}
+	}
+
+	return nil
+}
+
+type farCall struct {
+	source *Token // long_jump or long_call
+	push   *Token // push_word with the target
+	target int
+}
+
+// farCalls returns long_jump and long_call instructions that have their
+// target pushed directly before them.
+func (s *Script) farCalls() []farCall {
+	tokenMap := make(map[int]*Token)
+	for _, t := range s.Tokens {
+		tokenMap[t.Offset] = t
+	}
+
+	calls := []farCall{}
+	for _, t := range s.Tokens {
+		if t.Instruction == nil || t.IsData || (t.Raw != 0xAA && t.Raw != 0xAB) {
+			continue
+		}
+
+		push, ok := tokenMap[t.Offset-3]
+		if !ok || push.Raw != 0xB8 || push.Instruction == nil || push.Size() != 3 {
+			continue
+		}
+
+		calls = append(calls, farCall{
+			source: t,
+			push: push,
+			target: push.Inline[0].Int(),
+		})
+	}
+	return calls
+}
+
+// resolveFar finds the segments in other banks that contain the address.
+func (p *Project) resolveFar(from *ProjectSegment, addr int) []*ProjectSegment {
+	found := []*ProjectSegment{}
+	for _, ps := range p.Segments {
+		if ps.Bank() != from.Bank() && ps.Contains(addr) {
+			found = append(found, ps)
+		}
+	}
+	return found
+}
+
+// farBanks returns the banks of the segments.
+func farBanks(segments []*ProjectSegment) []int {
+	banks := []int{}
+	for _, ps := range segments {
+		if !slices.Contains(banks, ps.Bank()) {
+			banks = append(banks, ps.Bank())
+		}
+	}
+	return banks
+}
+
+// WriteTo writes a combined disassembly of all the segments, grouped by bank.
+func (p *Project) WriteTo(w io.Writer) (int64, error) {
+	count := int64(0)
+	write := func(format string, args ...any) error {
+		n, err := fmt.Fprintf(w, format, args...)
+		count += int64(n)
+		return err
+	}
+
+	for _, warn := range p.Warnings {
+		if err := write("; %s\n", warn); err != nil {
+			return count, err
+		}
+	}
+
+	segments := slices.Clone(p.Segments)
+	slices.SortStableFunc(segments, func(a, b *ProjectSegment) int {
+		return cmp.Compare(a.Bank(), b.Bank())
+	})
+
+	bank := -1
+	for _, ps := range segments {
+		if ps.Script == nil {
+			continue
+		}
+
+		if ps.Bank() != bank {
+			bank = ps.Bank()
+			if err := write("\n; ==== Bank $%02X ====\n", bank); err != nil {
+				return count, err
+			}
+		}
+
+		err := write("\n; ---- Page %d, script %d ----\n; Start address: $%04X\n; Stack address: $%04X\n",
+			ps.Page, ps.Index, ps.Script.StartAddress, ps.Script.StackAddress)
+		if err != nil {
+			return count, err
+		}
+
+		tokens := slices.Clone(ps.Script.Tokens)
+		slices.SortFunc(tokens, func(a, b *Token) int {
+			return cmp.Compare(a.Offset, b.Offset)
+		})
+
+		for _, t := range tokens {
+			if err := write("%s\n", t.String(ps.Script.Labels, false)); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
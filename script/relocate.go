@@ -0,0 +1,116 @@
+package script
+
+import (
+	"fmt"
+)
+
+// Relocate moves the script to a new start address in work RAM, and to a new
+// bank unless bank is negative.  Every code and data address operand that
+// points into the script is moved, along with the tokens, labels, CDL and
+// stack address if it is inside the script.  Addresses outside of the script
+// are left alone.
+//
+// Values that might be addresses but aren't used as one by an instruction,
+// eg push_word and words in data, can't be moved safely unless the push_word
+// was found to be a jump_arg_a target.  These are returned
+// as warnings.  The script should come from SmartParse so that data isn't
+// decoded as instructions.
+func (s *Script) Relocate(bank, newStart int) ([]string, error) {
+	if newStart < cdlStart || newStart+s.origSize > cdlStart+cdlSize {
+		return nil, fmt.Errorf("script at $%04X-$%04X is outside of work RAM",
+			newStart, newStart+s.origSize-1)
+	}
+
+	start := s.StartAddress
+	end := s.StartAddress + s.origSize
+	delta := newStart - s.StartAddress
+	inScript := func(addr int) bool {
+		return addr >= start && addr < end
+	}
+
+	warnings := s.unrelocatedWords(start)
+
+	for _, t := range s.Tokens {
+		t.Offset += delta
+		if t.Native != nil {
+			// Branches are relative and move with the code.
+			if addr, ok := t.NativeTarget(); ok && t.Native.Mode.Size() == 2 && inScript(addr) {
+				addr += delta
+				t.Inline[0] = WordVal{byte(addr & 0xFF), byte(addr >> 8)}
+			}
+			continue
+		}
+
+		if t.Instruction == nil || t.IsData {
+			continue
+		}
+
+		types := t.InlineTypes()
+		for i, v := range t.Inline {
+			addr := v.Int()
+			if (types[i].IsAddress() || t.codePush) && inScript(addr) {
+				addr += delta
+				t.Inline[i] = WordVal{byte(addr & 0xFF), byte(addr >> 8)}
+			}
+		}
+	}
+
+	labels := make(map[int]*Label)
+	for addr, lbl := range s.Labels {
+		if !inScript(addr) {
+			labels[addr] = lbl
+		}
+	}
+	for addr, lbl := range s.Labels {
+		if !inScript(addr) {
+			continue
+		}
+
+		moveLabel(lbl, addr+delta)
+		labels[addr+delta] = lbl
+	}
+	s.Labels = labels
+
+	// Auto labels were renamed
+	for _, t := range s.Tokens {
+		if !t.codePush {
+			continue
+		}
+		if lbl, ok := labels[t.Inline[0].Int()]; ok {
+			t.Label = lbl.Name
+		}
+	}
+
+	if s.CDL != nil {
+		s.CDL.relocate(start, end, delta)
+		if bank >= 0 {
+			s.CDL.SetBank(bank)
+		}
+	}
+
+	if bank >= 0 {
+		s.Bank = bank
+	}
+
+	if inScript(s.StackAddress) {
+		s.StackAddress += delta
+	}
+
+	s.StartAddress = newStart
+	s.BuildXrefs()
+	return warnings, nil
+}
+
+// moveLabel changes the label's address.  Automatic labels are renamed to
+// match.
+func moveLabel(lbl *Label, addr int) {
+	switch lbl.Name {
+	case AutoLabel(lbl.Address).Name:
+		lbl.Name = AutoLabel(addr).Name
+	case AutoLabelVar(lbl.Address).Name:
+		lbl.Name = AutoLabelVar(addr).Name
+	case AutoLabelFar(lbl.Address).Name:
+		lbl.Name = AutoLabelFar(addr).Name
+	}
+	lbl.Address = addr
+}
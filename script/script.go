@@ -3,6 +3,7 @@ package script
 import (
 	"fmt"
 	"os"
+	"slices"
 )
 
 type Script struct {
@@ -11,32 +12,19 @@ type Script struct {
 
 	StartAddress int
 	StackAddress int
+	Bank int // WRAM bank the script is loaded into, if known
 
 	Labels map[int]*Label
 	CDL *CodeDataLog
+	Xrefs map[int][]*Xref // map[target]references
 
 	origSize int // size of the binary input
+	smart    bool // from SmartParse, so code is known to be reachable
 }
 
+// Stats records instruction usage for the script without any source names.
 func (s *Script) Stats() Stats {
-	st := make(Stats)
-
-	for _, t := range s.Tokens {
-		if t.Instruction == nil {
-			continue
-		}
-
-		op := t.Instruction.Opcode
-		if _, ok := st[op]; !ok {
-			st[op] = &InstrStat{
-				Instr: t.Instruction,
-				Count: 0,
-			}
-		}
-		st[op].Count++
-	}
-
-	return st
+	return s.SourceStats("", "")
 }
 
 func (s *Script) DebugCDL(filename string) error {
@@ -44,18 +32,9 @@ func (s *Script) DebugCDL(filename string) error {
 		return fmt.Errorf("origSize == 0")
 	}
 
-	//if s.CDL.cache == nil {
-	//	err := s.CDL.doCache()
-	//	if err != nil {
-	//		return fmt.Errorf("doCache() error: %w", err)
-	//	}
-	//}
-
 	dat := make([]byte, s.origSize)
 	for i := 2; i < len(dat); i++ {
-		if val, ok := s.CDL.cache[i+0x6000]; ok {
-			dat[i] = byte(val)
-		}
+		dat[i] = byte(s.CDL.get(i+s.StartAddress))
 	}
 
 	err := os.WriteFile(filename, dat, 0644)
@@ -65,3 +44,32 @@ func (s *Script) DebugCDL(filename string) error {
 
 	return nil
 }
+
+// Bytes re-encodes the script, including the stack address header.  Every
+// byte of the script must be covered by a token.
+func (s *Script) Bytes() ([]byte, error) {
+	tokens := slices.Clone(s.Tokens)
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	raw := []byte{byte(s.StackAddress & 0xFF), byte(s.StackAddress >> 8)}
+	for _, t := range tokens {
+		addr := s.StartAddress+len(raw)
+		if t.Offset < addr {
+			return nil, fmt.Errorf("token at $%04X overlaps the previous token", t.Offset)
+		}
+		if t.Offset > addr {
+			return nil, fmt.Errorf("no token for $%04X-$%04X", addr, t.Offset-1)
+		}
+
+		raw = append(raw, t.Raw)
+		if (t.Instruction != nil && !t.IsData) || t.Native != nil {
+			for _, v := range t.Inline {
+				raw = append(raw, v.Bytes()...)
+			}
+		}
+	}
+
+	return raw, nil
+}
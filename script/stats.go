@@ -1,34 +1,207 @@
 package script
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"io"
 	"slices"
 	"maps"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// Number of example locations kept for each unknown opcode.
+const statExamples = 10
+
+// Number of instructions before an example that are kept with it.
+const statContext = 3
+
 type Stats map[byte]*InstrStat
 
 type InstrStat struct {
 	Instr *Instruction
 	Count int
+
+	Tapes     map[string]int // uses per tape
+	Scripts   map[string]int // uses per script
+	Operands  []map[int]int  // value counts for each inline operand
+	Preceding map[string]int // instruction right before each use
+	Examples  []StatLocation // only kept for unknown opcodes
+}
+
+// StatLocation is a use of an instruction.
+type StatLocation struct {
+	Tape      string
+	Script    string
+	Address   int
+	Preceding []string // instructions before this one, oldest first
+}
+
+func newInstrStat(instr *Instruction) *InstrStat {
+	return &InstrStat{
+		Instr:     instr,
+		Tapes:     make(map[string]int),
+		Scripts:   make(map[string]int),
+		Operands:  []map[int]int{},
+		Preceding: make(map[string]int),
+		Examples:  []StatLocation{},
+	}
 }
 
 func (is InstrStat) String() string {
 	return fmt.Sprintf("0x%02X %6d %s", is.Instr.Opcode, is.Count, is.Instr.String())
 }
 
+// SourceStats records instruction usage for the script.  The tape and
+// script names are used for the per-tape and per-script counts and the
+// example locations.  Counts for empty names are not recorded.
+func (s *Script) SourceStats(tape, name string) Stats {
+	st := make(Stats)
+
+	for i, t := range s.Tokens {
+		if t.Instruction == nil {
+			continue
+		}
+
+		op := t.Instruction.Opcode
+		if _, ok := st[op]; !ok {
+			st[op] = newInstrStat(t.Instruction)
+		}
+		is := st[op]
+		is.Count++
+
+		if tape != "" {
+			is.Tapes[tape]++
+		}
+		if name != "" {
+			is.Scripts[name]++
+		}
+
+		types := t.InlineTypes()
+		for j, val := range t.Inline {
+			// Code table addresses and strings aren't useful as values.
+			if j >= len(t.Instruction.Operands) || types[j] == OperandString {
+				break
+			}
+			for len(is.Operands) <= j {
+				is.Operands = append(is.Operands, make(map[int]int))
+			}
+			is.Operands[j][val.Int()]++
+		}
+
+		preceding := s.precedingInstructions(i, statContext)
+		if len(preceding) > 0 {
+			is.Preceding[preceding[len(preceding)-1].Instruction.String()]++
+		}
+
+		if t.Instruction.Name == "" && len(is.Examples) < statExamples {
+			loc := StatLocation{
+				Tape:      tape,
+				Script:    name,
+				Address:   t.Offset,
+				Preceding: []string{},
+			}
+			for _, p := range preceding {
+				loc.Preceding = append(loc.Preceding, p.instructionText(s.Labels))
+			}
+			is.Examples = append(is.Examples, loc)
+		}
+	}
+
+	return st
+}
+
+// precedingInstructions returns up to count instructions that run right
+// before the token at idx, oldest first.  It stops at anything that isn't
+// an instruction, an instruction that doesn't continue to the next one, and
+// labels.
+func (s *Script) precedingInstructions(idx, count int) []*Token {
+	list := []*Token{}
+	for i := idx-1; i >= 0 && len(list) < count; i-- {
+		t := s.Tokens[i]
+		if t.Instruction == nil || t.IsData || endsFlow(t.Instruction.Opcode) {
+			break
+		}
+		list = append(list, t)
+
+		// Labelled code can be reached from somewhere else.
+		if _, ok := s.Labels[t.Offset]; ok {
+			break
+		}
+	}
+	slices.Reverse(list)
+	return list
+}
+
+// instructionText returns the instruction without its label, address or
+// bytes.
+func (t Token) instructionText(labels map[int]*Label) string {
+	lines := strings.Split(strings.TrimSpace(t.String(labels, true)), "\n")
+	text := lines[len(lines)-1]
+	if _, after, found := strings.Cut(text, " : "); found {
+		return after
+	}
+	return text
+}
+
 func (this Stats) Add(that Stats) {
-	for _, st := range that {
-		op := st.Instr.Opcode
+	for op, st := range that {
 		if _, ok := this[op]; !ok {
-			this[op] = st
-		} else {
-			this[op].Count += that[op].Count
+			this[op] = newInstrStat(st.Instr)
 		}
+		this[op].add(st)
 	}
 }
 
+func (this *InstrStat) add(that *InstrStat) {
+	this.Count += that.Count
+	addCounts(this.Tapes, that.Tapes)
+	addCounts(this.Scripts, that.Scripts)
+	addCounts(this.Preceding, that.Preceding)
+
+	for i, vals := range that.Operands {
+		for len(this.Operands) <= i {
+			this.Operands = append(this.Operands, make(map[int]int))
+		}
+		addCounts(this.Operands[i], vals)
+	}
+
+	for _, ex := range that.Examples {
+		if len(this.Examples) >= statExamples {
+			break
+		}
+		this.Examples = append(this.Examples, ex)
+	}
+}
+
+func addCounts[K comparable](this, that map[K]int) {
+	for k, v := range that {
+		this[k] += v
+	}
+}
+
+// WriteStatsFile writes the stats as JSON or CSV, depending on the file
+// extension, or as text for anything else.
+func WriteStatsFile(filename string, s Stats) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return s.WriteJson(file)
+	case ".csv":
+		return s.WriteCsv(file)
+	}
+	_, err = s.WriteTo(file)
+	return err
+}
+
 func (s Stats) WriteTo(w io.Writer) (int64, error) {
 	count := int64(0)
 	keys := slices.Sorted(maps.Keys(s))
@@ -79,3 +252,175 @@ func (s Stats) WriteTo(w io.Writer) (int64, error) {
 
 	return count, nil
 }
+
+type JsonStats struct {
+	Instructions        []JsonInstrStat
+	Unused              []string // opcodes, eg "0x80"
+	UnknownUses         int
+	UnknownInstructions int
+}
+
+type JsonInstrStat struct {
+	Opcode    string // hex string, eg "0x80"
+	Name      string
+	Count     int
+	Tapes     map[string]int      `json:",omitempty"`
+	Scripts   map[string]int      `json:",omitempty"`
+	Operands  []JsonOperandStat   `json:",omitempty"`
+	Preceding map[string]int      `json:",omitempty"`
+	Examples  []JsonStatLocation `json:",omitempty"`
+}
+
+// JsonOperandStat counts the values of one inline operand.  Values are keyed
+// by hex string, eg "$0003".
+type JsonOperandStat struct {
+	Type   string
+	Values map[string]int
+}
+
+type JsonStatLocation struct {
+	Tape      string `json:",omitempty"`
+	Script    string `json:",omitempty"`
+	Address   string
+	Preceding []string
+}
+
+func (s Stats) WriteJson(w io.Writer) error {
+	out := JsonStats{
+		Instructions: []JsonInstrStat{},
+		Unused:       []string{},
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(s)) {
+		is := s[key]
+		if is.Instr.Name == "" {
+			out.UnknownInstructions++
+			out.UnknownUses += is.Count
+		}
+
+		js := JsonInstrStat{
+			Opcode:    fmt.Sprintf("0x%02X", is.Instr.Opcode),
+			Name:      is.Instr.String(),
+			Count:     is.Count,
+			Tapes:     is.Tapes,
+			Scripts:   is.Scripts,
+			Preceding: is.Preceding,
+		}
+
+		for i, vals := range is.Operands {
+			op := JsonOperandStat{
+				Type:   is.Instr.operandType(i).String(),
+				Values: make(map[string]int),
+			}
+			for val, n := range vals {
+				op.Values[is.Instr.operandText(i, val)] = n
+			}
+			js.Operands = append(js.Operands, op)
+		}
+
+		for _, ex := range is.Examples {
+			js.Examples = append(js.Examples, JsonStatLocation{
+				Tape:      ex.Tape,
+				Script:    ex.Script,
+				Address:   fmt.Sprintf("$%04X", ex.Address),
+				Preceding: ex.Preceding,
+			})
+		}
+
+		out.Instructions = append(out.Instructions, js)
+	}
+
+	for i := byte(0x80); i <= 0xFF && i >= 0x80; i++ {
+		if _, ok := s[i]; !ok {
+			out.Unused = append(out.Unused, fmt.Sprintf("0x%02X", i))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(out)
+}
+
+// WriteCsv writes one row per count with the columns opcode, name, stat,
+// key and count.  Stats are "uses", "tape", "script", "operandN" (the Nth
+// inline operand, starting at zero), "preceding" and "example".  Example
+// keys are the script name and address.
+func (s Stats) WriteCsv(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"opcode", "name", "stat", "key", "count"})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(s)) {
+		is := s[key]
+		opcode := fmt.Sprintf("0x%02X", is.Instr.Opcode)
+		name := is.Instr.String()
+		row := func(stat, key string, count int) error {
+			return cw.Write([]string{opcode, name, stat, key, strconv.Itoa(count)})
+		}
+
+		if err = row("uses", "", is.Count); err != nil {
+			return err
+		}
+
+		counts := func(stat string, m map[string]int) error {
+			for _, k := range slices.Sorted(maps.Keys(m)) {
+				if err := row(stat, k, m[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if err = counts("tape", is.Tapes); err != nil {
+			return err
+		}
+		if err = counts("script", is.Scripts); err != nil {
+			return err
+		}
+
+		for i, vals := range is.Operands {
+			for _, val := range slices.Sorted(maps.Keys(vals)) {
+				err = row(fmt.Sprintf("operand%d", i), is.Instr.operandText(i, val), vals[val])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = counts("preceding", is.Preceding); err != nil {
+			return err
+		}
+
+		for _, ex := range is.Examples {
+			if err = row("example", fmt.Sprintf("%s $%04X", ex.Script, ex.Address), 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// operandType returns the type of the inline operand at idx, in the same way
+// as Token.InlineTypes.
+func (i Instruction) operandType(idx int) OperandType {
+	if idx >= len(i.Operands) {
+		return OperandImm8
+	}
+
+	ot := i.Operands[idx]
+	if ot == OperandCodeTable {
+		return OperandImm8
+	}
+	return ot
+}
+
+func (i Instruction) operandText(idx, val int) string {
+	if i.operandType(idx).Size() == 1 {
+		return fmt.Sprintf("$%02X", val)
+	}
+	return fmt.Sprintf("$%04X", val)
+}
@@ -0,0 +1,277 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "embed"
+)
+
+// Character table used for script text.  The StudyBox BIOS font hasn't been
+// mapped yet, so the built-in table only has ASCII.
+//go:embed default.tbl
+var defaultTable []byte
+
+var CharTable *Table
+
+func init() {
+	tbl, err := ReadTable(bytes.NewReader(defaultTable))
+	if err != nil {
+		panic(fmt.Sprintf("built-in character table is invalid: %s", err))
+	}
+	CharTable = tbl
+}
+
+// Table is a ROM hacking character table (.tbl).  Entries map one or more
+// bytes to some text:
+//
+//	8A=あ
+//	8A9F=が
+//	/FF=<end>
+//	*FE=<br>
+//
+// Lines starting with "/" are end tokens and lines starting with "*" are line
+// breaks.  Line break text is followed by a newline.  End tokens and line
+// breaks without text are given "<end>" and "\n".
+type Table struct {
+	Entries []*TableEntry
+
+	byBytes map[string]*TableEntry
+	byText  map[string]*TableEntry
+	maxBytes int
+	maxText  int
+}
+
+type TableEntry struct {
+	Bytes   []byte
+	Text    string
+	End     bool
+	Newline bool
+}
+
+func ReadTableFile(filename string) (*Table, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadTable(file)
+}
+
+// LoadTableFile replaces CharTable with the table in the given file.
+func LoadTableFile(filename string) error {
+	tbl, err := ReadTableFile(filename)
+	if err != nil {
+		return err
+	}
+	CharTable = tbl
+	return nil
+}
+
+func ReadTable(r io.Reader) (*Table, error) {
+	tbl := &Table{
+		Entries: []*TableEntry{},
+		byBytes: make(map[string]*TableEntry),
+		byText:  make(map[string]*TableEntry),
+	}
+
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if num == 1 {
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		entry := &TableEntry{}
+		switch line[0] {
+		case '/':
+			entry.End = true
+			line = line[1:]
+		case '*':
+			entry.Newline = true
+			line = line[1:]
+		case '!', '@':
+			return nil, fmt.Errorf("line %d: table switching is not supported", num)
+		}
+
+		hexStr, text, found := strings.Cut(line, "=")
+		if !found && !entry.End && !entry.Newline {
+			return nil, fmt.Errorf("line %d: missing '=': %q", num, line)
+		}
+
+		raw, err := hex.DecodeString(strings.TrimSpace(hexStr))
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("line %d: invalid hex value: %q", num, hexStr)
+		}
+		entry.Bytes = raw
+
+		switch {
+		case entry.Newline:
+			text += "\n"
+		case entry.End && text == "":
+			text = "<end>"
+		case text == "":
+			return nil, fmt.Errorf("line %d: missing text for %s", num, hexStr)
+		}
+		entry.Text = text
+
+		err = tbl.add(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", num, err)
+		}
+	}
+
+	return tbl, scanner.Err()
+}
+
+func (tbl *Table) add(entry *TableEntry) error {
+	key := string(entry.Bytes)
+	if _, ok := tbl.byBytes[key]; ok {
+		return fmt.Errorf("duplicate entry for %X", entry.Bytes)
+	}
+
+	tbl.Entries = append(tbl.Entries, entry)
+	tbl.byBytes[key] = entry
+	tbl.maxBytes = max(tbl.maxBytes, len(entry.Bytes))
+
+	// The first entry for some text is used when encoding.
+	if _, ok := tbl.byText[entry.Text]; !ok {
+		tbl.byText[entry.Text] = entry
+		tbl.maxText = max(tbl.maxText, len(entry.Text))
+	}
+	return nil
+}
+
+// Text converts bytes to text.  The result is escaped to go between double
+// quotes: backslashes, quotes and newlines are escaped and bytes that aren't
+// in the table are written as \xNN.
+func (tbl *Table) Text(data []byte) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(data); {
+		var entry *TableEntry
+		for n := min(tbl.maxBytes, len(data)-i); n > 0; n-- {
+			if e, ok := tbl.byBytes[string(data[i:i+n])]; ok {
+				entry = e
+				break
+			}
+		}
+
+		if entry == nil {
+			fmt.Fprintf(sb, "\\x%02X", data[i])
+			i++
+			continue
+		}
+
+		for _, r := range entry.Text {
+			switch r {
+			case '\\', '"':
+				sb.WriteRune('\\')
+				sb.WriteRune(r)
+			case '\n':
+				sb.WriteString("\\n")
+			default:
+				sb.WriteRune(r)
+			}
+		}
+		i += len(entry.Bytes)
+	}
+	return sb.String()
+}
+
+// StringText returns the text for data if every byte is in the table and the
+// text encodes back to the same bytes.
+func (tbl *Table) StringText(data []byte) (string, bool) {
+	text := tbl.Text(data)
+	if strings.Contains(text, "\\x") {
+		return "", false
+	}
+
+	raw, err := tbl.Bytes(text)
+	if err != nil || !bytes.Equal(raw, data) {
+		return "", false
+	}
+	return text, true
+}
+
+// Bytes converts escaped text, as returned by Text, back to bytes.  The
+// longest matching entry is used at each point in the text.
+func (tbl *Table) Bytes(text string) ([]byte, error) {
+	out := []byte{}
+	pending := &strings.Builder{}
+
+	flush := func() error {
+		str := pending.String()
+		pending.Reset()
+
+		for i := 0; i < len(str); {
+			var entry *TableEntry
+			for n := min(tbl.maxText, len(str)-i); n > 0; n-- {
+				if e, ok := tbl.byText[str[i:i+n]]; ok {
+					entry = e
+					break
+				}
+			}
+
+			if entry == nil {
+				r := []rune(str[i:])[0]
+				return fmt.Errorf("no table entry for %q", r)
+			}
+			out = append(out, entry.Bytes...)
+			i += len(entry.Text)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			pending.WriteByte(text[i])
+			continue
+		}
+
+		if i+1 >= len(text) {
+			return nil, fmt.Errorf("trailing backslash in %q", text)
+		}
+
+		i++
+		switch text[i] {
+		case '\\', '"':
+			pending.WriteByte(text[i])
+		case 'n':
+			pending.WriteByte('\n')
+		case 'x':
+			if i+2 >= len(text) {
+				return nil, fmt.Errorf("invalid \\x escape in %q", text)
+			}
+			val, err := strconv.ParseUint(text[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\x escape in %q", text)
+			}
+
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			out = append(out, byte(val))
+			i += 2
+		default:
+			return nil, fmt.Errorf("unknown escape \\%c in %q", text[i], text)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
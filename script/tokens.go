@@ -12,16 +12,42 @@ type Token struct {
 	IsTarget bool   // target of a call/jump?
 	IsVariable bool // target of something else
 	IsData     bool // from CDL
+	Xrefs []*Xref   // references to this token
+	Symbol string   // enum name of the inline value
+	Label  string   // label of a code address pushed by push_word, eg for jump_arg_a or a far jump
 
 	cdl string // CDL string type
+	codePush bool // push_word value is a code address in the script, from propagateConstants
 
 	Instruction *Instruction
+	Native      *NativeOp // 6502 code run with call_asm
+}
+
+// Size returns the number of bytes the token takes up in the script.
+func (t Token) Size() int {
+	if t.Native != nil {
+		return 1+t.Native.Mode.Size()
+	}
+
+	if t.Instruction == nil {
+		return 1
+	}
+
+	size := 1
+	for _, v := range t.Inline {
+		size += len(v.Bytes())
+	}
+	return size
 }
 
 func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 	suffix := ""
-	switch t.Raw {
-	case 0x86, 0xAC, 0xAA: // Newline after return, long_return, & long_jump
+	switch {
+	case t.Native != nil:
+		if t.Native.EndsFlow() {
+			suffix = "\n"
+		}
+	case t.Raw == 0x86, t.Raw == 0xAC, t.Raw == 0xAA: // Newline after return, long_return, & long_jump
 		suffix = "\n"
 	}
 
@@ -36,6 +62,9 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 		if lbl.Comment != "" {
 			comment = "; "+lbl.Comment+"\n"
 		}
+		for _, x := range t.Xrefs {
+			comment += "; xref: "+x.String()+"\n"
+		}
 		name := ""
 		if lbl.Name != "" {
 			name = lbl.Name+":\n"
@@ -55,6 +84,24 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 		)
 	}
 
+	if t.Native != nil {
+		bytestr := []string{}
+		for _, a := range t.Inline {
+			for _, b := range a.Bytes() {
+				bytestr = append(bytestr, fmt.Sprintf("%02X", b))
+			}
+		}
+
+		return fmt.Sprintf("%s%s%02X %-5s : %s%s",
+			prefix,
+			offset,
+			t.Raw,
+			strings.Join(bytestr, " "),
+			t.nativeText(labels),
+			suffix,
+		)
+	}
+
 	if t.Instruction == nil {
 		if t.IsData == false {
 			return fmt.Sprintf("%s%s%02X %-5s : %d%s",
@@ -89,9 +136,14 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 	}
 
 	argstr := []string{}
-	for _, a := range t.Inline {
-		if lbl, ok := labels[a.Int()]; ok && !t.Instruction.InlineImmediate {
+	types := t.InlineTypes()
+	for i, a := range t.Inline {
+		if lbl, ok := labels[a.Int()]; ok && types[i].IsAddress() {
 			argstr = append(argstr, lbl.Name)
+		} else if t.Label != "" && !types[i].IsAddress() {
+			argstr = append(argstr, t.Label)
+		} else if t.Symbol != "" && !types[i].IsAddress() {
+			argstr = append(argstr, t.Symbol)
 		} else {
 			argstr = append(argstr, a.HexString())
 		}
@@ -108,34 +160,9 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 		}
 	}
 
-	switch t.Raw {
-	case 0xBB: // push_data
-		raw := []byte{}
-
-		ascii := true
-		for _, val := range t.Inline[1:len(t.Inline)-1] {
-			for _, b := range val.Bytes() {
-				raw = append(raw, b)
-				if b < 0x20 || b > 0x7E {
-					ascii = false
-				}
-			}
-		}
-
-		bs := ""
-		if ascii {
-			bs = fmt.Sprintf("%q", string(raw))
-		} else {
-			vals := []string{}
-			for _, b := range raw {
-				if b >= 0x20 && b <= 0x7E {
-					vals = append(vals, fmt.Sprintf("0x%02X{%c}", b, b))
-				} else {
-					vals = append(vals, fmt.Sprintf("0x%02X", b))
-				}
-			}
-			bs = "["+strings.Join(vals, " ")+"]"
-		}
+	switch {
+	case t.Instruction.HasOperand(OperandString): // push_data
+		bs := t.stringText()
 
 		//for _, val := range t.Inline {
 		//	//bs = append(bs, val.Bytes()...)
@@ -166,7 +193,7 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 	//case 0x84, 0x85, 0xBF, 0xC0, // jmp/call
 
 
-	case 0xC1, 0xEE: // switches
+	case t.Instruction.HasOperand(OperandCodeTable): // switches
 		return fmt.Sprintf("%s%s%02X %-5s : %s %s%s",
 			prefix,
 			offset,
@@ -199,3 +226,31 @@ func (t Token) String(labels map[int]*Label, suppAddr bool) string {
 	)
 }
 
+// stringText returns the inline string of push_data as it's printed in the
+// disassembly: quoted text if every byte is in the character table, otherwise
+// a list of bytes.
+func (t Token) stringText() string {
+	raw := []byte{}
+
+	data := t.Inline
+	if len(data) > 0 && data[len(data)-1].Int() == 0x00 {
+		data = data[:len(data)-1]
+	}
+	for _, val := range data {
+		raw = append(raw, val.Bytes()...)
+	}
+
+	if text, ok := CharTable.StringText(raw); ok {
+		return "\""+text+"\""
+	}
+
+	vals := []string{}
+	for _, b := range raw {
+		if b >= 0x20 && b <= 0x7E {
+			vals = append(vals, fmt.Sprintf("0x%02X{%c}", b, b))
+		} else {
+			vals = append(vals, fmt.Sprintf("0x%02X", b))
+		}
+	}
+	return "["+strings.Join(vals, " ")+"]"
+}
@@ -0,0 +1,146 @@
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CdlFromTraceFile creates a new CDL from an execution trace.  See
+// ImportTrace for the format.
+func CdlFromTraceFile(filename string, bank int) (*CodeDataLog, error) {
+	cdl := NewCDL()
+	err := cdl.ImportTraceFile(filename, bank)
+	if err != nil {
+		return nil, err
+	}
+	return cdl, nil
+}
+
+func (cdl *CodeDataLog) ImportTraceFile(filename string, bank int) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return cdl.ImportTrace(file, bank)
+}
+
+// ImportTrace merges an execution trace of the script VM into the CDL.  Each
+// line of the trace is an event type and a hex address, separated by commas
+// or whitespace, with an optional WRAM bank:
+//
+//	# comment
+//	pc,6002
+//	read,6040
+//	pc,6005,1
+//
+// A CSV header on the first line that isn't a comment is skipped.
+//
+// "pc" is the VM code pointer at the start of an instruction and is marked
+// as an opcode.  "read" is a byte read by an instruction handler.  Reads that
+// follow on from the last pc are the instruction's operands and are marked
+// as code.  Other reads are marked as data, unless the byte is code.  The
+// first pc, and any pc that isn't right after the previous instruction and
+// the operands it read, is added as an entry point and marked as a jump
+// target.  Events for a bank other than the given bank are ignored, unless
+// bank is negative.  The CDL's bank is set to the given bank, and it's an
+// error if the CDL is for another bank.
+func (cdl *CodeDataLog) ImportTrace(r io.Reader, bank int) error {
+	if bank >= 0 {
+		if cdl.Bank != nil && *cdl.Bank != bank {
+			return fmt.Errorf("trace for bank %d cannot be merged into CDL for bank %d", bank, *cdl.Bank)
+		}
+		cdl.SetBank(bank)
+	}
+
+	scanner := bufio.NewScanner(r)
+	num := 0
+	operand := -1 // next operand byte of the current instruction, or the next pc
+	first := true
+	reads := []int{}
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+
+		kind := strings.ToLower(fields[0])
+		if first {
+			first = false
+			if kind != "pc" && kind != "read" {
+				// CSV header
+				continue
+			}
+		}
+
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: invalid trace line: %q", num, line)
+		}
+
+		addr, err := parseTraceNumber(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address: %q", num, fields[1])
+		}
+
+		if len(fields) > 2 && bank >= 0 {
+			b, err := parseTraceNumber(fields[2])
+			if err != nil {
+				return fmt.Errorf("line %d: invalid bank: %q", num, fields[2])
+			}
+
+			if b != bank {
+				continue
+			}
+		}
+
+		switch kind {
+		case "pc":
+			cdl.set(addr, cdlCode | cdlOpCode)
+			if addr != operand {
+				cdl.set(addr, cdlJumpTarget)
+				cdl.AddEntry(addr)
+			}
+			operand = addr+1
+
+		case "read":
+			if addr == operand {
+				cdl.set(addr, cdlCode | cdlOperand)
+				operand++
+				continue
+			}
+			reads = append(reads, addr)
+
+		default:
+			return fmt.Errorf("line %d: unknown trace event: %q", num, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// After the whole trace, so reads of code that ran later aren't data.
+	for _, addr := range reads {
+		if !cdl.IsCode(addr) {
+			cdl.setData(addr)
+		}
+	}
+	return nil
+}
+
+func parseTraceNumber(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(s), "$"), "0x")
+	val, err := strconv.ParseInt(s, 16, 32)
+	return int(val), err
+}
@@ -0,0 +1,629 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Translation file formats
+const (
+	StringsJson = "json"
+	StringsPo   = "po" // gettext
+)
+
+// push_data always reserves 32 bytes on the stack, including the NUL.
+const pushDataMax = 32
+
+// ScriptString is a string used by the script, either inline with push_data
+// or elsewhere in the script and referenced by push_string_from_table.
+type ScriptString struct {
+	Address     int    // address of the first byte of the string
+	Instruction string // instruction that uses the string
+	Sources     []int  // addresses of the instructions that use the string
+	Context     string // closest label before the first source
+
+	Data []byte // without the NUL terminator
+
+	// Replacement text.  Empty keeps the original data.
+	Translation string
+}
+
+// Text returns the original data in the escaped form used in translation
+// files.
+func (ss *ScriptString) Text() string {
+	return EncodeStringText(ss.Data)
+}
+
+// EncodeStringText converts bytes to text with CharTable.  Bytes that aren't
+// in the table are written as \xNN.
+func EncodeStringText(data []byte) string {
+	return CharTable.Text(data)
+}
+
+// DecodeStringText is the reverse of EncodeStringText.
+func DecodeStringText(text string) ([]byte, error) {
+	raw, err := CharTable.Bytes(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid string text %q: %w", text, err)
+	}
+	return raw, nil
+}
+
+// Strings returns every push_data and push_string_from_table string in the
+// script, sorted by address.  Strings for push_string_from_table are only
+// found when they are in the script and NUL terminated.
+func (s *Script) Strings() []*ScriptString {
+	tokenMap := make(map[int]*Token)
+	for _, t := range s.Tokens {
+		tokenMap[t.Offset] = t
+	}
+
+	found := make(map[int]*ScriptString)
+	for _, t := range s.Tokens {
+		if t.Instruction == nil || t.IsData {
+			continue
+		}
+
+		switch {
+		case t.Instruction.HasOperand(OperandString):
+			data := []byte{}
+			for _, v := range t.Inline {
+				data = append(data, v.Bytes()...)
+			}
+			if len(data) > 0 && data[len(data)-1] == 0x00 {
+				data = data[:len(data)-1]
+			}
+
+			found[t.Offset+1] = &ScriptString{
+				Address: t.Offset+1,
+				Instruction: t.Instruction.Name,
+				Sources: []int{t.Offset},
+				Data: data,
+			}
+
+		case t.Raw == 0xBC: // push_string_from_table
+			addr := t.Inline[0].Int()
+			if ss, ok := found[addr]; ok {
+				ss.Sources = append(ss.Sources, t.Offset)
+				continue
+			}
+
+			data, ok := s.dataString(tokenMap, addr)
+			if !ok {
+				continue
+			}
+
+			found[addr] = &ScriptString{
+				Address: addr,
+				Instruction: t.Instruction.Name,
+				Sources: []int{t.Offset},
+				Data: data,
+			}
+		}
+	}
+
+	list := []*ScriptString{}
+	for _, addr := range slices.Sorted(maps.Keys(found)) {
+		ss := found[addr]
+		ss.Context = s.contextLabel(ss.Sources[0])
+		list = append(list, ss)
+	}
+	return list
+}
+
+// dataString reads a NUL terminated string from the data tokens at addr.
+func (s *Script) dataString(tokenMap map[int]*Token, addr int) ([]byte, bool) {
+	data := []byte{}
+	for {
+		t, ok := tokenMap[addr]
+		if !ok || !t.IsData {
+			return nil, false
+		}
+
+		if t.Raw == 0x00 {
+			return data, true
+		}
+		data = append(data, t.Raw)
+		addr++
+	}
+}
+
+// contextLabel returns the name of the closest label at or before addr.
+func (s *Script) contextLabel(addr int) string {
+	best := -1
+	for a, lbl := range s.Labels {
+		if a <= addr && a > best && a >= s.StartAddress && lbl.Name != "" {
+			best = a
+		}
+	}
+
+	if best == -1 {
+		return ""
+	}
+
+	if best == addr {
+		return s.Labels[best].Name
+	}
+	return fmt.Sprintf("%s+%d", s.Labels[best].Name, addr-best)
+}
+
+// InjectStrings rebuilds the script with translated strings.  The script is
+// re-assembled from its disassembly, so every jump, call and variable that
+// uses a label is moved along with the code.  The script should come from
+// SmartParse so that data isn't decoded as instructions.
+//
+// Returned warnings list values that look like addresses but could not be
+// relocated.  An error is returned if the new script doesn't fit in the bank.
+func (s *Script) InjectStrings(list []*ScriptString) ([]byte, []string, error) {
+	replace := make(map[int][]byte)
+	for _, ss := range list {
+		if ss.Translation == "" {
+			continue
+		}
+
+		data, err := DecodeStringText(ss.Translation)
+		if err != nil {
+			return nil, nil, fmt.Errorf("string at $%04X: %w", ss.Address, err)
+		}
+
+		if slices.Contains(data, 0x00) {
+			return nil, nil, fmt.Errorf("string at $%04X: translation contains a NUL byte", ss.Address)
+		}
+		replace[ss.Address] = data
+	}
+
+	tokens := slices.Clone(s.Tokens)
+	slices.SortFunc(tokens, func(a, b *Token) int {
+		return a.Offset - b.Offset
+	})
+
+	tokenMap := make(map[int]*Token)
+	for _, t := range tokens {
+		tokenMap[t.Offset] = t
+	}
+
+	// Label addresses that don't start a token can't be moved.  They keep
+	// their address, as they aren't printed in the source.
+	warnings := []string{}
+	asm := NewAssembler()
+	end := s.StartAddress + s.origSize
+	for _, addr := range slices.Sorted(maps.Keys(s.Labels)) {
+		if addr < s.StartAddress+2 || addr >= end {
+			continue
+		}
+		if _, ok := tokenMap[addr]; !ok {
+			warnings = append(warnings, fmt.Sprintf("label %s at $%04X is inside an instruction and was not relocated",
+				s.Labels[addr].Name, addr))
+			if name := s.Labels[addr].Name; name != "" {
+				asm.Labels[name] = addr
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, ".stack $%04X\n", s.StackAddress)
+
+	first := -1
+	skip := 0
+	for _, t := range tokens {
+		if skip > 0 {
+			if lbl, ok := s.Labels[t.Offset]; ok && lbl.Name != "" {
+				return nil, nil, fmt.Errorf("label %s at $%04X is inside a translated string", lbl.Name, t.Offset)
+			}
+			skip--
+			continue
+		}
+
+		switch {
+		case t.Instruction != nil && !t.IsData && t.Instruction.HasOperand(OperandString):
+			data, ok := replace[t.Offset+1]
+			if !ok {
+				break
+			}
+
+			if len(data)+1 > pushDataMax {
+				return nil, nil, fmt.Errorf("string at $%04X is too long for %s: %d bytes (max %d)",
+					t.Offset+1, t.Instruction.Name, len(data), pushDataMax-1)
+			}
+
+			if first == -1 {
+				first = t.Offset
+			}
+
+			nt := *t
+			nt.Inline = []InlineVal{}
+			for _, b := range append(data, 0x00) {
+				nt.Inline = append(nt.Inline, ByteVal(b))
+			}
+			fmt.Fprintln(buf, nt.String(s.Labels, true))
+			continue
+
+		case t.IsData && t.Instruction == nil:
+			data, ok := replace[t.Offset]
+			if !ok {
+				break
+			}
+
+			orig, ok := s.dataString(tokenMap, t.Offset)
+			if !ok {
+				return nil, nil, fmt.Errorf("string at $%04X is not NUL terminated data", t.Offset)
+			}
+
+			if first == -1 {
+				first = t.Offset
+			}
+
+			// Keep the label line for the first byte and write the rest
+			// with .byte.
+			data = append(data, 0x00)
+			nt := *t
+			nt.Raw = data[0]
+			fmt.Fprintln(buf, nt.String(s.Labels, true))
+
+			vals := []string{}
+			for _, b := range data[1:] {
+				vals = append(vals, fmt.Sprintf("$%02X", b))
+			}
+			if len(vals) > 0 {
+				fmt.Fprintln(buf, "    .byte "+strings.Join(vals, ", "))
+			}
+
+			skip = len(orig)
+			continue
+		}
+
+		fmt.Fprintln(buf, t.String(s.Labels, true))
+	}
+
+	if first == -1 {
+		// Nothing to translate
+		warnings = append(warnings, "no strings were translated")
+	} else {
+		warnings = append(warnings, s.unrelocatedWords(first)...)
+	}
+
+	raw, err := asm.AssembleScript(buf, s.StartAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to rebuild script: %w", err)
+	}
+
+	bankEnd := (s.StartAddress &^ 0x1FFF) + 0x2000
+	if s.StartAddress+len(raw) > bankEnd {
+		return nil, nil, fmt.Errorf("script overflows the bank by %d bytes (ends at $%04X)",
+			s.StartAddress+len(raw)-bankEnd, s.StartAddress+len(raw)-1)
+	}
+
+	return raw, warnings, nil
+}
+
+// unrelocatedWords finds push_word values and words in data, eg pointer
+// tables, that point into the script after the first changed string.  These
+// may be addresses, but there is no way to know for sure.
+func (s *Script) unrelocatedWords(first int) []string {
+	warnings := []string{}
+	end := s.StartAddress + s.origSize
+	data := make(map[int]byte)
+	for _, t := range s.Tokens {
+		if t.Raw != 0xB8 || t.Instruction == nil || t.IsData || len(t.Inline) != 1 || t.codePush {
+			continue
+		}
+
+		val := t.Inline[0].Int()
+		if val > first && val < end {
+			warnings = append(warnings, fmt.Sprintf("push_word $%04X at $%04X may be an address and was not relocated",
+				val, t.Offset))
+		}
+	}
+
+	if s.CDL == nil {
+		return warnings
+	}
+
+	for _, t := range s.Tokens {
+		if t.IsData && t.Instruction == nil {
+			data[t.Offset] = t.Raw
+		}
+	}
+
+	isWord := func(addr int) bool {
+		bit := s.CDL.get(addr)
+		_, ok := data[addr]
+		return ok && bit & (cdlData | cdlWord) == cdlData | cdlWord && bit & cdlCode == 0
+	}
+
+	for addr := s.StartAddress+2; addr+1 < end; addr++ {
+		if !isWord(addr) || !isWord(addr+1) {
+			continue
+		}
+
+		val := int(data[addr]) | int(data[addr+1])<<8
+		if val > first && val < end {
+			warnings = append(warnings, fmt.Sprintf("data word $%04X at $%04X may be an address and was not relocated",
+				val, addr))
+		}
+		addr++ // high byte
+	}
+	return warnings
+}
+
+// StringsFormatFromFilename picks a translation file format from the file
+// extension.
+func StringsFormatFromFilename(filename string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	switch ext {
+	case StringsJson, StringsPo:
+		return ext, nil
+	}
+	return "", fmt.Errorf("unknown translation file format: %q", filepath.Ext(filename))
+}
+
+type JsonScriptString struct {
+	Address     string
+	Instruction string
+	Sources     []string
+	Context     string `json:",omitempty"`
+	Original    string
+	Translation string
+}
+
+func WriteStringsFile(filename string, list []*ScriptString) error {
+	format, err := StringsFormatFromFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return WriteStrings(file, list, format)
+}
+
+// WriteStrings writes a translation file.  In PO files the address is used as
+// msgctxt so identical strings get their own entries.
+func WriteStrings(w io.Writer, list []*ScriptString, format string) error {
+	switch format {
+	case StringsJson:
+		out := []JsonScriptString{}
+		for _, ss := range list {
+			js := JsonScriptString{
+				Address: fmt.Sprintf("$%04X", ss.Address),
+				Instruction: ss.Instruction,
+				Sources: []string{},
+				Context: ss.Context,
+				Original: ss.Text(),
+				Translation: ss.Translation,
+			}
+			for _, src := range ss.Sources {
+				js.Sources = append(js.Sources, fmt.Sprintf("$%04X", src))
+			}
+			out = append(out, js)
+		}
+
+		raw, err := json.MarshalIndent(out, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(raw, '\n'))
+		return err
+
+	case StringsPo:
+		fmt.Fprintln(w, "msgid \"\"")
+		fmt.Fprintln(w, "msgstr \"\"")
+		fmt.Fprintln(w, "\"Content-Type: text/plain; charset=UTF-8\\n\"")
+
+		for _, ss := range list {
+			srcs := []string{}
+			for _, src := range ss.Sources {
+				srcs = append(srcs, fmt.Sprintf("$%04X", src))
+			}
+
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "#. %s %s\n", ss.Instruction, ss.Context)
+			fmt.Fprintf(w, "#: %s\n", strings.Join(srcs, " "))
+			fmt.Fprintf(w, "msgctxt \"$%04X\"\n", ss.Address)
+			fmt.Fprintf(w, "msgid \"%s\"\n", ss.Text())
+			fmt.Fprintf(w, "msgstr \"%s\"\n", ss.Translation)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown translation file format: %q", format)
+}
+
+func ReadStringsFile(filename string) ([]*ScriptString, error) {
+	format, err := StringsFormatFromFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadStrings(file, format)
+}
+
+// ReadStrings reads a translation file.  Use MatchStrings to apply the
+// translations to the strings found in a script.
+func ReadStrings(r io.Reader, format string) ([]*ScriptString, error) {
+	switch format {
+	case StringsJson:
+		jlist := []JsonScriptString{}
+		err := json.NewDecoder(r).Decode(&jlist)
+		if err != nil {
+			return nil, err
+		}
+
+		list := []*ScriptString{}
+		for _, js := range jlist {
+			addr, err := parseNumber(js.Address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", js.Address)
+			}
+
+			data, err := DecodeStringText(js.Original)
+			if err != nil {
+				return nil, fmt.Errorf("string at %s: %w", js.Address, err)
+			}
+
+			list = append(list, &ScriptString{
+				Address: addr,
+				Instruction: js.Instruction,
+				Context: js.Context,
+				Data: data,
+				Translation: js.Translation,
+			})
+		}
+		return list, nil
+
+	case StringsPo:
+		return readPoStrings(r)
+	}
+
+	return nil, fmt.Errorf("unknown translation file format: %q", format)
+}
+
+func readPoStrings(r io.Reader) ([]*ScriptString, error) {
+	list := []*ScriptString{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+
+	var current *ScriptString
+	var field *string
+	var msgid, msgstr string
+
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+
+		data, err := DecodeStringText(msgid)
+		if err != nil {
+			return fmt.Errorf("string at $%04X: %w", current.Address, err)
+		}
+		current.Data = data
+		current.Translation = msgstr
+		list = append(list, current)
+		current = nil
+		return nil
+	}
+
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, "msgctxt "):
+			if err := finish(); err != nil {
+				return nil, err
+			}
+
+			ctx, err := poQuoted(line[len("msgctxt "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", num, err)
+			}
+
+			addr, err := parseNumber(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid address %q", num, ctx)
+			}
+			current = &ScriptString{Address: addr}
+			msgid, msgstr = "", ""
+			field = nil
+
+		case strings.HasPrefix(line, "msgid "):
+			if current == nil {
+				// header entry
+				field = nil
+				continue
+			}
+			val, err := poQuoted(line[len("msgid "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", num, err)
+			}
+			msgid = val
+			field = &msgid
+
+		case strings.HasPrefix(line, "msgstr "):
+			if current == nil {
+				field = nil
+				continue
+			}
+			val, err := poQuoted(line[len("msgstr "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", num, err)
+			}
+			msgstr = val
+			field = &msgstr
+
+		case strings.HasPrefix(line, "\""):
+			// continuation line
+			val, err := poQuoted(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", num, err)
+			}
+			if field != nil {
+				*field += val
+			}
+
+		default:
+			return nil, fmt.Errorf("line %d: invalid po line: %q", num, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// poQuoted returns the contents of a quoted PO string without unescaping it.
+func poQuoted(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || !strings.HasPrefix(s, "\"") || !strings.HasSuffix(s, "\"") {
+		return "", fmt.Errorf("expected quoted string: %s", s)
+	}
+	return s[1:len(s)-1], nil
+}
+
+// MatchStrings copies translations from a translation file onto the strings
+// found in the script.  The original text in the file must match the script.
+func MatchStrings(found, translated []*ScriptString) error {
+	byAddr := make(map[int]*ScriptString)
+	for _, ss := range found {
+		byAddr[ss.Address] = ss
+	}
+
+	for _, tr := range translated {
+		ss, ok := byAddr[tr.Address]
+		if !ok {
+			return fmt.Errorf("no string at $%04X in script", tr.Address)
+		}
+
+		if !bytes.Equal(ss.Data, tr.Data) {
+			return fmt.Errorf("original string at $%04X does not match the script: %q", tr.Address, tr.Text())
+		}
+		ss.Translation = tr.Translation
+	}
+	return nil
+}
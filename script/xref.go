@@ -0,0 +1,218 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"encoding/json"
+	"slices"
+	"maps"
+	"strings"
+)
+
+type XrefType int
+
+const (
+	XrefJump XrefType = iota
+	XrefCall
+	XrefRead
+	XrefWrite
+)
+
+func (xt XrefType) String() string {
+	switch xt {
+	case XrefJump:
+		return "jump"
+	case XrefCall:
+		return "call"
+	case XrefRead:
+		return "read"
+	case XrefWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// Xref is a single reference to an address from an instruction.
+type Xref struct {
+	Source int // address of the referencing instruction
+	Target int
+	Type   XrefType
+	Instruction *Instruction
+	Native      *NativeOp // set instead of Instruction for 6502 code
+}
+
+func (x Xref) String() string {
+	return fmt.Sprintf("$%04X %s (%s)", x.Source, x.mnemonic(), x.Type)
+}
+
+func (x Xref) mnemonic() string {
+	if x.Native != nil {
+		return x.Native.Name
+	}
+	return x.Instruction.String()
+}
+
+type JsonXref struct {
+	Source string
+	Type string
+	Instruction string
+}
+
+type JsonXrefTarget struct {
+	Address string
+	Label string `json:",omitempty"`
+	References []JsonXref
+}
+
+// BuildXrefs (re)builds the cross-reference index from the parsed tokens.
+// Tokens that are the target of a reference get their Xrefs field populated
+// as well.
+func (s *Script) BuildXrefs() {
+	s.Xrefs = make(map[int][]*Xref)
+	tokenMap := make(map[int]*Token)
+
+	for _, t := range s.Tokens {
+		t.Xrefs = nil
+		tokenMap[t.Offset] = t
+	}
+
+	for _, t := range s.Tokens {
+		if t.Native != nil {
+			s.addNativeXref(t)
+			continue
+		}
+
+		if t.Instruction == nil || t.IsData {
+			continue
+		}
+
+		types := t.InlineTypes()
+		for i := range t.Inline {
+			switch types[i] {
+			case OperandAsmAddr:
+				s.addXref(t, i, XrefCall)
+
+			case OperandCodeAddr:
+				switch t.Raw {
+				case 0x85, 0xEE: // call_abs, call_switch
+					s.addXref(t, i, XrefCall)
+				default:
+					s.addXref(t, i, XrefJump)
+				}
+
+			case OperandDataAddr:
+				switch t.Raw {
+				case 0xBD, 0xBE, 0x8A, 0xEA: // pop_into, write_to_table, pop_string_to_addr, string_write_to_table
+					s.addXref(t, i, XrefWrite)
+				default:
+					s.addXref(t, i, XrefRead)
+				}
+			}
+		}
+	}
+
+	for addr, refs := range s.Xrefs {
+		slices.SortFunc(refs, func(a, b *Xref) int {
+			return a.Source - b.Source
+		})
+
+		if tok, ok := tokenMap[addr]; ok {
+			tok.Xrefs = refs
+		}
+	}
+}
+
+func (s *Script) addXref(t *Token, idx int, xt XrefType) {
+	if len(t.Inline) <= idx {
+		return
+	}
+
+	target := t.Inline[idx].Int()
+	s.Xrefs[target] = append(s.Xrefs[target], &Xref{
+		Source: t.Offset,
+		Target: target,
+		Type: xt,
+		Instruction: t.Instruction,
+	})
+}
+
+// addNativeXref adds the reference from a 6502 instruction.  Stores are
+// writes, and anything else with an address that isn't a jump is a read.
+func (s *Script) addNativeXref(t *Token) {
+	target, ok := t.NativeTarget()
+	if !ok || t.Native.Mode == ModeIndirect {
+		return
+	}
+
+	xt := XrefRead
+	switch {
+	case t.Native.IsCall():
+		xt = XrefCall
+	case t.Native.IsBranch():
+		xt = XrefJump
+	case strings.HasPrefix(t.Native.Name, "st"),
+		slices.Contains([]string{"asl", "lsr", "rol", "ror", "inc", "dec"}, t.Native.Name):
+		xt = XrefWrite
+	}
+
+	s.Xrefs[target] = append(s.Xrefs[target], &Xref{
+		Source: t.Offset,
+		Target: target,
+		Type: xt,
+		Native: t.Native,
+	})
+}
+
+// XrefsTo returns all the references to the given address.
+func (s *Script) XrefsTo(addr int) []*Xref {
+	if s.Xrefs == nil {
+		return nil
+	}
+	return s.Xrefs[addr]
+}
+
+func (s *Script) WriteXrefsToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.WriteXrefs(file)
+}
+
+// WriteXrefs writes the cross-reference index as JSON, sorted by target
+// address.
+func (s *Script) WriteXrefs(w io.Writer) error {
+	slice := []JsonXrefTarget{}
+	for _, addr := range slices.Sorted(maps.Keys(s.Xrefs)) {
+		target := JsonXrefTarget{
+			Address: fmt.Sprintf("0x%X", addr),
+			References: []JsonXref{},
+		}
+
+		if lbl, ok := s.Labels[addr]; ok {
+			target.Label = lbl.Name
+		}
+
+		for _, x := range s.Xrefs[addr] {
+			target.References = append(target.References, JsonXref{
+				Source: fmt.Sprintf("0x%X", x.Source),
+				Type: x.Type.String(),
+				Instruction: x.mnemonic(),
+			})
+		}
+
+		slice = append(slice, target)
+	}
+
+	raw, err := json.MarshalIndent(slice, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(raw)
+	return err
+}